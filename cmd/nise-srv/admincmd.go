@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/spf13/cobra"
+	"text/tabwriter"
+	"time"
+)
+
+// newAdminCommand creates the admin command, for maintenance tasks on the data dir. The commands work on the
+// database directly and don't need the server to be running.
+func (a *Application) newAdminCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "admin",
+		Short: "Manage users and maintain the data of the data dir",
+	}
+	command.AddCommand(
+		a.newAdminUsersCommand(),
+		a.newAdminUsageCommand(),
+		a.newAdminPurgeCommand(),
+		a.newAdminResetStuckCommand(),
+		a.newAdminVacuumAttachmentsCommand(),
+		a.newAdminRetentionCommand(),
+		a.newAdminEmptyTrashCommand(),
+	)
+	return command
+}
+
+func (a *Application) newAdminUsersCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "users",
+		Short: "Create, list, verify and disable users",
+	}
+
+	listCommand := &cobra.Command{
+		Use:          "list",
+		Short:        "List users",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			users, err := a.PB.FindAllRecords("users")
+			if err != nil {
+				return fmt.Errorf("failed to find users: %w", err)
+			}
+			out := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(out, "ID\tEMAIL\tNAME\tVERIFIED\tDISABLED\tCREATED")
+			for _, user := range users {
+				fmt.Fprintf(out, "%s\t%s\t%s\t%t\t%t\t%s\n",
+					user.Id, user.Email(), user.GetString("name"), user.Verified(), user.GetBool("disabled"), user.GetString("created"))
+			}
+			return out.Flush()
+		},
+	}
+
+	var name string
+	var verified bool
+	createCommand := &cobra.Command{
+		Use:          "create <email> <password>",
+		Short:        "Create a user",
+		Args:         cobra.ExactArgs(2),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			usersCollection, err := a.PB.FindCollectionByNameOrId("users")
+			if err != nil {
+				return fmt.Errorf("failed to find users collection: %w", err)
+			}
+			user := core.NewRecord(usersCollection)
+			user.SetEmail(args[0])
+			user.SetPassword(args[1])
+			user.SetVerified(verified)
+			user.Set("name", name)
+			if err := a.PB.Save(user); err != nil {
+				return fmt.Errorf("failed to create user: %w", err)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Created user %s (%s)\n", user.Email(), user.Id)
+			return nil
+		},
+	}
+	createCommand.Flags().StringVar(&name, "name", "", "display name of the user")
+	createCommand.Flags().BoolVar(&verified, "verified", false, "mark the email of the user as verified")
+
+	// updateUser returns a command applying a change to the user with the given email
+	updateUser := func(use, short, done string, update func(user *core.Record)) *cobra.Command {
+		return &cobra.Command{
+			Use:          use + " <email>",
+			Short:        short,
+			Args:         cobra.ExactArgs(1),
+			SilenceUsage: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				user, err := a.PB.FindAuthRecordByEmail("users", args[0])
+				if err != nil {
+					return fmt.Errorf("user %s not found: %w", args[0], err)
+				}
+				update(user)
+				if err := a.PB.Save(user); err != nil {
+					return fmt.Errorf("failed to save user: %w", err)
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%s user %s\n", done, user.Email())
+				return nil
+			},
+		}
+	}
+
+	command.AddCommand(
+		listCommand,
+		createCommand,
+		updateUser("verify", "Mark the email of a user as verified", "Verified", func(user *core.Record) {
+			user.SetVerified(true)
+		}),
+		updateUser("disable", "Prevent a user from signing in and invalidate their sessions and tokens", "Disabled", func(user *core.Record) {
+			user.Set("disabled", true)
+			// Invalidates the auth tokens already issued, access tokens are rejected while the user is disabled
+			user.RefreshTokenKey()
+		}),
+		updateUser("enable", "Allow a disabled user to sign in again", "Enabled", func(user *core.Record) {
+			user.Set("disabled", false)
+		}),
+	)
+	return command
+}
+
+func (a *Application) newAdminUsageCommand() *cobra.Command {
+	var since string
+	command := &cobra.Command{
+		Use:          "usage",
+		Short:        "List threads, responses and token usage per user",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var sinceDate types.DateTime
+			if since != "" {
+				sinceTime, err := time.Parse(time.DateOnly, since)
+				if err != nil {
+					return fmt.Errorf("invalid --since date, expected YYYY-MM-DD: %w", err)
+				}
+				sinceDate, _ = types.ParseDateTime(sinceTime)
+			}
+
+			usage, err := a.usageByUser(sinceDate)
+			if err != nil {
+				return err
+			}
+			out := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(out, "EMAIL\tTHREADS\tRESPONSES\tPROMPT TOKENS\tCOMPLETION TOKENS\tLAST RESPONSE")
+			for _, user := range usage {
+				fmt.Fprintf(out, "%s\t%d\t%d\t%d\t%d\t%s\n",
+					user.Email, user.Threads, user.Messages, user.PromptTokens, user.CompletionTokens, user.LastActive)
+			}
+			return out.Flush()
+		},
+	}
+	command.Flags().StringVar(&since, "since", "", "only count responses from this date, as YYYY-MM-DD")
+	return command
+}
+
+func (a *Application) newAdminPurgeCommand() *cobra.Command {
+	var yes bool
+	command := &cobra.Command{
+		Use:          "purge <email>",
+		Short:        "Delete all threads, messages and attachments of a user",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			user, err := a.PB.FindAuthRecordByEmail("users", args[0])
+			if err != nil {
+				return fmt.Errorf("user %s not found: %w", args[0], err)
+			}
+			if !yes {
+				threads, err := a.PB.CountRecords("threads", dbx.HashExp{"owner_user_id": user.Id})
+				if err != nil {
+					return fmt.Errorf("failed to count threads of user: %w", err)
+				}
+				return fmt.Errorf("this would delete %d threads of %s, run again with --yes to confirm", threads, user.Email())
+			}
+
+			purged, err := a.purgeUserThreads(user.Id)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Deleted %d threads of %s\n", purged, user.Email())
+			return nil
+		},
+	}
+	command.Flags().BoolVar(&yes, "yes", false, "confirm the deletion")
+	return command
+}
+
+func (a *Application) newAdminResetStuckCommand() *cobra.Command {
+	var olderThan time.Duration
+	command := &cobra.Command{
+		Use:          "reset-stuck",
+		Short:        "Mark messages left pending or generating, e.g. after a crash, as failed",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			reset, err := a.resetStuckMessages(olderThan)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Reset %d stuck messages\n", reset)
+			return nil
+		},
+	}
+	command.Flags().DurationVar(&olderThan, "older-than", 0, "only reset messages not updated for this long, e.g. 10m when the server is running")
+	return command
+}
+
+func (a *Application) newAdminVacuumAttachmentsCommand() *cobra.Command {
+	var dryRun bool
+	command := &cobra.Command{
+		Use:          "vacuum-attachments",
+		Short:        "Delete attachment files no message refers to anymore",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			orphans, err := a.vacuumAttachments(dryRun)
+			for _, key := range orphans {
+				fmt.Fprintln(cmd.OutOrStdout(), key)
+			}
+			if err != nil {
+				return err
+			}
+			if dryRun {
+				fmt.Fprintf(cmd.OutOrStdout(), "Found %d orphaned files\n", len(orphans))
+			} else {
+				fmt.Fprintf(cmd.OutOrStdout(), "Deleted %d orphaned files\n", len(orphans))
+			}
+			return nil
+		},
+	}
+	command.Flags().BoolVar(&dryRun, "dry-run", false, "only list the orphaned files")
+	return command
+}
+
+func (a *Application) newAdminRetentionCommand() *cobra.Command {
+	var dryRun bool
+	command := &cobra.Command{
+		Use:          "retention",
+		Short:        "Enforce the retention policies now instead of waiting for the nightly job",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			results, err := a.enforceRetention(dryRun)
+			out := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(out, "USER\tTHREAD MAX AGE\tATTACHMENT MAX AGE\tTHREADS\tMESSAGES WITH ATTACHMENTS")
+			for _, result := range results {
+				fmt.Fprintf(out, "%s\t%dd\t%dd\t%d\t%d\n",
+					result.UserID, result.Policy.ThreadMaxAgeDays, result.Policy.AttachmentMaxAgeDays, len(result.Threads), len(result.Attachments))
+			}
+			if flushErr := out.Flush(); err == nil {
+				err = flushErr
+			}
+			if err != nil {
+				return err
+			}
+			if dryRun {
+				fmt.Fprintln(cmd.OutOrStdout(), "Dry run, nothing was purged")
+			}
+			return nil
+		},
+	}
+	command.Flags().BoolVar(&dryRun, "dry-run", false, "only list what would be purged")
+	return command
+}
+
+func (a *Application) newAdminEmptyTrashCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:          "empty-trash",
+		Short:        "Permanently delete the threads in the trash for longer than --trashRetentionDays",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			purged, err := a.purgeTrashedThreads(a.TrashRetentionDays)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Deleted %d trashed threads\n", purged)
+			return nil
+		},
+	}
+	return command
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/pocketbase/dbx"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+const testResponseModel = `{"providerId":"test/model"}`
+
+func TestCreateThread(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("user@example.com")
+
+	threadID, responseID := s.createThread(user, "Hello there")
+
+	response := s.waitMessage(responseID)
+	if status := MessageStatus(response.GetString("status")); status != MessageStatusCompleted {
+		t.Fatalf("Response status is %s, expected %s", status, MessageStatusCompleted)
+	}
+	if content := messageParts(t, response).Content; content != "Reply to: Hello there" {
+		t.Errorf("Response content is %q", content)
+	}
+	if response.GetString("parent_thread_id") != threadID {
+		t.Errorf("Response is in thread %s, expected %s", response.GetString("parent_thread_id"), threadID)
+	}
+
+	userMessage, err := s.App.PB.FindRecordById("messages", response.GetString("parent_message_id"))
+	if err != nil {
+		t.Fatalf("Failed to find the user message: %v", err)
+	}
+	if content := messageParts(t, userMessage).Content; content != "Hello there" {
+		t.Errorf("User message content is %q", content)
+	}
+
+	thread, err := s.App.PB.FindRecordById("threads", threadID)
+	if err != nil {
+		t.Fatalf("Failed to find the thread: %v", err)
+	}
+	if thread.GetString("owner_user_id") != user.ID {
+		t.Errorf("Thread is owned by %s, expected %s", thread.GetString("owner_user_id"), user.ID)
+	}
+	if title := thread.GetString("title"); title != testTitle {
+		t.Errorf("Thread title is %q, expected %q", title, testTitle)
+	}
+}
+
+func TestCreateThreadRequiresAuth(t *testing.T) {
+	s := newTestServer(t)
+
+	res := s.postForm(testUser{}, "/api/threads", map[string]string{
+		"content":       "Hello there",
+		"responseModel": testResponseModel,
+	})
+	s.decode(res, http.StatusUnauthorized, nil)
+}
+
+func TestCreateThreadInvalidInput(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("user@example.com")
+
+	res := s.postForm(user, "/api/threads", map[string]string{"responseModel": testResponseModel})
+	s.decode(res, http.StatusBadRequest, nil)
+
+	res = s.postForm(user, "/api/threads", map[string]string{"content": "Hello there", "responseModel": "{"})
+	s.decode(res, http.StatusBadRequest, nil)
+}
+
+func TestSendMessageInThread(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("user@example.com")
+	threadID, firstResponseID := s.createThread(user, "First question")
+	s.waitMessage(firstResponseID)
+
+	var output struct {
+		UserMessageID     string `json:"userMessageId"`
+		ResponseMessageID string `json:"responseMessageId"`
+	}
+	res := s.postForm(user, "/api/threads/"+threadID+"/messages", map[string]string{
+		"content":         "Second question",
+		"parentMessageId": firstResponseID,
+		"responseModel":   testResponseModel,
+	})
+	s.decode(res, http.StatusOK, &output)
+
+	response := s.waitMessage(output.ResponseMessageID)
+	if content := messageParts(t, response).Content; content != "Reply to: Second question" {
+		t.Errorf("Response content is %q", content)
+	}
+	if response.GetString("parent_message_id") != output.UserMessageID {
+		t.Errorf("Response parent is %s, expected %s", response.GetString("parent_message_id"), output.UserMessageID)
+	}
+
+	// The transcript sent upstream is the branch of the thread up to the new message
+	last := s.Upstream.lastRequest(t)
+	var roles, texts []string
+	for _, message := range last.Messages {
+		if message.Role == MessageRoleSystem.String() {
+			continue
+		}
+		roles = append(roles, message.Role)
+		texts = append(texts, last.text(message.Content))
+	}
+	expectedTexts := []string{"First question", "Reply to: First question", "Second question"}
+	if len(texts) != len(expectedTexts) {
+		t.Fatalf("Upstream transcript is %v %q, expected %q", roles, texts, expectedTexts)
+	}
+	for i, text := range expectedTexts {
+		if texts[i] != text {
+			t.Errorf("Upstream message %d is %s %q, expected %q", i, roles[i], texts[i], text)
+		}
+	}
+}
+
+func TestSendMessageInOtherUsersThread(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.createUser("owner@example.com")
+	other := s.createUser("other@example.com")
+	threadID, responseID := s.createThread(owner, "Hello there")
+	s.waitMessage(responseID)
+
+	res := s.postForm(other, "/api/threads/"+threadID+"/messages", map[string]string{
+		"content":         "Let me in",
+		"parentMessageId": responseID,
+		"responseModel":   testResponseModel,
+	})
+	s.decode(res, http.StatusNotFound, nil)
+
+	res = s.do(other, http.MethodGet, "/api/messages/"+responseID+"/stream", nil, "", nil)
+	s.decode(res, http.StatusNotFound, nil)
+}
+
+func TestEditMessage(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("user@example.com")
+	threadID, responseID := s.createThread(user, "Original question")
+	originalResponse := s.waitMessage(responseID)
+	originalUserMessageID := originalResponse.GetString("parent_message_id")
+
+	res := s.sendJSON(user, http.MethodPatch, "/api/messages/"+originalUserMessageID, map[string]any{
+		"content":       "Edited question",
+		"responseModel": map[string]any{"providerId": "test/model"},
+	})
+	s.decode(res, http.StatusOK, nil)
+
+	userMessages, err := s.App.PB.FindAllRecords("messages", dbx.HashExp{
+		"parent_thread_id": threadID,
+		"role":             MessageRoleUser.String(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to find the user messages: %v", err)
+	}
+	if len(userMessages) != 2 {
+		t.Fatalf("Thread has %d user messages, expected the original and the edited one", len(userMessages))
+	}
+	edited := userMessages[0]
+	if edited.Id == originalUserMessageID {
+		edited = userMessages[1]
+	}
+	var meta MessageMeta
+	if err := edited.UnmarshalJSONField("meta", &meta); err != nil {
+		t.Fatalf("Failed to unmarshal the meta of the edited message: %v", err)
+	}
+	if !meta.Edited || meta.OriginalMessageID != originalUserMessageID {
+		t.Errorf("Edited message meta is %+v, expected it edited from %s", meta, originalUserMessageID)
+	}
+	if content := messageParts(t, edited).Content; content != "Edited question" {
+		t.Errorf("Edited message content is %q", content)
+	}
+
+	response, err := s.App.PB.FindFirstRecordByData("messages", "parent_message_id", edited.Id)
+	if err != nil {
+		t.Fatalf("Failed to find the response to the edited message: %v", err)
+	}
+	response = s.waitMessage(response.Id)
+	if content := messageParts(t, response).Content; content != "Reply to: Edited question" {
+		t.Errorf("Response content is %q", content)
+	}
+
+	// The original branch is kept
+	originalResponse = s.waitMessage(responseID)
+	if content := messageParts(t, originalResponse).Content; content != "Reply to: Original question" {
+		t.Errorf("Original response content is %q", content)
+	}
+}
+
+func TestRegenerateMessage(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("user@example.com")
+	threadID, responseID := s.createThread(user, "Hello there")
+	original := s.waitMessage(responseID)
+
+	s.Upstream.Script = func(request mockRequest) MockScript {
+		return MockScript{Content: []string{"Another ", "answer"}}
+	}
+
+	var output struct {
+		MessageID string `json:"messageId"`
+	}
+	res := s.sendJSON(user, http.MethodPost, "/api/threads/"+threadID+"/messages/"+responseID+"/regenerate", map[string]any{
+		"responseModel": map[string]any{"providerId": "test/other-model"},
+	})
+	s.decode(res, http.StatusOK, &output)
+	if output.MessageID == "" || output.MessageID == responseID {
+		t.Fatalf("Regeneration returned message %q", output.MessageID)
+	}
+
+	regenerated := s.waitMessage(output.MessageID)
+	if content := messageParts(t, regenerated).Content; content != "Another answer" {
+		t.Errorf("Regenerated content is %q", content)
+	}
+	if regenerated.GetString("parent_message_id") != original.GetString("parent_message_id") {
+		t.Errorf("Regenerated message is not a sibling of the original one")
+	}
+	if model := regenerated.GetString("model"); model != "test/other-model" {
+		t.Errorf("Regenerated message model is %s", model)
+	}
+
+	// Assistant messages can be regenerated, user messages can't
+	res = s.sendJSON(user, http.MethodPost, "/api/threads/"+threadID+"/messages/"+original.GetString("parent_message_id")+"/regenerate", map[string]any{
+		"responseModel": map[string]any{"providerId": "test/model"},
+	})
+	s.decode(res, http.StatusInternalServerError, nil)
+}
+
+func TestStreamReplay(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("user@example.com")
+	s.Upstream.Script = func(request mockRequest) MockScript {
+		return MockScript{
+			Reasoning: []string{"Thinking"},
+			Content:   []string{"one ", "two ", "three"},
+			DelayMs:   20,
+		}
+	}
+	_, responseID := s.createThread(user, "Count to three")
+
+	chunks := s.readStream(user, responseID, 0)
+	if content := chunksContent(chunks); content != "one two three" {
+		t.Errorf("Streamed content is %q", content)
+	}
+	finish := chunks[len(chunks)-2]
+	if finish.Type != ChunkTypeFinishReason || finish.Content != FinishReasonStop.String() {
+		t.Errorf("Chunk before the stats is %+v, expected the stop finish reason", finish)
+	}
+	if last := chunks[len(chunks)-1]; last.Type != ChunkTypeStats {
+		t.Errorf("Last chunk is %+v, expected the stats", last)
+	}
+	for i := 1; i < len(chunks); i++ {
+		if chunks[i].ID <= chunks[i-1].ID {
+			t.Fatalf("Chunk IDs are not increasing: %+v", chunks)
+		}
+	}
+
+	// Reconnecting clients only get the chunks after the last one they received
+	s.waitMessage(responseID)
+	lastEventID := chunks[1].ID
+	replayed := s.readStream(user, responseID, lastEventID)
+	var expected []Chunk
+	for _, chunk := range chunks {
+		if chunk.ID > lastEventID {
+			expected = append(expected, chunk)
+		}
+	}
+	if chunksContent(replayed) != chunksContent(expected) || len(replayed) == 0 || replayed[0].ID <= lastEventID {
+		t.Errorf("Replayed chunks after %d are %+v, expected %+v", lastEventID, replayed, expected)
+	}
+
+	// Messages no longer held in memory are rebuilt from the stored parts
+	s.App.StreamService.activeStreams.Delete(responseID)
+	stored := s.readStream(user, responseID, 0)
+	if content := chunksContent(stored); content != "one two three" {
+		t.Errorf("Stored content is %q", content)
+	}
+	if stored[0].Type != ChunkTypeReasoning || stored[0].Content != "Thinking" {
+		t.Errorf("First stored chunk is %+v, expected the reasoning", stored[0])
+	}
+
+	// Clients resuming after the retention window are told to drop what they had before the whole message
+	resumed := s.readStream(user, responseID, lastEventID)
+	if len(resumed) == 0 || resumed[0].Type != ChunkTypeReset {
+		t.Fatalf("Chunks resumed after %d from the stored parts are %+v, expected a reset first", lastEventID, resumed)
+	}
+	if content := chunksContent(resumed[1:]); content != "one two three" {
+		t.Errorf("Content resumed from the stored parts is %q", content)
+	}
+}
+
+func TestStreamStats(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("user@example.com")
+	s.Upstream.Script = func(request mockRequest) MockScript {
+		return MockScript{
+			Reasoning: []string{"Let me ", "think"},
+			Content:   []string{"Done ", "thinking"},
+			DelayMs:   50,
+		}
+	}
+	_, responseID := s.createThread(user, "Think about it")
+
+	chunks := s.readStream(user, responseID, 0)
+	last := chunks[len(chunks)-1]
+	if last.Type != ChunkTypeStats {
+		t.Fatalf("Last chunk is %+v, expected the stats", last)
+	}
+	var streamed StreamStats
+	if err := json.Unmarshal([]byte(last.Content), &streamed); err != nil {
+		t.Fatalf("Invalid stats chunk: %v", err)
+	}
+
+	response := s.waitMessage(responseID)
+	var meta MessageMeta
+	if err := response.UnmarshalJSONField("meta", &meta); err != nil {
+		t.Fatalf("Failed to unmarshal the meta of the response: %v", err)
+	}
+	if meta.Stats != streamed {
+		t.Errorf("Stored stats %+v differ from the streamed ones %+v", meta.Stats, streamed)
+	}
+	// Each of the 4 chunks is delayed, the first one before the first token, and the content comes after 2 of them
+	if meta.Stats.TimeToFirstTokenMs < 40 {
+		t.Errorf("Time to first token is %dms, expected at least one chunk delay", meta.Stats.TimeToFirstTokenMs)
+	}
+	if meta.Stats.ReasoningMs < 90 {
+		t.Errorf("Reasoning took %dms, expected at least two chunk delays", meta.Stats.ReasoningMs)
+	}
+	if meta.Stats.TotalMs < meta.Stats.TimeToFirstTokenMs+meta.Stats.ReasoningMs {
+		t.Errorf("Total time %dms is shorter than its parts", meta.Stats.TotalMs)
+	}
+	if meta.Stats.TokensPerSecond <= 0 {
+		t.Errorf("Tokens per second is %v", meta.Stats.TokensPerSecond)
+	}
+}
+
+func TestSearchThreads(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("user@example.com")
+	other := s.createUser("other@example.com")
+	penguinsID, penguinsResponseID := s.createThread(user, "Tell me about penguins")
+	pastaID, pastaResponseID := s.createThread(user, "How do I cook pasta")
+	_, otherResponseID := s.createThread(other, "Penguins are great")
+	for _, id := range []string{penguinsResponseID, pastaResponseID, otherResponseID} {
+		s.waitMessage(id)
+	}
+
+	search := func(query string) []SearchResultThread {
+		t.Helper()
+		var output struct {
+			Threads []SearchResultThread `json:"threads"`
+		}
+		res := s.do(user, http.MethodGet, "/api/threads/search?query="+url.QueryEscape(query), nil, "", nil)
+		s.decode(res, http.StatusOK, &output)
+		return output.Threads
+	}
+
+	results := search("penguins")
+	if len(results) != 1 || results[0].ID != penguinsID {
+		t.Fatalf("Search for penguins returned %+v, expected only thread %s", results, penguinsID)
+	}
+	if len(results[0].Messages) == 0 {
+		t.Errorf("Search result has no matching messages")
+	}
+
+	// Responses are searched too
+	results = search("Reply to: How do I")
+	if len(results) != 1 || results[0].ID != pastaID {
+		t.Errorf("Search in responses returned %+v, expected only thread %s", results, pastaID)
+	}
+
+	if results := search("nothing matches this"); len(results) != 0 {
+		t.Errorf("Search without matches returned %+v", results)
+	}
+
+	res := s.do(user, http.MethodGet, "/api/threads/search", nil, "", nil)
+	s.decode(res, http.StatusBadRequest, nil)
+}
+
+func TestRefusalsLeftOutOfTranscript(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("user@example.com")
+	s.Upstream.Script = func(request mockRequest) MockScript {
+		if request.lastUserText() == "Forbidden question" {
+			return MockScript{Refusal: []string{"I can't help with that"}}
+		}
+		return MockScript{Content: []string{"Reply to: " + request.lastUserText()}}
+	}
+	threadID, refusedID := s.createThread(user, "Forbidden question")
+	if status := MessageStatus(s.waitMessage(refusedID).GetString("status")); status != MessageStatusRefused {
+		t.Fatalf("Message status is %s, expected %s", status, MessageStatusRefused)
+	}
+
+	send := func(responseModel string) []string {
+		t.Helper()
+		var output struct {
+			ResponseMessageID string `json:"responseMessageId"`
+		}
+		res := s.postForm(user, "/api/threads/"+threadID+"/messages", map[string]string{
+			"content":         "Another question",
+			"parentMessageId": refusedID,
+			"responseModel":   responseModel,
+		})
+		s.decode(res, http.StatusOK, &output)
+		s.waitMessage(output.ResponseMessageID)
+		request := s.Upstream.lastRequest(t)
+		var roles []string
+		for _, message := range request.Messages {
+			if message.Role != "system" {
+				roles = append(roles, message.Role+": "+request.text(message.Content))
+			}
+		}
+		return roles
+	}
+
+	// The refused prompt is left out with its refusal
+	if transcript := send(testResponseModel); !reflect.DeepEqual(transcript, []string{"user: Another question"}) {
+		t.Errorf("Transcript is %q, expected only the new question", transcript)
+	}
+	transcript := send(`{"providerId":"test/model","options":{"includeRefusals":true}}`)
+	if len(transcript) != 3 || transcript[0] != "user: Forbidden question" || transcript[2] != "user: Another question" {
+		t.Errorf("Transcript with refusals is %q", transcript)
+	}
+}
@@ -6,21 +6,56 @@ import (
 	"github.com/pocketbase/pocketbase"
 )
 
+// DefaultAIBaseURL is the OpenAI compatible API the models are requested from.
+const DefaultAIBaseURL = "https://openrouter.ai/api/v1"
+
 type Application struct {
 	PB            *pocketbase.PocketBase
 	AIClient      *openai.Client
 	StreamService *StreamService
+	Webhooks      *WebhookService
+	ThreadEvents  *ThreadEventBus
+	Models        *ModelCatalog
+
+	// TrashRetentionDays is how long deleted threads stay in the trash before being purged
+	TrashRetentionDays int
+	// ThreadInsightsEnabled keeps a summary of threads and suggests follow-up prompts after every response
+	ThreadInsightsEnabled bool
+}
+
+// ApplicationConfig is the configuration of a new application, the zero value uses the defaults.
+type ApplicationConfig struct {
+	// DataDir is the PocketBase data dir, pb_data next to the executable by default
+	DataDir string
+	// AIBaseURL is DefaultAIBaseURL by default
+	AIBaseURL string
 }
 
 func NewApplication() *Application {
-	pb := pocketbase.New()
+	return NewApplicationWithConfig(ApplicationConfig{})
+}
+
+func NewApplicationWithConfig(config ApplicationConfig) *Application {
+	if config.AIBaseURL == "" {
+		config.AIBaseURL = DefaultAIBaseURL
+	}
+
+	pb := pocketbase.NewWithConfig(pocketbase.Config{
+		DefaultDataDir: config.DataDir,
+	})
 	aiClient := openai.NewClient(
-		option.WithBaseURL("https://openrouter.ai/api/v1"),
+		option.WithBaseURL(config.AIBaseURL),
 	)
-	streamService := NewStreamService(pb, aiClient)
+	webhooks := NewWebhookService(pb)
+	threadEvents := NewThreadEventBus(pb)
+	streamService := NewStreamService(pb, aiClient, webhooks, threadEvents)
 	return &Application{
-		PB:            pb,
-		AIClient:      &aiClient,
-		StreamService: streamService,
+		PB:                 pb,
+		AIClient:           &aiClient,
+		StreamService:      streamService,
+		Webhooks:           webhooks,
+		ThreadEvents:       threadEvents,
+		Models:             NewModelCatalog(pb, aiClient),
+		TrashRetentionDays: DefaultTrashRetentionDays,
 	}
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/openai/openai-go"
+	"github.com/pocketbase/pocketbase"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// modelCatalogTTL is how long the fetched catalog is used before being fetched again
+	modelCatalogTTL = 1 * time.Hour
+	// modelCatalogRetryDelay is how long a failed fetch is remembered, so that requests don't all wait on a provider
+	// that is down
+	modelCatalogRetryDelay = 1 * time.Minute
+	modelCatalogTimeout    = 5 * time.Second
+)
+
+// ModelCatalog is the list of models of the provider with the generation parameters each one supports, fetched from
+// its models endpoint and cached.
+type ModelCatalog struct {
+	pb       *pocketbase.PocketBase
+	aiClient openai.Client
+
+	mu sync.Mutex
+	// parameters are the supported parameters by model ID, nil until fetched
+	parameters map[string][]string
+	fetched    time.Time
+	failed     time.Time
+	// fetching is closed once the fetch in progress ends, nil when there is none
+	fetching chan struct{}
+}
+
+func NewModelCatalog(pb *pocketbase.PocketBase, aiClient openai.Client) *ModelCatalog {
+	return &ModelCatalog{
+		pb:       pb,
+		aiClient: aiClient,
+	}
+}
+
+// SupportedParameters returns the generation parameters supported by a model, ok is false when the model isn't in
+// the catalog or the catalog can't be fetched, and then nothing is known about the model. The catalog is fetched
+// without holding the mutex, and only by one caller at a time: the others keep using the stale catalog meanwhile,
+// or wait for the fetch when there is none yet.
+func (c *ModelCatalog) SupportedParameters(ctx context.Context, modelID string) (parameters []string, ok bool) {
+	c.mu.Lock()
+	fetching := c.fetching
+	stale := time.Since(c.fetched) > modelCatalogTTL
+	if fetching == nil && stale && time.Since(c.failed) > modelCatalogRetryDelay {
+		done := make(chan struct{})
+		c.fetching = done
+		c.mu.Unlock()
+
+		// Other callers may wait for the fetch, so it isn't cancelled with the request of this one
+		fetched, err := c.fetch(context.WithoutCancel(ctx))
+
+		c.mu.Lock()
+		if err != nil {
+			c.pb.Logger().Warn("Failed to fetch the model catalog", "error", err)
+			c.failed = time.Now()
+		} else {
+			c.parameters = fetched
+			c.fetched = time.Now()
+		}
+		c.fetching = nil
+		close(done)
+	} else if fetching != nil && c.parameters == nil {
+		c.mu.Unlock()
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+		}
+		c.mu.Lock()
+	}
+	defer c.mu.Unlock()
+
+	parameters, ok = c.parameters[modelID]
+	return parameters, ok
+}
+
+// fetch returns the supported parameters of the models of the provider.
+func (c *ModelCatalog) fetch(ctx context.Context) (map[string][]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, modelCatalogTimeout)
+	defer cancel()
+
+	page, err := c.aiClient.Models.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	parameters := make(map[string][]string, len(page.Data))
+	for _, model := range page.Data {
+		// OpenRouter lists the parameters of each model, the models without them are treated as unknown
+		field, ok := model.JSON.ExtraFields["supported_parameters"]
+		if !ok {
+			continue
+		}
+		var supported []string
+		if err := json.Unmarshal([]byte(field.Raw()), &supported); err != nil || len(supported) == 0 {
+			continue
+		}
+		parameters[model.ID] = supported
+	}
+	return parameters, nil
+}
+
+// checkResponseModel validates the options of a response model beyond their struct tags: the response format, and
+// that the model supports the requested generation parameters when it is in the catalog. The returned error wraps
+// errInvalidModelOptions, and its message can be shown to the user.
+func (a *Application) checkResponseModel(ctx context.Context, responseModel ResponseModel) error {
+	options := responseModel.Options
+	if options == nil {
+		return nil
+	}
+	if err := checkResponseFormat(options.ResponseFormat); err != nil {
+		return err
+	}
+
+	requested := options.requestedParameters()
+	if len(requested) == 0 || isMockModel(responseModel.ProviderID) {
+		return nil
+	}
+	supported, ok := a.Models.SupportedParameters(ctx, responseModel.ProviderID)
+	if !ok {
+		return nil
+	}
+	var unsupported []string
+	for _, parameter := range requested {
+		if !slices.Contains(supported, parameter) {
+			unsupported = append(unsupported, parameter)
+		}
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("%w: %s doesn't support %s", errInvalidModelOptions, responseModel.ProviderID, strings.Join(unsupported, ", "))
+	}
+	return nil
+}
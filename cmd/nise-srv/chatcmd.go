@@ -0,0 +1,795 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/spf13/cobra"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// chatThread is a thread as listed by the chat command.
+type chatThread struct {
+	ID      string         `json:"id"`
+	Title   string         `json:"title"`
+	Updated types.DateTime `json:"updated"`
+}
+
+// chatBackend is what the chat command talks to, either the local data dir or a remote server.
+type chatBackend interface {
+	ListThreads(ctx context.Context, limit int) ([]chatThread, error)
+	// ThreadMessages returns every message of the thread, across all branches, oldest first.
+	ThreadMessages(ctx context.Context, threadID string) ([]Message, error)
+	// Send adds a user message to the thread, creating a new thread when threadID is empty, and returns the
+	// thread ID and the ID of the response message.
+	Send(ctx context.Context, threadID string, input UserMessage, model ResponseModel) (string, string, error)
+	// Stream calls onChunk for every chunk of the response message until it is complete.
+	Stream(ctx context.Context, messageID string, onChunk func(Chunk) error) error
+	Cancel(ctx context.Context, messageID string) error
+}
+
+// localChatBackend runs the chat command against the data dir as the given user, generating responses in process.
+type localChatBackend struct {
+	app    *Application
+	userID string
+}
+
+func (b *localChatBackend) ListThreads(_ context.Context, limit int) ([]chatThread, error) {
+	records, err := b.app.PB.FindRecordsByFilter(
+		"threads",
+		"owner_user_id = {:userID} && deleted_at = ''",
+		"-updated",
+		limit,
+		0,
+		dbx.Params{"userID": b.userID},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find threads: %w", err)
+	}
+	threads := make([]chatThread, 0, len(records))
+	for _, record := range records {
+		threads = append(threads, chatThread{
+			ID:      record.Id,
+			Title:   record.GetString("title"),
+			Updated: record.GetDateTime("updated"),
+		})
+	}
+	return threads, nil
+}
+
+func (b *localChatBackend) ThreadMessages(_ context.Context, threadID string) ([]Message, error) {
+	if _, err := findThreadAccess(b.app.PB, threadID, b.userID); err != nil {
+		return nil, fmt.Errorf("thread %s: %w", threadID, err)
+	}
+	records, err := b.app.PB.FindRecordsByFilter(
+		"messages",
+		"parent_thread_id = {:threadID}",
+		"id",
+		0,
+		0,
+		dbx.Params{"threadID": threadID},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find messages: %w", err)
+	}
+	messages := make([]Message, 0, len(records))
+	for _, record := range records {
+		message, err := messageFromRecord(record)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+func (b *localChatBackend) Send(_ context.Context, threadID string, input UserMessage, model ResponseModel) (string, string, error) {
+	if threadID == "" {
+		threadID, responseMessage, err := b.app.createChatCompletionThread(b.userID, nil, input, model)
+		if err != nil {
+			return "", "", err
+		}
+		return threadID, responseMessage.ID, nil
+	}
+
+	if _, err := findWritableThreadAccess(b.app.PB, threadID, b.userID); err != nil {
+		return "", "", fmt.Errorf("thread %s: %w", threadID, err)
+	}
+	_, responseMessage, err := b.app.sendMessageInThread(b.userID, threadID, input, model, nil)
+	if err != nil {
+		return "", "", err
+	}
+	return threadID, responseMessage.ID, nil
+}
+
+func (b *localChatBackend) Stream(ctx context.Context, messageID string, onChunk func(Chunk) error) error {
+	stream, ok, err := b.app.StreamService.GetActiveStream(messageID, b.userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		messageRecord, err := b.app.PB.FindRecordById("messages", messageID)
+		if err != nil {
+			return fmt.Errorf("failed to find message: %w", err)
+		}
+		if _, err := findThreadAccess(b.app.PB, messageRecord.GetString("parent_thread_id"), b.userID); err != nil {
+			return fmt.Errorf("message %s: %w", messageID, err)
+		}
+		chunks, err := storedMessageChunks(messageRecord, 0)
+		if err != nil {
+			return err
+		}
+		for _, chunk := range chunks {
+			if err := onChunk(chunk); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	cursor := stream.Subscribe(0)
+	for {
+		chunks, done, wait := cursor.Read()
+		for _, chunk := range chunks {
+			if err := onChunk(chunk); err != nil {
+				return err
+			}
+		}
+		if done {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wait:
+		}
+	}
+
+	// Wait for the message to be saved, the process may exit right after
+	<-stream.Finished()
+	return nil
+}
+
+// Cancel stops the generation and waits for the message to be saved, as the process may exit right after.
+func (b *localChatBackend) Cancel(ctx context.Context, messageID string) error {
+	stream, ok, err := b.app.StreamService.GetActiveStream(messageID, b.userID)
+	if err != nil || !ok {
+		return err
+	}
+	if _, err := b.app.StreamService.CancelStream(messageID, b.userID); err != nil {
+		return err
+	}
+	select {
+	case <-stream.Finished():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// remoteChatBackend runs the chat command against a Nise server with a personal access token.
+type remoteChatBackend struct {
+	server string
+	token  string
+	client *http.Client
+}
+
+// chatRemoteMessageRecord is a messages record as returned by the PocketBase records API.
+type chatRemoteMessageRecord struct {
+	ID              string         `json:"id"`
+	OwnerUserID     string         `json:"owner_user_id"`
+	ParentThreadID  string         `json:"parent_thread_id"`
+	ParentMessageID string         `json:"parent_message_id"`
+	Model           string         `json:"model"`
+	Role            MessageRole    `json:"role"`
+	Status          MessageStatus  `json:"status"`
+	Parts           MessageParts   `json:"parts"`
+	Meta            MessageMeta    `json:"meta"`
+	Created         types.DateTime `json:"created"`
+	Updated         types.DateTime `json:"updated"`
+}
+
+func (b *remoteChatBackend) do(ctx context.Context, method, path string, contentType string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, b.server+path, body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+b.token)
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	response, err := b.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		defer response.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		return nil, fmt.Errorf("%s %s: server responded with status %d: %s", method, path, response.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return response, nil
+}
+
+func (b *remoteChatBackend) getJSON(ctx context.Context, path string, v any) error {
+	response, err := b.do(ctx, http.MethodGet, path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+func (b *remoteChatBackend) ListThreads(ctx context.Context, limit int) ([]chatThread, error) {
+	query := url.Values{}
+	query.Set("sort", "-updated")
+	query.Set("perPage", fmt.Sprint(limit))
+	query.Set("fields", "id,title,updated")
+	query.Set("skipTotal", "true")
+	var result struct {
+		Items []chatThread `json:"items"`
+	}
+	if err := b.getJSON(ctx, "/api/collections/threads/records?"+query.Encode(), &result); err != nil {
+		return nil, err
+	}
+	return result.Items, nil
+}
+
+func (b *remoteChatBackend) ThreadMessages(ctx context.Context, threadID string) ([]Message, error) {
+	var messages []Message
+	for page := 1; ; page++ {
+		query := url.Values{}
+		query.Set("filter", fmt.Sprintf("parent_thread_id = %q", threadID))
+		query.Set("sort", "id")
+		query.Set("perPage", "500")
+		query.Set("page", fmt.Sprint(page))
+		var result struct {
+			Items      []chatRemoteMessageRecord `json:"items"`
+			TotalPages int                       `json:"totalPages"`
+		}
+		if err := b.getJSON(ctx, "/api/collections/messages/records?"+query.Encode(), &result); err != nil {
+			return nil, err
+		}
+		for _, item := range result.Items {
+			messages = append(messages, Message{
+				MessageScalar: MessageScalar{
+					ID:              item.ID,
+					OwnerUserID:     item.OwnerUserID,
+					ParentThreadID:  item.ParentThreadID,
+					ParentMessageID: item.ParentMessageID,
+					Model:           item.Model,
+					Role:            item.Role,
+					Status:          item.Status,
+					Created:         item.Created,
+					Updated:         item.Updated,
+				},
+				Parts: item.Parts,
+				Meta:  item.Meta,
+			})
+		}
+		if page >= result.TotalPages {
+			return messages, nil
+		}
+	}
+}
+
+func (b *remoteChatBackend) Send(ctx context.Context, threadID string, input UserMessage, model ResponseModel) (string, string, error) {
+	responseModel, err := json.Marshal(model)
+	if err != nil {
+		return "", "", err
+	}
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	_ = form.WriteField("content", input.Content)
+	_ = form.WriteField("responseModel", string(responseModel))
+	if input.ParentMessageID != "" {
+		_ = form.WriteField("parentMessageId", input.ParentMessageID)
+	}
+	if err := form.Close(); err != nil {
+		return "", "", err
+	}
+
+	path := "/api/threads"
+	if threadID != "" {
+		path = "/api/threads/" + url.PathEscape(threadID) + "/messages"
+	}
+	response, err := b.do(ctx, http.MethodPost, path, form.FormDataContentType(), &body)
+	if err != nil {
+		return "", "", err
+	}
+	defer response.Body.Close()
+
+	if threadID != "" {
+		var result struct {
+			ResponseMessageID string `json:"responseMessageId"`
+		}
+		if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+			return "", "", fmt.Errorf("failed to decode response: %w", err)
+		}
+		return threadID, result.ResponseMessageID, nil
+	}
+	var result struct {
+		Data NewThreadOutput `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return "", "", fmt.Errorf("failed to decode response: %w", err)
+	}
+	if result.Data.ResponseMessage == nil {
+		return "", "", fmt.Errorf("server did not return a response message")
+	}
+	return result.Data.Thread.ID, result.Data.ResponseMessage.ID, nil
+}
+
+func (b *remoteChatBackend) Stream(ctx context.Context, messageID string, onChunk func(Chunk) error) error {
+	response, err := b.do(ctx, http.MethodGet, "/api/messages/"+url.PathEscape(messageID)+"/stream", "", nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var chunk Chunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("failed to decode chunk: %w", err)
+		}
+		if err := onChunk(chunk); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+func (b *remoteChatBackend) Cancel(ctx context.Context, messageID string) error {
+	response, err := b.do(ctx, http.MethodPost, "/api/messages/"+url.PathEscape(messageID)+"/cancel", "", nil)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// chatBranch returns the messages of the branch going through the given message, from the root of the thread to
+// the tip of the branch, following the latest reply below the message. An empty messageID selects the branch of
+// the latest message.
+func chatBranch(messages []Message, messageID string) ([]Message, error) {
+	if len(messages) == 0 {
+		return nil, nil
+	}
+	byID := make(map[string]Message, len(messages))
+	children := make(map[string][]Message)
+	for _, message := range messages {
+		byID[message.ID] = message
+		children[message.ParentMessageID] = append(children[message.ParentMessageID], message)
+	}
+
+	// Messages are sorted by ID, so the last one is the latest
+	current, ok := byID[messageID]
+	if messageID == "" {
+		current, ok = messages[len(messages)-1], true
+	}
+	if !ok {
+		return nil, fmt.Errorf("message %s not found in thread", messageID)
+	}
+
+	var branch []Message
+	for message, ok := current, true; ok; message, ok = byID[message.ParentMessageID] {
+		branch = append(branch, message)
+	}
+	slices.Reverse(branch)
+	for replies := children[current.ID]; len(replies) > 0; replies = children[current.ID] {
+		current = replies[len(replies)-1]
+		branch = append(branch, current)
+	}
+	return branch, nil
+}
+
+// chatSiblings returns the IDs of the other messages answering the same parent as the message.
+func chatSiblings(messages []Message, message Message) []string {
+	var siblings []string
+	for _, other := range messages {
+		if other.ParentMessageID == message.ParentMessageID && other.ID != message.ID {
+			siblings = append(siblings, other.ID)
+		}
+	}
+	return siblings
+}
+
+func printChatThreads(out io.Writer, threads []chatThread) {
+	for _, thread := range threads {
+		fmt.Fprintf(out, "%s  %s  %s\n", thread.ID, thread.Updated.Time().Local().Format("2006-01-02 15:04"), thread.Title)
+	}
+}
+
+func printChatBranch(out io.Writer, messages, branch []Message, showReasoning bool) {
+	for _, message := range branch {
+		header := fmt.Sprintf("── %s %s", message.Role, message.ID)
+		if message.Model != "" {
+			header += " (" + message.Model + ")"
+		}
+		if message.Status != MessageStatusCompleted {
+			header += " [" + message.Status.String() + "]"
+		}
+		if siblings := chatSiblings(messages, message); len(siblings) > 0 {
+			header += fmt.Sprintf(" [other branches: %s]", strings.Join(siblings, ", "))
+		}
+		fmt.Fprintln(out, header)
+		if showReasoning && message.Parts.Reasoning != "" {
+			fmt.Fprintf(out, "(reasoning)\n%s\n", message.Parts.Reasoning)
+		}
+		if message.Parts.Error != "" {
+			fmt.Fprintf(out, "(error) %s\n", message.Parts.Error)
+		}
+		fmt.Fprintln(out, message.Parts.Content)
+		fmt.Fprintln(out)
+	}
+}
+
+// chatSession holds the state of the chat command between messages.
+type chatSession struct {
+	backend       chatBackend
+	out           io.Writer
+	errOut        io.Writer
+	threadID      string
+	branch        string
+	model         ResponseModel
+	showReasoning bool
+	// inFlight is the ID of the message being streamed, if any
+	inFlight atomic.Pointer[string]
+}
+
+// cancelInFlight stops the generation of the message being streamed. PocketBase terminates the process on
+// interrupt, so this is called on terminate rather than from a signal handler of the command.
+func (s *chatSession) cancelInFlight() {
+	messageID := s.inFlight.Load()
+	if messageID == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.backend.Cancel(ctx, *messageID); err != nil {
+		fmt.Fprintf(s.errOut, "\nFailed to cancel generation: %v\n", err)
+		return
+	}
+	fmt.Fprintln(s.errOut, "\nCancelled")
+}
+
+// send sends a message on the current branch of the current thread and streams the response to the terminal.
+func (s *chatSession) send(ctx context.Context, content string) error {
+	if s.model.ProviderID == "" {
+		return fmt.Errorf("no model selected, set one with --model")
+	}
+
+	input := UserMessage{Content: content}
+	if s.threadID != "" {
+		messages, err := s.backend.ThreadMessages(ctx, s.threadID)
+		if err != nil {
+			return err
+		}
+		branch, err := chatBranch(messages, s.branch)
+		if err != nil {
+			return err
+		}
+		if len(branch) > 0 {
+			input.ParentMessageID = branch[len(branch)-1].ID
+		}
+	}
+
+	threadID, messageID, err := s.backend.Send(ctx, s.threadID, input, s.model)
+	if err != nil {
+		return err
+	}
+	if s.threadID == "" {
+		fmt.Fprintf(s.errOut, "Created thread %s\n", threadID)
+	}
+	s.threadID = threadID
+	s.branch = messageID
+
+	s.inFlight.Store(&messageID)
+	defer s.inFlight.Store(nil)
+
+	var streamError string
+	var errorCode ErrorCode
+	inReasoning := false
+	err = s.backend.Stream(ctx, messageID, func(chunk Chunk) error {
+		switch chunk.Type {
+		case ChunkTypeReasoning:
+			if s.showReasoning {
+				inReasoning = true
+				fmt.Fprint(s.errOut, chunk.Content)
+			}
+		case ChunkTypeContent:
+			if inReasoning {
+				inReasoning = false
+				fmt.Fprint(s.errOut, "\n\n")
+			}
+			fmt.Fprint(s.out, chunk.Content)
+		case ChunkTypeError:
+			if chunk.Content != "" {
+				streamError = chunk.Content
+				if chunk.Error != nil {
+					errorCode = chunk.Error.Code
+				}
+			}
+		case ChunkTypeRetry:
+			var attempt StreamAttempt
+			if err := json.Unmarshal([]byte(chunk.Content), &attempt); err == nil {
+				fmt.Fprintf(s.errOut, "Attempt %d failed, retrying in %s: %s\n", attempt.Attempt, time.Duration(attempt.RetryDelayMs)*time.Millisecond, attempt.Error)
+			}
+		case ChunkTypeRefusal:
+			fmt.Fprint(s.out, chunk.Content)
+		case ChunkTypeFallback:
+			fmt.Fprintf(s.errOut, "Model unavailable, falling back to %s\n", chunk.Content)
+		}
+		return nil
+	})
+	fmt.Fprintln(s.out)
+	if err != nil {
+		return err
+	}
+	if streamError != "" {
+		if guidance := errorCode.Guidance(); guidance != "" {
+			fmt.Fprintln(s.errOut, guidance)
+		}
+		return errors.New(strings.TrimPrefix(streamError, "Error: "))
+	}
+	return nil
+}
+
+func (s *chatSession) show(ctx context.Context) error {
+	messages, err := s.backend.ThreadMessages(ctx, s.threadID)
+	if err != nil {
+		return err
+	}
+	branch, err := chatBranch(messages, s.branch)
+	if err != nil {
+		return err
+	}
+	printChatBranch(s.out, messages, branch, s.showReasoning)
+	return nil
+}
+
+const chatInteractiveHelp = `Type a message and press enter to send it. Commands:
+  /threads          list recent threads
+  /open <threadId>  open a thread on its latest branch
+  /branch <id>      switch to the branch going through a message
+  /show             print the current branch
+  /new              start a new thread with the next message
+  /model <model>    set the model used for responses
+  /help             show this help
+  /quit             exit`
+
+// interactive reads messages and commands from the input until it is closed.
+func (s *chatSession) interactive(ctx context.Context, in io.Reader) error {
+	fmt.Fprintln(s.errOut, chatInteractiveHelp)
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for {
+		fmt.Fprint(s.errOut, "> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(s.errOut)
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var err error
+		command, argument, _ := strings.Cut(line, " ")
+		argument = strings.TrimSpace(argument)
+		switch {
+		case !strings.HasPrefix(line, "/"):
+			err = s.send(ctx, line)
+		case command == "/quit" || command == "/exit":
+			return nil
+		case command == "/help":
+			fmt.Fprintln(s.errOut, chatInteractiveHelp)
+		case command == "/threads":
+			var threads []chatThread
+			threads, err = s.backend.ListThreads(ctx, 20)
+			printChatThreads(s.out, threads)
+		case command == "/open" && argument != "":
+			s.threadID, s.branch = argument, ""
+			err = s.show(ctx)
+		case command == "/branch" && argument != "" && s.threadID != "":
+			s.branch = argument
+			err = s.show(ctx)
+		case command == "/show" && s.threadID != "":
+			err = s.show(ctx)
+		case command == "/new":
+			s.threadID, s.branch = "", ""
+		case command == "/model" && argument != "":
+			s.model.ProviderID = argument
+		default:
+			err = fmt.Errorf("unknown or incomplete command %q, see /help", line)
+		}
+		if err != nil {
+			fmt.Fprintf(s.errOut, "Error: %v\n", err)
+		}
+	}
+}
+
+// newChatCommand creates the chat command, for using Nise from a terminal. It runs against the local data dir as
+// the user given with --user, or against a remote server with --server and a personal access token.
+func (a *Application) newChatCommand() *cobra.Command {
+	var userEmail, server, token, model, reasoningEffort string
+	var webSearch, showReasoning bool
+
+	newSession := func(cmd *cobra.Command) (*chatSession, error) {
+		session := &chatSession{
+			out:           cmd.OutOrStdout(),
+			errOut:        cmd.ErrOrStderr(),
+			model:         ResponseModel{ProviderID: model},
+			showReasoning: showReasoning,
+		}
+		a.PB.OnTerminate().BindFunc(func(e *core.TerminateEvent) error {
+			session.cancelInFlight()
+			return e.Next()
+		})
+
+		if webSearch || reasoningEffort != "" {
+			options := &ResponseModelOptions{WebSearch: webSearch}
+			if reasoningEffort != "" {
+				effort := ResponseModelReasoningEffort(reasoningEffort)
+				options.ReasoningEffort = &effort
+			}
+			if err := validate.Struct(options); err != nil {
+				return nil, fmt.Errorf("invalid model options: %w", err)
+			}
+			session.model.Options = options
+		}
+
+		if server == "" {
+			server = os.Getenv("NISE_SERVER")
+		}
+		if token == "" {
+			token = os.Getenv("NISE_TOKEN")
+		}
+		if server != "" {
+			if token == "" {
+				return nil, fmt.Errorf("a personal access token is required with --server, set --token or NISE_TOKEN")
+			}
+			session.backend = &remoteChatBackend{
+				server: strings.TrimSuffix(server, "/"),
+				token:  token,
+				client: &http.Client{},
+			}
+			return session, nil
+		}
+
+		if userEmail == "" {
+			return nil, fmt.Errorf("either --user for the local data dir or --server is required")
+		}
+		user, err := a.PB.FindAuthRecordByEmail("users", userEmail)
+		if err != nil {
+			return nil, fmt.Errorf("user %s not found: %w", userEmail, err)
+		}
+		session.backend = &localChatBackend{app: a, userID: user.Id}
+		return session, nil
+	}
+
+	command := &cobra.Command{
+		Use:          "chat",
+		SilenceUsage: true,
+		Short:        "Chat from the terminal, interactively when no subcommand is given",
+		Args:         cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			session, err := newSession(cmd)
+			if err != nil {
+				return err
+			}
+			session.threadID, _ = cmd.Flags().GetString("thread")
+			session.branch, _ = cmd.Flags().GetString("branch")
+			if session.threadID != "" {
+				if err := session.show(cmd.Context()); err != nil {
+					return err
+				}
+			}
+			return session.interactive(cmd.Context(), cmd.InOrStdin())
+		},
+	}
+	command.PersistentFlags().StringVar(&userEmail, "user", "", "email of the user to chat as, when using the local data dir")
+	command.PersistentFlags().StringVar(&server, "server", "", "URL of a remote Nise server, defaults to NISE_SERVER")
+	command.PersistentFlags().StringVar(&token, "token", "", "personal access token for the remote server, defaults to NISE_TOKEN")
+	command.PersistentFlags().StringVarP(&model, "model", "m", "", "model used for responses, e.g. openai/gpt-4o")
+	command.PersistentFlags().StringVar(&reasoningEffort, "reasoning-effort", "", "reasoning effort of the model: off, low, medium or high")
+	command.PersistentFlags().BoolVar(&webSearch, "web-search", false, "let the model search the web")
+	command.PersistentFlags().BoolVar(&showReasoning, "show-reasoning", false, "print the reasoning of the model to stderr")
+	command.Flags().String("thread", "", "thread to open")
+	command.Flags().String("branch", "", "message whose branch to open in the thread")
+
+	threadsCommand := &cobra.Command{
+		Use:          "threads",
+		SilenceUsage: true,
+		Short:        "List recent threads",
+		Args:         cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			session, err := newSession(cmd)
+			if err != nil {
+				return err
+			}
+			limit, _ := cmd.Flags().GetInt("limit")
+			threads, err := session.backend.ListThreads(cmd.Context(), limit)
+			if err != nil {
+				return err
+			}
+			printChatThreads(session.out, threads)
+			return nil
+		},
+	}
+	threadsCommand.Flags().Int("limit", 20, "maximum number of threads to list")
+
+	showCommand := &cobra.Command{
+		Use:          "show <threadId>",
+		SilenceUsage: true,
+		Short:        "Print a branch of a thread, the latest one by default",
+		Args:         cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			session, err := newSession(cmd)
+			if err != nil {
+				return err
+			}
+			session.threadID = args[0]
+			session.branch, _ = cmd.Flags().GetString("branch")
+			return session.show(cmd.Context())
+		},
+	}
+	showCommand.Flags().String("branch", "", "message whose branch to print")
+
+	sendCommand := &cobra.Command{
+		Use:          "send [message]",
+		SilenceUsage: true,
+		Short:        "Send a message and stream the response, the message is read from stdin when not given",
+		Args:         cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			session, err := newSession(cmd)
+			if err != nil {
+				return err
+			}
+			session.threadID, _ = cmd.Flags().GetString("thread")
+			session.branch, _ = cmd.Flags().GetString("branch")
+
+			var content string
+			if len(args) == 1 {
+				content = args[0]
+			} else {
+				input, err := io.ReadAll(cmd.InOrStdin())
+				if err != nil {
+					return fmt.Errorf("failed to read message from stdin: %w", err)
+				}
+				content = string(input)
+			}
+			content = strings.TrimSpace(content)
+			if content == "" {
+				return fmt.Errorf("the message cannot be empty")
+			}
+			return session.send(cmd.Context(), content)
+		},
+	}
+	sendCommand.Flags().String("thread", "", "thread to send the message in, a new thread is created when not given")
+	sendCommand.Flags().String("branch", "", "message whose branch to reply on, the latest branch by default")
+
+	command.AddCommand(threadsCommand, showCommand, sendCommand)
+	return command
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/openai/openai-go"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ChatCompletionContent is the content of a chat completion message, sent either as a string or as an array
+// of content parts. Only text parts are supported.
+type ChatCompletionContent string
+
+func (c *ChatCompletionContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = ChatCompletionContent(text)
+		return nil
+	}
+
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return fmt.Errorf("content must be a string or an array of content parts: %w", err)
+	}
+	var builder strings.Builder
+	for _, part := range parts {
+		if part.Type != "text" {
+			return fmt.Errorf("unsupported content part type: %s", part.Type)
+		}
+		builder.WriteString(part.Text)
+	}
+	*c = ChatCompletionContent(builder.String())
+	return nil
+}
+
+// ChatCompletionStop are the stop sequences of a chat completion request, sent either as a string or as an array.
+type ChatCompletionStop []string
+
+func (s *ChatCompletionStop) UnmarshalJSON(data []byte) error {
+	var stop string
+	if err := json.Unmarshal(data, &stop); err == nil {
+		*s = ChatCompletionStop{stop}
+		return nil
+	}
+	var stops []string
+	if err := json.Unmarshal(data, &stops); err != nil {
+		return fmt.Errorf("stop must be a string or an array of strings: %w", err)
+	}
+	*s = stops
+	return nil
+}
+
+// ChatCompletionResponseFormat is the response format of a chat completion request, in the OpenAI format.
+type ChatCompletionResponseFormat struct {
+	Type       ResponseFormatType        `json:"type" validate:"required,oneof=text json_object json_schema"`
+	JSONSchema *ResponseFormatJSONSchema `json:"json_schema" validate:"required_if=Type json_schema"`
+}
+
+type ChatCompletionRequestMessage struct {
+	Role    string                `json:"role" validate:"required,oneof=system developer user assistant"`
+	Content ChatCompletionContent `json:"content" validate:"max=50000"`
+}
+
+type ChatCompletionStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// ChatCompletionRequest is the subset of the OpenAI chat completions request supported by Nise, plus the
+// thread_id and parent_message_id extensions used to continue an existing thread.
+type ChatCompletionRequest struct {
+	Model           string                         `json:"model" validate:"required,max=256"`
+	Messages        []ChatCompletionRequestMessage `json:"messages" validate:"required,min=1,dive"`
+	Stream          bool                           `json:"stream"`
+	StreamOptions   *ChatCompletionStreamOptions   `json:"stream_options"`
+	ReasoningEffort *ResponseModelReasoningEffort  `json:"reasoning_effort" validate:"omitempty,oneof=off low medium high"`
+	Temperature     *float64                       `json:"temperature" validate:"omitempty,min=0,max=2"`
+	TopP            *float64                       `json:"top_p" validate:"omitempty,gt=0,max=1"`
+	MaxTokens       *int64                         `json:"max_tokens" validate:"omitempty,min=1,max=1000000"`
+	// MaxCompletionTokens replaces MaxTokens in newer OpenAI clients, it wins when both are set
+	MaxCompletionTokens *int64                        `json:"max_completion_tokens" validate:"omitempty,min=1,max=1000000"`
+	Stop                ChatCompletionStop            `json:"stop" validate:"omitempty,max=4,dive,min=1,max=256"`
+	Seed                *int64                        `json:"seed"`
+	PresencePenalty     *float64                      `json:"presence_penalty" validate:"omitempty,min=-2,max=2"`
+	FrequencyPenalty    *float64                      `json:"frequency_penalty" validate:"omitempty,min=-2,max=2"`
+	ResponseFormat      *ChatCompletionResponseFormat `json:"response_format"`
+	// ThreadID appends the last message to an existing thread instead of creating a new one, earlier messages
+	// are then ignored as the thread already holds the history.
+	ThreadID string `json:"thread_id" validate:"omitempty,len=26"`
+	// ParentMessageID is the message in the thread to reply to, defaults to the latest message of the thread.
+	ParentMessageID string `json:"parent_message_id" validate:"omitempty,len=26"`
+}
+
+// modelOptions returns the generation parameters of the request as response model options, nil without any.
+func (r ChatCompletionRequest) modelOptions() *ResponseModelOptions {
+	options := &ResponseModelOptions{
+		ReasoningEffort:  r.ReasoningEffort,
+		Temperature:      r.Temperature,
+		TopP:             r.TopP,
+		MaxTokens:        r.MaxTokens,
+		Seed:             r.Seed,
+		PresencePenalty:  r.PresencePenalty,
+		FrequencyPenalty: r.FrequencyPenalty,
+	}
+	if r.MaxCompletionTokens != nil {
+		options.MaxTokens = r.MaxCompletionTokens
+	}
+	if len(r.Stop) > 0 {
+		options.Stop = r.Stop
+	}
+	if r.ResponseFormat != nil {
+		options.ResponseFormat = &ResponseFormat{
+			Type:       r.ResponseFormat.Type,
+			JSONSchema: r.ResponseFormat.JSONSchema,
+		}
+	}
+	if options.ReasoningEffort == nil && options.ResponseFormat == nil && len(options.requestedParameters()) == 0 {
+		return nil
+	}
+	return options
+}
+
+type ChatCompletionResponseMessage struct {
+	Role      string `json:"role,omitempty"`
+	Content   string `json:"content,omitempty"`
+	Reasoning string `json:"reasoning,omitempty"`
+	Refusal   string `json:"refusal,omitempty"`
+}
+
+type ChatCompletionChoice struct {
+	Index        int                            `json:"index"`
+	Message      *ChatCompletionResponseMessage `json:"message,omitempty"`
+	Delta        *ChatCompletionResponseMessage `json:"delta,omitempty"`
+	FinishReason *string                        `json:"finish_reason"`
+}
+
+type ChatCompletionResponse struct {
+	ID       string                  `json:"id"`
+	Object   string                  `json:"object"`
+	Created  int64                   `json:"created"`
+	Model    string                  `json:"model"`
+	Choices  []ChatCompletionChoice  `json:"choices"`
+	Usage    *openai.CompletionUsage `json:"usage,omitempty"`
+	ThreadID string                  `json:"thread_id"`
+}
+
+type ChatCompletionError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+func chatCompletionErrorData(message, errorType string) map[string]any {
+	return map[string]any{"error": ChatCompletionError{Message: message, Type: errorType}}
+}
+
+// chatCompletionErrorType is the error type of a failed generation, the error code when it has one.
+func chatCompletionErrorType(code ErrorCode) string {
+	if code == "" {
+		return "upstream_error"
+	}
+	return code.String()
+}
+
+// chatCompletionsHandler implements an OpenAI compatible chat completions endpoint. Every request is recorded as a
+// user message and response in a thread, exactly like messages sent from the UI, and is generated by the stream
+// service. The thread and response message IDs are returned in the X-Nise-Thread-ID and X-Nise-Message-ID headers.
+func (a *Application) chatCompletionsHandler(e *core.RequestEvent) error {
+	var input ChatCompletionRequest
+	if err := json.NewDecoder(e.Request.Body).Decode(&input); err != nil {
+		a.PB.Logger().Warn("Failed to decode chat completion request", "error", err)
+		return e.JSON(400, chatCompletionErrorData("Invalid request body: "+err.Error(), "invalid_request_error"))
+	}
+	if err := validate.Struct(input); err != nil {
+		a.PB.Logger().Warn("Validation failed for chat completion request", "error", err)
+		return e.JSON(400, chatCompletionErrorData("Invalid request: "+err.Error(), "invalid_request_error"))
+	}
+	lastMessage := input.Messages[len(input.Messages)-1]
+	if lastMessage.Role != string(MessageRoleUser) || lastMessage.Content == "" {
+		a.PB.Logger().Warn("Last chat completion message must be a non empty user message")
+		return e.JSON(400, chatCompletionErrorData("The last message must be a non empty user message", "invalid_request_error"))
+	}
+
+	userID := e.Auth.Id
+	responseModel := ResponseModel{ProviderID: input.Model}
+	responseModel.Options = input.modelOptions()
+	if err := a.checkResponseModel(e.Request.Context(), responseModel); err != nil {
+		a.PB.Logger().Warn("Invalid chat completion model options", "error", err)
+		return e.JSON(400, chatCompletionErrorData(err.Error(), "invalid_request_error"))
+	}
+	userMessage := UserMessage{
+		Content:         string(lastMessage.Content),
+		ParentMessageID: input.ParentMessageID,
+	}
+
+	var threadID string
+	var responseMessage *NewThreadOutputThreadMessage
+	var err error
+	if input.ThreadID != "" {
+		threadID = input.ThreadID
+		responseMessage, err = a.appendChatCompletionToThread(userID, threadID, userMessage, responseModel)
+	} else {
+		threadID, responseMessage, err = a.createChatCompletionThread(userID, input.Messages[:len(input.Messages)-1], userMessage, responseModel)
+	}
+	if errors.Is(err, errThreadAccessDenied) {
+		a.PB.Logger().Warn("Thread not found or user can't write to it", "userID", userID, "threadID", input.ThreadID)
+		return e.JSON(404, chatCompletionErrorData("Thread not found or access denied", "invalid_request_error"))
+	}
+	if errors.Is(err, errParentMessageNotFound) {
+		a.PB.Logger().Warn("Parent message not found in the thread", "error", err, "threadID", input.ThreadID)
+		return e.JSON(404, chatCompletionErrorData("Parent message not found in the thread", "invalid_request_error"))
+	}
+	if err != nil {
+		a.PB.Logger().Error("Failed to create chat completion messages", "error", err, "userID", userID, "threadID", input.ThreadID)
+		return e.JSON(500, chatCompletionErrorData("Failed to create messages", "server_error"))
+	}
+
+	a.PB.Logger().Info("Chat completion requested", "threadID", threadID, "messageID", responseMessage.ID, "userID", userID, "stream", input.Stream)
+
+	stream, ok, err := a.StreamService.GetActiveStream(responseMessage.ID, userID)
+	if err != nil || !ok {
+		a.PB.Logger().Error("Failed to get stream for chat completion", "error", err, "messageID", responseMessage.ID)
+		return e.JSON(500, chatCompletionErrorData("Failed to start generation", "server_error"))
+	}
+
+	e.Response.Header().Set("X-Nise-Thread-ID", threadID)
+	e.Response.Header().Set("X-Nise-Message-ID", responseMessage.ID)
+
+	completion := ChatCompletionResponse{
+		ID:       "chatcmpl-" + responseMessage.ID,
+		Created:  time.Now().Unix(),
+		Model:    input.Model,
+		ThreadID: threadID,
+	}
+
+	if input.Stream {
+		includeUsage := input.StreamOptions != nil && input.StreamOptions.IncludeUsage
+		return a.streamChatCompletion(e, stream, completion, includeUsage)
+	}
+
+	// The message keeps generating and is saved even if the client goes away
+	select {
+	case <-stream.Finished():
+	case <-e.Request.Context().Done():
+		return nil
+	}
+
+	messageRecord, err := a.PB.FindRecordById("messages", responseMessage.ID)
+	if err != nil {
+		a.PB.Logger().Error("Failed to find chat completion message", "error", err, "messageID", responseMessage.ID)
+		return e.JSON(500, chatCompletionErrorData("Failed to read the generated message", "server_error"))
+	}
+	message, err := messageFromRecord(messageRecord)
+	if err != nil {
+		a.PB.Logger().Error("Failed to read chat completion message", "error", err, "messageID", responseMessage.ID)
+		return e.JSON(500, chatCompletionErrorData("Failed to read the generated message", "server_error"))
+	}
+	if message.Status != MessageStatusCompleted && message.Status != MessageStatusRefused {
+		errorMessage := message.Parts.Error
+		if len(message.Parts.SchemaErrors) > 0 {
+			errorMessage += ": " + strings.Join(message.Parts.SchemaErrors, "; ")
+		}
+		return e.JSON(502, chatCompletionErrorData(errorMessage, chatCompletionErrorType(message.Parts.ErrorCode)))
+	}
+
+	finishReason := message.Meta.FinishReason.String()
+	completion.Object = "chat.completion"
+	completion.Choices = []ChatCompletionChoice{{
+		Message: &ChatCompletionResponseMessage{
+			Role:      string(MessageRoleAssistant),
+			Content:   message.Parts.Content,
+			Reasoning: message.Parts.Reasoning,
+			Refusal:   message.Parts.Refusal,
+		},
+		FinishReason: &finishReason,
+	}}
+	completion.Usage = &message.Meta.Usage
+
+	return e.JSON(200, completion)
+}
+
+// streamChatCompletion forwards the chunks of a stream as chat completion chunk events.
+func (a *Application) streamChatCompletion(e *core.RequestEvent, stream *ActiveStream, completion ChatCompletionResponse, includeUsage bool) error {
+	e.Response.Header().Set("Content-Type", "text/event-stream")
+	e.Response.Header().Set("Cache-Control", "no-cache")
+	e.Response.Header().Set("Connection", "keep-alive")
+	rc := http.NewResponseController(e.Response)
+	completion.Object = "chat.completion.chunk"
+
+	writeEvent := func(data any) error {
+		msg, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		if _, err := e.Response.Write([]byte(fmt.Sprintf("data: %s\n\n", msg))); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	writeDelta := func(delta ChatCompletionResponseMessage, finishReason *string) error {
+		completion.Choices = []ChatCompletionChoice{{Delta: &delta, FinishReason: finishReason}}
+		return writeEvent(completion)
+	}
+
+	if err := writeDelta(ChatCompletionResponseMessage{Role: string(MessageRoleAssistant)}, nil); err != nil {
+		a.PB.Logger().Error("Failed to write chat completion chunk", "error", err, "messageID", stream.MessageID)
+		return nil
+	}
+
+	cursor := stream.Subscribe(0)
+	var streamError StreamError
+	for {
+		chunks, done, wait := cursor.Read()
+		for _, chunk := range chunks {
+			var err error
+			switch chunk.Type {
+			case ChunkTypeContent:
+				err = writeDelta(ChatCompletionResponseMessage{Content: chunk.Content}, nil)
+			case ChunkTypeReasoning:
+				err = writeDelta(ChatCompletionResponseMessage{Reasoning: chunk.Content}, nil)
+			case ChunkTypeRefusal:
+				err = writeDelta(ChatCompletionResponseMessage{Refusal: chunk.Content}, nil)
+			case ChunkTypeError:
+				if chunk.Error != nil && chunk.Error.Code != ErrorCodeCancelled {
+					streamError = *chunk.Error
+				}
+			case ChunkTypeFinishReason:
+				if FinishReason(chunk.Content) == FinishReasonError {
+					err = writeEvent(chatCompletionErrorData(streamError.Message, chatCompletionErrorType(streamError.Code)))
+				} else {
+					finishReason := chunk.Content
+					err = writeDelta(ChatCompletionResponseMessage{}, &finishReason)
+				}
+			}
+			if err != nil {
+				a.PB.Logger().Error("Failed to write chat completion chunk", "error", err, "messageID", stream.MessageID)
+				return nil
+			}
+		}
+		if done {
+			break
+		}
+		select {
+		case <-e.Request.Context().Done():
+			return nil
+		case <-wait:
+		}
+	}
+
+	if includeUsage {
+		select {
+		case <-stream.Finished():
+		case <-e.Request.Context().Done():
+			return nil
+		}
+		messageRecord, err := a.PB.FindRecordById("messages", stream.MessageID)
+		if err == nil {
+			var meta MessageMeta
+			if err := messageRecord.UnmarshalJSONField("meta", &meta); err == nil {
+				completion.Choices = []ChatCompletionChoice{}
+				completion.Usage = &meta.Usage
+				_ = writeEvent(completion)
+			}
+		}
+	}
+
+	if _, err := e.Response.Write([]byte("data: [DONE]\n\n")); err != nil {
+		return nil
+	}
+	_ = rc.Flush()
+	return nil
+}
+
+// appendChatCompletionToThread adds a user message to an existing thread the user can write to, replying to the
+// latest message of the thread unless a parent message is given, and starts streaming the response.
+func (a *Application) appendChatCompletionToThread(userID, threadID string, input UserMessage, responseModel ResponseModel) (*NewThreadOutputThreadMessage, error) {
+	if _, err := findWritableThreadAccess(a.PB, threadID, userID); err != nil {
+		return nil, err
+	}
+
+	if input.ParentMessageID == "" {
+		// Message IDs are UUIDv7, so the latest message has the greatest ID
+		var latest struct {
+			ID string `db:"id"`
+		}
+		err := a.PB.DB().NewQuery(`
+SELECT id FROM messages
+WHERE parent_thread_id = {:threadID}
+ORDER BY id DESC
+LIMIT 1;
+`).Bind(dbx.Params{"threadID": threadID}).One(&latest)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("failed to find latest message in thread: %w", err)
+		}
+		input.ParentMessageID = latest.ID
+	}
+
+	_, responseMessage, err := a.sendMessageInThread(userID, threadID, input, responseModel, nil)
+	if err != nil {
+		return nil, err
+	}
+	return responseMessage, nil
+}
+
+// createChatCompletionThread creates a new thread holding the earlier messages of a chat completion request as
+// its history, followed by the user message and its response, and starts streaming the response.
+func (a *Application) createChatCompletionThread(
+	userID string,
+	history []ChatCompletionRequestMessage,
+	input UserMessage,
+	responseModel ResponseModel,
+) (string, *NewThreadOutputThreadMessage, error) {
+	threadsCollection, err := a.PB.FindCollectionByNameOrId("threads")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to find threads collection: %w", err)
+	}
+	messagesCollection, err := a.PB.FindCollectionByNameOrId("messages")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to find messages collection: %w", err)
+	}
+	threadID, err := NewUUIDv7b32()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate new thread ID: %w", err)
+	}
+
+	threadRecord := core.NewRecord(threadsCollection)
+	threadRecord.Set("id", threadID.String())
+	threadRecord.Set("owner_user_id", userID)
+	threadRecord.Set("title", "New Thread")
+	autoTitle := !a.titleSettings(userID).Disabled
+	if autoTitle {
+		threadRecord.Set("title_generation_status", ThreadTitleGenerationStatusGenerating)
+	}
+
+	var firstUserMessageID string
+	var responseMessage *NewThreadOutputThreadMessage
+	err = a.PB.RunInTransaction(func(txApp core.App) error {
+		if err := txApp.Save(threadRecord); err != nil {
+			return fmt.Errorf("failed to save new thread record: %w", err)
+		}
+
+		parentMessageID := ""
+		for _, historyMessage := range history {
+			role := MessageRole(historyMessage.Role)
+			if historyMessage.Role == "developer" {
+				role = MessageRoleSystem
+			}
+			messageID, err := NewUUIDv7b32()
+			if err != nil {
+				return fmt.Errorf("failed to generate history message ID: %w", err)
+			}
+			messageRecord := core.NewRecord(messagesCollection)
+			messageRecord.Set("id", messageID.String())
+			messageRecord.Set("parent_thread_id", threadID.String())
+			messageRecord.Set("parent_message_id", parentMessageID)
+			messageRecord.Set("owner_user_id", userID)
+			messageRecord.Set("role", role)
+			messageRecord.Set("status", MessageStatusCompleted)
+			messageRecord.Set("parts", MessageParts{Content: string(historyMessage.Content)})
+			if err := txApp.Save(messageRecord); err != nil {
+				return fmt.Errorf("failed to save history message: %w", err)
+			}
+			parentMessageID = messageRecord.Id
+			if role == MessageRoleUser && firstUserMessageID == "" {
+				firstUserMessageID = messageRecord.Id
+			}
+		}
+
+		input.ParentMessageID = parentMessageID
+		userMessage, response, err := a.createNewMessageWithResponse(txApp, userID, userID, threadID.String(), input, responseModel, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create new message with response: %w", err)
+		}
+		if firstUserMessageID == "" {
+			firstUserMessageID = userMessage.ID
+		}
+		responseMessage = response
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	if _, err := a.StreamService.StartStream(responseMessage.ID, userID, responseModel); err != nil {
+		return "", nil, fmt.Errorf("failed to start stream for message %s: %w", responseMessage.ID, err)
+	}
+
+	if autoTitle {
+		_ = a.setThreadTitleFromFirstMessage(userID, threadRecord.Id, firstUserMessageID)
+	}
+
+	return threadRecord.Id, responseMessage, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/openai/openai-go"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ErrorCode is the kind of error that stopped the generation of a message, for clients to show what to do about it.
+type ErrorCode string
+
+const (
+	ErrorCodeAuthFailed          ErrorCode = "auth_failed"
+	ErrorCodeInsufficientCredits ErrorCode = "insufficient_credits"
+	ErrorCodeRateLimited         ErrorCode = "rate_limited"
+	ErrorCodeContextTooLong      ErrorCode = "context_too_long"
+	ErrorCodeContentFiltered     ErrorCode = "content_filtered"
+	ErrorCodeUpstreamUnavailable ErrorCode = "upstream_unavailable"
+	ErrorCodeCancelled           ErrorCode = "cancelled"
+	ErrorCodeSchemaMismatch      ErrorCode = "schema_mismatch"
+	ErrorCodeInternal            ErrorCode = "internal"
+)
+
+func (c ErrorCode) String() string {
+	return string(c)
+}
+
+// Guidance is what the user can do about an error, empty when there is nothing to do but try again.
+func (c ErrorCode) Guidance() string {
+	switch c {
+	case ErrorCodeAuthFailed:
+		return "Check the OpenRouter API key in your settings."
+	case ErrorCodeInsufficientCredits:
+		return "Top up your OpenRouter credits."
+	case ErrorCodeRateLimited:
+		return "The model is rate limited, wait a moment before trying again."
+	case ErrorCodeContextTooLong:
+		return "The thread is too long for the model, start a new thread or pick a model with a larger context."
+	case ErrorCodeContentFiltered:
+		return "The request was blocked by the moderation of the provider, rephrase it or pick another model."
+	case ErrorCodeUpstreamUnavailable:
+		return "The model is unavailable, try again later or pick another model."
+	case ErrorCodeSchemaMismatch:
+		return "The response doesn't match the JSON schema, try again or pick a model supporting structured outputs."
+	default:
+		return ""
+	}
+}
+
+// StreamError is the error of a stream, as sent in error chunks. The code and message are stored in the message parts.
+type StreamError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// StatusCode is the HTTP status of the upstream response, zero for other errors
+	StatusCode int `json:"statusCode,omitempty"`
+	// Details are the violations of the JSON schema for schema mismatches
+	Details []string `json:"details,omitempty"`
+}
+
+// streamedErrorPrefix starts the errors of the client for error events in a stream.
+const streamedErrorPrefix = "received error while streaming: "
+
+var (
+	// errStreamCancelled is the error of a stream stopped by the user.
+	errStreamCancelled = errors.New("stream cancelled")
+	// errNoAPIKey is the error of a stream for a user without an API key.
+	errNoAPIKey = errors.New("no API key")
+)
+
+// classifyStreamError maps the error of a stream to its code, using the status and message of upstream responses.
+func classifyStreamError(err error) StreamError {
+	streamErr := StreamError{Code: ErrorCodeInternal, Message: err.Error()}
+
+	var apiErr *openai.Error
+	var schemaErr *SchemaMismatchError
+	switch {
+	case errors.Is(err, errStreamCancelled), errors.Is(err, context.Canceled):
+		streamErr.Code = ErrorCodeCancelled
+	case errors.Is(err, errNoAPIKey):
+		streamErr.Code = ErrorCodeAuthFailed
+	case errors.As(err, &schemaErr):
+		streamErr.Code = ErrorCodeSchemaMismatch
+		streamErr.Message = "The response doesn't match the JSON schema"
+		streamErr.Details = schemaErr.Violations
+	case errors.As(err, &apiErr):
+		streamErr.StatusCode = apiErr.StatusCode
+		if apiErr.Message != "" {
+			streamErr.Message = apiErr.Message
+		}
+		streamErr.Code = classifyUpstreamError(apiErr)
+	case strings.Contains(err.Error(), streamedErrorPrefix):
+		// Errors sent in the stream after the response started only come as text, with the error object as JSON
+		_, errorJSON, _ := strings.Cut(err.Error(), streamedErrorPrefix)
+		var streamedErr struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal([]byte(errorJSON), &streamedErr) == nil {
+			if streamedErr.Message != "" {
+				streamErr.Message = streamedErr.Message
+			}
+			streamErr.StatusCode = streamedErr.Code
+			streamErr.Code = classifyUpstreamError(&openai.Error{StatusCode: streamedErr.Code, Message: streamedErr.Message})
+		}
+	default:
+		var netErr net.Error
+		if errors.As(err, &netErr) {
+			streamErr.Code = ErrorCodeUpstreamUnavailable
+		}
+	}
+	return streamErr
+}
+
+// classifyUpstreamError maps an error response of the provider to its code. OpenRouter reports moderation with a
+// 403 and context length errors with a 400, so the message tells them apart from other errors with the same status.
+func classifyUpstreamError(apiErr *openai.Error) ErrorCode {
+	message := strings.ToLower(apiErr.Message)
+	switch {
+	case apiErr.StatusCode == http.StatusPaymentRequired:
+		return ErrorCodeInsufficientCredits
+	case apiErr.StatusCode == http.StatusTooManyRequests:
+		return ErrorCodeRateLimited
+	case apiErr.StatusCode == http.StatusRequestEntityTooLarge,
+		apiErr.Code == "context_length_exceeded",
+		strings.Contains(message, "context length"),
+		strings.Contains(message, "context window"),
+		strings.Contains(message, "maximum context"),
+		strings.Contains(message, "too many tokens"):
+		return ErrorCodeContextTooLong
+	case strings.Contains(message, "moderation"),
+		strings.Contains(message, "flagged"),
+		apiErr.Code == "content_filter":
+		return ErrorCodeContentFiltered
+	case apiErr.StatusCode == http.StatusUnauthorized, apiErr.StatusCode == http.StatusForbidden:
+		return ErrorCodeAuthFailed
+	case apiErr.StatusCode == http.StatusNotFound,
+		apiErr.StatusCode == http.StatusRequestTimeout,
+		apiErr.StatusCode >= 500:
+		return ErrorCodeUpstreamUnavailable
+	default:
+		return ErrorCodeInternal
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+type ThreadEventType string
+
+const (
+	ThreadEventMessageCreated ThreadEventType = "message_created"
+	ThreadEventStreamStarted  ThreadEventType = "stream_started"
+	ThreadEventStreamFinished ThreadEventType = "stream_finished"
+	ThreadEventTitleUpdated   ThreadEventType = "title_updated"
+	// ThreadEventInsightsUpdated is sent once the summary of the thread and the suggestions of a message are updated
+	ThreadEventInsightsUpdated ThreadEventType = "insights_updated"
+	ThreadEventTyping          ThreadEventType = "typing"
+	ThreadEventPresence        ThreadEventType = "presence"
+)
+
+func (t ThreadEventType) String() string {
+	return string(t)
+}
+
+// threadEventBuffer is how many events a subscriber can lag behind before it starts missing events.
+const threadEventBuffer = 64
+
+// ThreadEvent is something that happened in a thread, sent to everyone who has the thread open.
+type ThreadEvent struct {
+	Type     ThreadEventType `json:"type"`
+	ThreadID string          `json:"threadId"`
+	// MessageID is set on message and stream events
+	MessageID string `json:"messageId,omitempty"`
+	// UserID is the user who caused the event, when there is one
+	UserID string `json:"userId,omitempty"`
+	// Status is the status of the message when its stream finished
+	Status MessageStatus `json:"status,omitempty"`
+	Title  string        `json:"title,omitempty"`
+	// Viewers are the users who have the thread open, on presence events
+	Viewers []string       `json:"viewers,omitempty"`
+	Created types.DateTime `json:"created"`
+}
+
+// ThreadSubscription receives the events of a thread until it is closed.
+type ThreadSubscription struct {
+	ThreadID string
+	UserID   string
+	// Shared subscribers only see the thread through its public share, they are left out of presence events
+	Shared bool
+	Events chan ThreadEvent
+}
+
+// ThreadEventBus fans out the events of threads to their subscribers. Publishing never blocks: a subscriber whose
+// buffer is full misses the event, and is expected to reload the thread when it notices.
+type ThreadEventBus struct {
+	PB            *pocketbase.PocketBase
+	mu            sync.Mutex
+	subscriptions map[string]map[*ThreadSubscription]struct{}
+}
+
+func NewThreadEventBus(app *pocketbase.PocketBase) *ThreadEventBus {
+	return &ThreadEventBus{
+		PB:            app,
+		subscriptions: make(map[string]map[*ThreadSubscription]struct{}),
+	}
+}
+
+// Subscribe opens a subscription to the events of a thread, and tells everyone in the thread about the new viewer.
+// Viewers of a public share neither appear in nor receive presence events, so user IDs aren't leaked to anyone
+// with the link.
+func (b *ThreadEventBus) Subscribe(threadID, userID string, shared bool) *ThreadSubscription {
+	sub := &ThreadSubscription{
+		ThreadID: threadID,
+		UserID:   userID,
+		Shared:   shared,
+		Events:   make(chan ThreadEvent, threadEventBuffer),
+	}
+
+	b.mu.Lock()
+	if b.subscriptions[threadID] == nil {
+		b.subscriptions[threadID] = make(map[*ThreadSubscription]struct{})
+	}
+	b.subscriptions[threadID][sub] = struct{}{}
+	b.publishLocked(b.presenceEventLocked(threadID))
+	b.mu.Unlock()
+
+	return sub
+}
+
+// Unsubscribe closes a subscription, and tells everyone left in the thread that the viewer is gone.
+func (b *ThreadEventBus) Unsubscribe(sub *ThreadSubscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subs, ok := b.subscriptions[sub.ThreadID]
+	if !ok {
+		return
+	}
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	close(sub.Events)
+	if len(subs) == 0 {
+		delete(b.subscriptions, sub.ThreadID)
+		return
+	}
+	b.publishLocked(b.presenceEventLocked(sub.ThreadID))
+}
+
+// Publish sends an event to the subscribers of its thread.
+func (b *ThreadEventBus) Publish(event ThreadEvent) {
+	if event.Created.IsZero() {
+		event.Created = types.NowDateTime()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.publishLocked(event)
+}
+
+func (b *ThreadEventBus) publishLocked(event ThreadEvent) {
+	for sub := range b.subscriptions[event.ThreadID] {
+		if sub.Shared && event.Type == ThreadEventPresence {
+			continue
+		}
+		select {
+		case sub.Events <- event:
+		default:
+			b.PB.Logger().Warn("Thread event subscriber is lagging behind, dropping event", "threadID", event.ThreadID, "userID", sub.UserID, "event", event.Type)
+		}
+	}
+}
+
+// presenceEventLocked lists the owner and members who have the thread open, each user once however many tabs they
+// have open.
+func (b *ThreadEventBus) presenceEventLocked(threadID string) ThreadEvent {
+	viewers := make([]string, 0, len(b.subscriptions[threadID]))
+	for sub := range b.subscriptions[threadID] {
+		if !sub.Shared && !slices.Contains(viewers, sub.UserID) {
+			viewers = append(viewers, sub.UserID)
+		}
+	}
+	slices.Sort(viewers)
+	return ThreadEvent{Type: ThreadEventPresence, ThreadID: threadID, Viewers: viewers, Created: types.NowDateTime()}
+}
+
+// publishMessageCreated is the record hook publishing the messages created in a thread, whichever API created them.
+func (a *Application) publishMessageCreated(e *core.RecordEvent) error {
+	userID := e.Record.GetString("author_user_id")
+	if userID == "" {
+		userID = e.Record.GetString("owner_user_id")
+	}
+	a.ThreadEvents.Publish(ThreadEvent{
+		Type:      ThreadEventMessageCreated,
+		ThreadID:  e.Record.GetString("parent_thread_id"),
+		MessageID: e.Record.Id,
+		UserID:    userID,
+	})
+
+	return e.Next()
+}
+
+// publishTitleUpdated is the record hook publishing the new title of a thread, once generated or renamed.
+func (a *Application) publishTitleUpdated(e *core.RecordEvent) error {
+	title := e.Record.GetString("title")
+	if title != e.Record.Original().GetString("title") {
+		a.ThreadEvents.Publish(ThreadEvent{
+			Type:     ThreadEventTitleUpdated,
+			ThreadID: e.Record.Id,
+			Title:    title,
+		})
+	}
+
+	return e.Next()
+}
+
+func formatThreadEvent(event ThreadEvent) ([]byte, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event.Type, data)), nil
+}
+
+// threadEventsHandler streams the events of a thread as server-sent events, to any user with access to the thread.
+// The user is listed as a viewer of the thread until they disconnect.
+func (a *Application) threadEventsHandler(e *core.RequestEvent) error {
+	threadID := e.Request.PathValue("threadId")
+	if len(threadID) != 26 {
+		a.PB.Logger().Warn("Invalid thread ID length", "threadID", threadID)
+		return e.JSON(400, InvalidInputErrorData)
+	}
+	userID := e.Auth.Id
+
+	access, err := findThreadAccess(a.PB, threadID, userID)
+	if err != nil {
+		a.PB.Logger().Warn("Thread not found or access denied", "error", err, "threadID", threadID, "userID", userID)
+		return e.JSON(404, map[string]string{"error": "Thread not found or access denied"})
+	}
+
+	e.Response.Header().Set("Content-Type", "text/event-stream")
+	e.Response.Header().Set("Cache-Control", "no-cache")
+	e.Response.Header().Set("Connection", "keep-alive")
+
+	disconnectChan := e.Request.Context().Done()
+	rc := http.NewResponseController(e.Response)
+
+	sub := a.ThreadEvents.Subscribe(threadID, userID, access.Shared)
+	defer a.ThreadEvents.Unsubscribe(sub)
+	a.PB.Logger().Info("Streaming thread events", "threadID", threadID, "userID", userID)
+
+	// heartbeat to keep the connection alive
+	heartbeatTicker := time.NewTicker(30 * time.Second)
+	defer heartbeatTicker.Stop()
+
+	for {
+		select {
+		case <-disconnectChan:
+			a.PB.Logger().Info("Client disconnected from thread events", "threadID", threadID, "userID", userID)
+			return nil
+		case <-heartbeatTicker.C:
+			if _, err := e.Response.Write([]byte(": don't die on me\n\n")); err != nil {
+				a.PB.Logger().Error("Failed to write heartbeat to thread events", "error", err, "threadID", threadID)
+				return nil
+			}
+		case event := <-sub.Events:
+			msg, err := formatThreadEvent(event)
+			if err != nil {
+				a.PB.Logger().Error("Failed to marshal thread event", "error", err, "threadID", threadID)
+				return nil
+			}
+			if _, err := e.Response.Write(msg); err != nil {
+				a.PB.Logger().Error("Failed to write thread event", "error", err, "threadID", threadID)
+				return nil
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			a.PB.Logger().Error("Failed to flush thread events", "error", err, "threadID", threadID)
+			return nil
+		}
+	}
+}
+
+// typingHandler tells the viewers of a thread that the user is writing a message in it.
+func (a *Application) typingHandler(e *core.RequestEvent) error {
+	threadID := e.Request.PathValue("threadId")
+	if len(threadID) != 26 {
+		a.PB.Logger().Warn("Invalid thread ID length", "threadID", threadID)
+		return e.JSON(400, InvalidInputErrorData)
+	}
+
+	access, err := findThreadAccess(a.PB, threadID, e.Auth.Id)
+	if err != nil || !access.Role.CanWrite() {
+		a.PB.Logger().Warn("Thread not found or user can't write in it", "error", err, "threadID", threadID, "userID", e.Auth.Id)
+		return e.JSON(404, map[string]string{"error": "Thread not found or access denied"})
+	}
+
+	a.ThreadEvents.Publish(ThreadEvent{Type: ThreadEventTyping, ThreadID: threadID, UserID: e.Auth.Id})
+
+	return e.NoContent(204)
+}
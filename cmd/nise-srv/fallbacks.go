@@ -0,0 +1,76 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"slices"
+	"strings"
+)
+
+// MaxModelFallbacks is the maximum number of models tried after the requested one.
+const MaxModelFallbacks = 5
+
+// SkippedModel is a model of a fallback chain that failed before producing any content, saved in the message meta.
+type SkippedModel struct {
+	Model string `json:"model"`
+	// StatusCode is the HTTP status of the last upstream response for the model, zero for other errors
+	StatusCode int    `json:"statusCode,omitempty"`
+	Reason     string `json:"reason"`
+}
+
+// validateModelFallbacks is the record hook checking that the fallbacks of a model are a list of model IDs.
+func validateModelFallbacks(e *core.RecordEvent) error {
+	invalid := validation.Errors{
+		"fallbacks": validation.NewError("validation_invalid_fallbacks", fmt.Sprintf("Must be a list of 1 to %d model IDs.", MaxModelFallbacks)),
+	}
+
+	var fallbacks []string
+	if err := e.Record.UnmarshalJSONField("fallbacks", &fallbacks); err != nil {
+		return invalid
+	}
+	if len(fallbacks) == 0 || len(fallbacks) > MaxModelFallbacks {
+		return invalid
+	}
+	for _, fallback := range fallbacks {
+		if strings.TrimSpace(fallback) == "" || len(fallback) > 200 {
+			return invalid
+		}
+	}
+
+	return e.Next()
+}
+
+// modelChain returns the models to try in order for a response: the requested model, then the fallbacks the user
+// configured for it. The requested model alone is returned along with any error.
+func modelChain(app core.App, userID, model string) ([]string, error) {
+	chain := []string{model}
+	record, err := app.FindFirstRecordByFilter(
+		"model_fallbacks",
+		"owner_user_id = {:userID} && model = {:model}",
+		dbx.Params{"userID": userID, "model": model},
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return chain, nil
+	}
+	if err != nil {
+		return chain, fmt.Errorf("failed to find fallbacks of model %s: %w", model, err)
+	}
+
+	var fallbacks []string
+	if err := record.UnmarshalJSONField("fallbacks", &fallbacks); err != nil {
+		return chain, fmt.Errorf("failed to unmarshal fallbacks of model %s: %w", model, err)
+	}
+	for _, fallback := range fallbacks {
+		if len(chain) > MaxModelFallbacks {
+			break
+		}
+		if fallback != "" && !slices.Contains(chain, fallback) {
+			chain = append(chain, fallback)
+		}
+	}
+	return chain, nil
+}
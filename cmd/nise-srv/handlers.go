@@ -2,12 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-playground/validator/v10"
 	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/tools/types"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -18,6 +20,7 @@ var InvalidInputErrorData = map[string]string{
 }
 var UnexpectedErrorData = map[string]string{
 	"error": "An unexpected error occurred",
+	"code":  ErrorCodeInternal.String(),
 }
 var UnimplementedErrorData = map[string]string{
 	"error": "This feature is not implemented yet",
@@ -88,6 +91,10 @@ func (a *Application) newThreadHandler(e *core.RequestEvent) error {
 		a.PB.Logger().Warn("Validation failed for response model", "error", err)
 		return e.JSON(400, InvalidInputErrorData)
 	}
+	if err := a.checkResponseModel(e.Request.Context(), responseModel); err != nil {
+		a.PB.Logger().Warn("Invalid response model options", "error", err)
+		return e.JSON(400, map[string]string{"error": err.Error()})
+	}
 
 	// Parse attachments if any
 	attachments := e.Request.MultipartForm.File["attachments"]
@@ -104,6 +111,22 @@ func (a *Application) newThreadHandler(e *core.RequestEvent) error {
 
 	userID := e.Auth.Id
 
+	// Optionally create the thread in one of the user's projects
+	projectIDField := input["projectId"]
+	if len(projectIDField) > 1 {
+		a.PB.Logger().Warn("Project ID should not be an array")
+		return e.JSON(400, InvalidInputErrorData)
+	}
+	var projectID string
+	if len(projectIDField) == 1 && projectIDField[0] != "" {
+		projectID = projectIDField[0]
+		projectRecord, err := a.PB.FindRecordById("projects", projectID)
+		if err != nil || projectRecord.GetString("owner_user_id") != userID {
+			a.PB.Logger().Warn("Project not found or user is not the owner", "error", err, "projectID", projectID, "userID", userID)
+			return e.JSON(404, map[string]string{"error": "Project not found or access denied"})
+		}
+	}
+
 	threadsCollection, err := a.PB.FindCollectionByNameOrId("threads")
 	if err != nil {
 		a.PB.Logger().Error("Failed to find threads collection", "error", err)
@@ -119,7 +142,11 @@ func (a *Application) newThreadHandler(e *core.RequestEvent) error {
 	threadRecord.Set("id", threadID.String())
 	threadRecord.Set("owner_user_id", userID)
 	threadRecord.Set("title", "New Thread")
-	threadRecord.Set("title_generation_status", ThreadTitleGenerationStatusGenerating)
+	autoTitle := !a.titleSettings(userID).Disabled
+	if autoTitle {
+		threadRecord.Set("title_generation_status", ThreadTitleGenerationStatusGenerating)
+	}
+	threadRecord.Set("project_id", projectID)
 
 	var userMessage *NewThreadOutputThreadMessage
 	var responseMessage *NewThreadOutputThreadMessage
@@ -132,6 +159,7 @@ func (a *Application) newThreadHandler(e *core.RequestEvent) error {
 		userMessage, responseMessage, err = a.createNewMessageWithResponse(
 			txApp,
 			userID,
+			userID,
 			threadID.String(),
 			inputUserMessage,
 			responseModel,
@@ -145,6 +173,10 @@ func (a *Application) newThreadHandler(e *core.RequestEvent) error {
 		return nil
 	})
 
+	if errors.Is(err, errParentMessageNotFound) {
+		a.PB.Logger().Warn("Parent message not found in the thread", "error", err)
+		return e.JSON(404, map[string]string{"error": "Parent message not found in the thread"})
+	}
 	if err != nil {
 		a.PB.Logger().Error("Failed to create new message with response", "error", err)
 		return e.JSON(500, UnexpectedErrorData)
@@ -160,7 +192,9 @@ func (a *Application) newThreadHandler(e *core.RequestEvent) error {
 		return e.JSON(500, UnexpectedErrorData)
 	}
 
-	_ = a.setThreadTitleFromFirstMessage(userID, threadRecord.Id, userMessage.ID)
+	if autoTitle {
+		_ = a.setThreadTitleFromFirstMessage(userID, threadRecord.Id, userMessage.ID)
+	}
 
 	return e.JSON(200, map[string]any{
 		"message": "Thread created successfully",
@@ -239,6 +273,10 @@ func (a *Application) newMessageInThreadHandler(e *core.RequestEvent) error {
 		a.PB.Logger().Warn("Validation failed for response model", "error", err)
 		return e.JSON(400, InvalidInputErrorData)
 	}
+	if err := a.checkResponseModel(e.Request.Context(), responseModel); err != nil {
+		a.PB.Logger().Warn("Invalid response model options", "error", err)
+		return e.JSON(400, map[string]string{"error": err.Error()})
+	}
 
 	// Parse attachments if any
 	attachments := e.Request.MultipartForm.File["attachments"]
@@ -253,21 +291,17 @@ func (a *Application) newMessageInThreadHandler(e *core.RequestEvent) error {
 		}
 	}
 
-	userMessage, responseMessage, err := a.createNewMessageWithResponse(
-		a.PB,
-		userID,
-		threadID,
-		inputUserMessage,
-		responseModel,
-		attachments,
-	)
-	if err != nil {
-		a.PB.Logger().Error("Failed to create new message with response", "error", err)
-		return e.JSON(500, UnexpectedErrorData)
+	userMessage, responseMessage, err := a.sendMessageInThread(userID, threadID, inputUserMessage, responseModel, attachments)
+	if errors.Is(err, errThreadAccessDenied) {
+		a.PB.Logger().Warn("Thread not found or user can't write in it", "threadID", threadID, "userID", userID)
+		return e.JSON(404, map[string]string{"error": "Thread not found or access denied"})
+	}
+	if errors.Is(err, errParentMessageNotFound) {
+		a.PB.Logger().Warn("Parent message not found in the thread", "error", err, "threadID", threadID)
+		return e.JSON(404, map[string]string{"error": "Parent message not found in the thread"})
 	}
-	_, err = a.StreamService.StartStream(responseMessage.ID, userID, responseModel)
 	if err != nil {
-		a.PB.Logger().Error("Failed to start stream for new message", "error", err, "threadID", threadID, "messageID", responseMessage.ID)
+		a.PB.Logger().Error("Failed to send new message in thread", "error", err, "threadID", threadID)
 		return e.JSON(500, UnexpectedErrorData)
 	}
 
@@ -300,6 +334,10 @@ func (a *Application) updateMessageInThreadHandler(e *core.RequestEvent) error {
 		a.PB.Logger().Warn("Validation failed for update message input", "error", err)
 		return e.JSON(400, InvalidInputErrorData)
 	}
+	if err := a.checkResponseModel(e.Request.Context(), input.ResponseModel); err != nil {
+		a.PB.Logger().Warn("Invalid response model options", "error", err)
+		return e.JSON(400, map[string]string{"error": err.Error()})
+	}
 
 	a.PB.Logger().Info("Updating message in thread", "messageID", messageID, "userID", e.Auth.Id)
 
@@ -309,7 +347,12 @@ func (a *Application) updateMessageInThreadHandler(e *core.RequestEvent) error {
 		return e.JSON(500, UnexpectedErrorData)
 	}
 
-	if messageRecord.GetString("owner_user_id") != e.Auth.Id ||
+	access, err := findWritableThreadAccess(a.PB, messageRecord.GetString("parent_thread_id"), e.Auth.Id)
+	if err != nil && !errors.Is(err, errThreadAccessDenied) {
+		a.PB.Logger().Error("Failed to find thread access", "error", err, "messageID", messageID)
+		return e.JSON(500, UnexpectedErrorData)
+	}
+	if !access.Role.CanWrite() ||
 		messageRecord.GetString("role") != string(MessageRoleUser) {
 		a.PB.Logger().Warn("User does not have permission to update this message", "userID", e.Auth.Id, "messageID", messageID)
 		return e.JSON(400, InvalidInputErrorData)
@@ -322,6 +365,7 @@ func (a *Application) updateMessageInThreadHandler(e *core.RequestEvent) error {
 	}
 	messageRecord.MarkAsNew()
 	messageRecord.Set("id", newMessageRecordId.String())
+	messageRecord.Set("author_user_id", e.Auth.Id)
 
 	messageRecord.Set("parts", MessageParts{Content: input.Content})
 	var messageMeta MessageMeta
@@ -347,7 +391,8 @@ func (a *Application) updateMessageInThreadHandler(e *core.RequestEvent) error {
 	responseMessageRecord.Set("id", responseMessageId.String())
 	responseMessageRecord.Set("parent_thread_id", messageRecord.GetString("parent_thread_id"))
 	responseMessageRecord.Set("parent_message_id", newMessageRecordId.String())
-	responseMessageRecord.Set("owner_user_id", e.Auth.Id)
+	responseMessageRecord.Set("owner_user_id", access.OwnerUserID)
+	responseMessageRecord.Set("author_user_id", e.Auth.Id)
 	responseMessageRecord.Set("role", string(MessageRoleAssistant))
 	responseMessageRecord.Set("model", input.ResponseModel.ProviderID)
 	responseMeta := MessageMeta{
@@ -371,7 +416,7 @@ func (a *Application) updateMessageInThreadHandler(e *core.RequestEvent) error {
 		return e.JSON(500, UnexpectedErrorData)
 	}
 	// Start a new stream for the response message
-	_, err = a.StreamService.StartStream(responseMessageRecord.Id, e.Auth.Id, input.ResponseModel)
+	_, err = a.StreamService.StartStream(responseMessageRecord.Id, access.OwnerUserID, input.ResponseModel)
 	if err != nil {
 		a.PB.Logger().Error("Failed to start stream for updated message", "error", err, "messageID", responseMessageRecord.Id)
 		return e.JSON(500, UnexpectedErrorData)
@@ -386,7 +431,7 @@ type RegenerateMessageInThreadInput struct {
 	// Content is optional, if provided it implies the user wants to edit the message.
 	Content string `json:"content" validate:"omitempty,max=50000"`
 	// ResponseModel is optional, if provided it implies the user wants to use a different model for the regeneration.
-	ResponseModel ResponseModel `json:"responseModel" validate:"required"`
+	ResponseModel ResponseModel `json:"responseModel"`
 }
 
 // regenerateMessageInThreadHandler used to regenerate an ai message, or for a user to edit it.
@@ -415,24 +460,119 @@ func (a *Application) regenerateMessageInThreadHandler(e *core.RequestEvent) err
 
 	a.PB.Logger().Info("Regenerating message in thread", "threadID", threadID, "messageID", messageID, "userID", e.Auth.Id, "model", input.ResponseModel, "content", len(input.Content) > 0)
 
-	err := a.regenerateMessage(
+	newMessageID, err := a.regenerateMessage(
+		e.Request.Context(),
 		e.Auth.Id,
 		threadID,
 		messageID,
 		input,
 	)
+	if errors.Is(err, errInvalidModelOptions) {
+		a.PB.Logger().Warn("Invalid response model options", "error", err)
+		return e.JSON(400, map[string]string{"error": err.Error()})
+	}
+	if errors.Is(err, errThreadAccessDenied) {
+		a.PB.Logger().Warn("Message not found or user can't regenerate it", "error", err, "threadID", threadID, "messageID", messageID)
+		return e.JSON(404, map[string]string{"error": "Message not found or access denied"})
+	}
 	if err != nil {
 		a.PB.Logger().Error("Failed to regenerate message with response", "error", err)
 		return e.JSON(500, UnexpectedErrorData)
 	}
 
 	return e.JSON(200, map[string]any{
-		"message": "Message regenerated successfully",
+		"message":   "Message regenerated successfully",
+		"messageId": newMessageID,
+	})
+}
+
+// cancelMessageHandler stops the generation of a message that is still streaming.
+func (a *Application) cancelMessageHandler(e *core.RequestEvent) error {
+	messageID := e.Request.PathValue("messageId")
+	if len(messageID) != 26 {
+		a.PB.Logger().Warn("Invalid message ID length", "messageID", messageID)
+		return e.JSON(400, InvalidInputErrorData)
+	}
+
+	a.PB.Logger().Info("Cancelling message generation", "messageID", messageID, "userID", e.Auth.Id)
+
+	cancelled, err := a.StreamService.CancelStream(messageID, e.Auth.Id)
+	if errors.Is(err, errThreadAccessDenied) {
+		a.PB.Logger().Warn("User can't cancel the generation of the message", "error", err, "messageID", messageID, "userID", e.Auth.Id)
+		return e.JSON(404, map[string]string{"error": "Message is not being generated"})
+	}
+	if err != nil {
+		a.PB.Logger().Error("Failed to cancel stream for message", "error", err, "messageID", messageID)
+		return e.JSON(500, UnexpectedErrorData)
+	}
+	if !cancelled {
+		return e.JSON(404, map[string]string{"error": "Message is not being generated"})
+	}
+
+	return e.JSON(200, map[string]any{
+		"message": "Message generation cancelled",
 	})
 }
 
 // TODO: Send chunks other than content and reasoning
 
+// formatChunkEvent formats a chunk as an SSE event, using the chunk ID as the event ID when it has one.
+func formatChunkEvent(chunk Chunk) ([]byte, error) {
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return nil, err
+	}
+	if chunk.ID > 0 {
+		return []byte(fmt.Sprintf("id: %d\ndata: %s\n\n", chunk.ID, data)), nil
+	}
+	return []byte(fmt.Sprintf("data: %s\n\n", data)), nil
+}
+
+// storedMessageChunks rebuilds the chunks of a message that is no longer streaming from its saved parts. The saved
+// parts can't be split at a chunk ID, so clients resuming after lastChunkID first get a reset chunk.
+func storedMessageChunks(messageRecord *core.Record, lastChunkID int) ([]Chunk, error) {
+	var messageParts MessageParts
+	if err := messageRecord.UnmarshalJSONField("parts", &messageParts); err != nil {
+		return nil, err
+	}
+
+	chunks := make([]Chunk, 0, 3)
+	if lastChunkID > 0 {
+		chunks = append(chunks, Chunk{Type: ChunkTypeReset})
+	}
+	if messageParts.Reasoning != "" {
+		chunks = append(chunks, Chunk{Type: ChunkTypeReasoning, Content: messageParts.Reasoning})
+	}
+	chunks = append(chunks, Chunk{Type: ChunkTypeContent, Content: messageParts.Content})
+	if messageParts.Refusal != "" {
+		chunks = append(chunks, Chunk{Type: ChunkTypeRefusal, Content: messageParts.Refusal})
+	}
+	if messageParts.Error != "" {
+		code := messageParts.ErrorCode
+		if code == "" {
+			// Messages saved before error codes
+			code = ErrorCodeInternal
+		}
+		chunks = append(chunks, errorChunk(StreamError{Code: code, Message: messageParts.Error, Details: messageParts.SchemaErrors}))
+	}
+
+	var messageMeta MessageMeta
+	if err := messageRecord.UnmarshalJSONField("meta", &messageMeta); err != nil {
+		return nil, err
+	}
+	if messageMeta.Stats != (StreamStats{}) {
+		stats, err := json.Marshal(messageMeta.Stats)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, Chunk{Type: ChunkTypeStats, Content: string(stats)})
+	}
+	return chunks, nil
+}
+
+// streamMessageHandler streams the chunks of a message as server-sent events. Clients reconnecting with a
+// Last-Event-ID header only receive the chunks after that ID as long as the stream is still held in memory, after
+// that they get a reset chunk followed by the whole saved message.
 func (a *Application) streamMessageHandler(e *core.RequestEvent) error {
 	messageID := e.Request.PathValue("messageId")
 	if len(messageID) != 26 {
@@ -441,7 +581,17 @@ func (a *Application) streamMessageHandler(e *core.RequestEvent) error {
 	}
 	userID := e.Auth.Id
 
-	a.PB.Logger().Info("Streaming message", "messageID", messageID)
+	lastChunkID := 0
+	if lastEventID := e.Request.Header.Get("Last-Event-ID"); lastEventID != "" {
+		parsed, err := strconv.Atoi(lastEventID)
+		if err != nil || parsed < 0 {
+			a.PB.Logger().Warn("Invalid Last-Event-ID header", "lastEventID", lastEventID, "messageID", messageID)
+			return e.JSON(400, InvalidInputErrorData)
+		}
+		lastChunkID = parsed
+	}
+
+	a.PB.Logger().Info("Streaming message", "messageID", messageID, "lastChunkID", lastChunkID)
 
 	e.Response.Header().Set("Content-Type", "text/event-stream")
 	e.Response.Header().Set("Cache-Control", "no-cache")
@@ -451,6 +601,10 @@ func (a *Application) streamMessageHandler(e *core.RequestEvent) error {
 
 	rc := http.NewResponseController(e.Response)
 	stream, ok, err := a.StreamService.GetActiveStream(messageID, userID)
+	if errors.Is(err, errThreadAccessDenied) {
+		a.PB.Logger().Warn("Stream not accessible to the user", "error", err, "messageID", messageID, "userID", userID)
+		return e.JSON(404, map[string]string{"error": "Message not found"})
+	}
 	if err != nil {
 		a.PB.Logger().Error("Failed to get stream for message", "error", err, "messageID", messageID)
 		return e.JSON(500, UnexpectedErrorData)
@@ -467,60 +621,69 @@ func (a *Application) streamMessageHandler(e *core.RequestEvent) error {
 			a.PB.Logger().Warn("Message record not found", "messageID", messageID)
 			return e.JSON(404, map[string]string{"error": "Message not found"})
 		}
+		if _, err := findThreadAccess(a.PB, messageRecord.GetString("parent_thread_id"), userID); err != nil {
+			a.PB.Logger().Warn("Message not accessible to the user", "error", err, "messageID", messageID, "userID", userID)
+			return e.JSON(404, map[string]string{"error": "Message not found"})
+		}
 		// If the message is already completed, we can send it directly
 		a.PB.Logger().Info("Message already completed, sending directly", "messageID", messageID)
-		var messageParts MessageParts
-		err = messageRecord.UnmarshalJSONField("parts", &messageParts)
+		chunks, err := storedMessageChunks(messageRecord, lastChunkID)
 		if err != nil {
 			a.PB.Logger().Error("Failed to unmarshal message content", "error", err, "messageID", messageID)
 			return e.JSON(500, UnexpectedErrorData)
 		}
-		if messageParts.Reasoning != "" {
-			reasoningMsg, err := json.Marshal(Chunk{
-				Type:    ChunkTypeReasoning,
-				Content: messageParts.Reasoning,
-			})
+		for _, chunk := range chunks {
+			msg, err := formatChunkEvent(chunk)
 			if err != nil {
-				a.PB.Logger().Error("Failed to marshal reasoning message", "error", err, "messageID", messageID)
+				a.PB.Logger().Error("Failed to marshal stored message chunk", "error", err, "messageID", messageID)
 				return e.JSON(500, UnexpectedErrorData)
 			}
-			_, err = e.Response.Write([]byte(fmt.Sprintf("data: %s\n\n", reasoningMsg)))
+			_, err = e.Response.Write(msg)
 			if err != nil {
-				a.PB.Logger().Error("Failed to write reasoning to response stream", "error", err, "messageID", messageID)
+				a.PB.Logger().Error("Failed to write stored message to response stream", "error", err, "messageID", messageID)
 				return e.JSON(500, UnexpectedErrorData)
 			}
 		}
-		contentMsg, err := json.Marshal(Chunk{
-			Type:    ChunkTypeContent,
-			Content: messageParts.Content,
-		})
-		if err != nil {
-			a.PB.Logger().Error("Failed to marshal content message", "error", err, "messageID", messageID)
-			return e.JSON(500, UnexpectedErrorData)
-		}
-		_, err = e.Response.Write([]byte(fmt.Sprintf("data: %s\n\n", contentMsg)))
-		if err != nil {
-			a.PB.Logger().Error("Failed to write content to response stream", "error", err, "messageID", messageID)
-			return e.JSON(500, UnexpectedErrorData)
-		}
 		if err := rc.Flush(); err != nil {
 			a.PB.Logger().Error("Failed to flush response stream", "error", err, "messageID", messageID)
 			return e.JSON(500, UnexpectedErrorData)
 		}
 		return nil
 	}
-	subscriberId := fmt.Sprintf("%s-%d", messageID, time.Now().UnixNano())
-	responseChan := stream.Subscribe(subscriberId)
+	cursor := stream.Subscribe(lastChunkID)
 
 	// heartbeat to keep the connection alive
 	heartbeatTicker := time.NewTicker(30 * time.Second)
 	defer heartbeatTicker.Stop()
 
 	for {
+		chunks, done, wait := cursor.Read()
+		for _, chunk := range chunks {
+			msg, err := formatChunkEvent(chunk)
+			if err != nil {
+				a.PB.Logger().Error("Failed to marshal response for streaming", "error", err, "messageID", messageID)
+				return e.JSON(500, UnexpectedErrorData)
+			}
+			_, err = e.Response.Write(msg)
+			if err != nil {
+				a.PB.Logger().Error("Failed to write response to stream", "error", err, "messageID", messageID)
+				return e.JSON(500, UnexpectedErrorData)
+			}
+		}
+		if len(chunks) > 0 {
+			if err := rc.Flush(); err != nil {
+				a.PB.Logger().Error("Failed to flush response stream", "error", err, "messageID", messageID)
+				return e.JSON(500, UnexpectedErrorData)
+			}
+		}
+		if done {
+			a.PB.Logger().Info("Stream finished", "messageID", messageID)
+			return nil
+		}
+
 		select {
 		case <-disconnectChan:
 			a.PB.Logger().Info("Client disconnected", "messageID", messageID)
-			stream.Unsubscribe(subscriberId)
 			return nil
 		case <-heartbeatTicker.C:
 			_, err := e.Response.Write([]byte(": don't die on me\n\n"))
@@ -532,27 +695,8 @@ func (a *Application) streamMessageHandler(e *core.RequestEvent) error {
 				a.PB.Logger().Error("Failed to flush heartbeat response stream", "error", err, "messageID", messageID)
 				return e.JSON(500, UnexpectedErrorData)
 			}
-		case response, ok := <-responseChan:
-			if !ok {
-				a.PB.Logger().Info("Response channel closed", "messageID", messageID)
-				return nil
-			}
-			msg, err := json.Marshal(response)
-			if err != nil {
-				a.PB.Logger().Error("Failed to marshal response for streaming", "error", err, "messageID", messageID)
-				return e.JSON(500, UnexpectedErrorData)
-			}
-			_, err = e.Response.Write([]byte(fmt.Sprintf("data: %s\n\n", msg)))
-			if err != nil {
-				a.PB.Logger().Error("Failed to write response to stream", "error", err, "messageID", messageID)
-				return e.JSON(500, UnexpectedErrorData)
-			}
-			if err := rc.Flush(); err != nil {
-				a.PB.Logger().Error("Failed to flush response stream", "error", err, "messageID", messageID)
-				return e.JSON(500, UnexpectedErrorData)
-			}
+		case <-wait:
 		}
-
 	}
 }
 
@@ -612,27 +756,86 @@ func (a *Application) getKeyInfoHandler(e *core.RequestEvent) error {
 type SearchResultThread struct {
 	ID       string        `json:"id" db:"id"`
 	Title    string        `json:"title" db:"title"`
+	Tags     types.JSONRaw `json:"tags" db:"tags"`
 	Messages types.JSONRaw `json:"messages" db:"messages"`
 }
 
 // searchThreadsHandler searches for threads based on a query string that exists either in the thread title or in the content of the messages within the thread.
+// The threads of the user and the ones they are a member of are searched.
+// The query can also filter threads with tag:, model:, before: and after: terms, see parseThreadSearchQuery, or be
+// replaced by the query of one of the user's saved searches with savedSearchId.
 // returns a list of threads and array of its messages
 func (a *Application) searchThreadsHandler(e *core.RequestEvent) error {
+	userID := e.Auth.Id
+
 	query := e.Request.URL.Query().Get("query")
+	if savedSearchID := e.Request.URL.Query().Get("savedSearchId"); savedSearchID != "" {
+		savedSearchRecord, err := a.PB.FindRecordById("saved_searches", savedSearchID)
+		if err != nil || savedSearchRecord.GetString("owner_user_id") != userID {
+			a.PB.Logger().Warn("Saved search not found or user is not the owner", "error", err, "savedSearchID", savedSearchID, "userID", userID)
+			return e.JSON(404, map[string]string{"error": "Saved search not found or access denied"})
+		}
+		query = savedSearchRecord.GetString("query")
+	}
 	if query == "" {
 		a.PB.Logger().Warn("Query parameter is missing or empty")
 		return e.JSON(400, InvalidInputErrorData)
 	}
 
-	userID := e.Auth.Id
+	searchQuery, err := parseThreadSearchQuery(query)
+	if err != nil {
+		a.PB.Logger().Warn("Invalid search query", "error", err, "query", query)
+		return e.JSON(400, map[string]string{"error": err.Error()})
+	}
+
 	a.PB.Logger().Info("Searching threads", "query", query, "userID", userID)
 
+	params := dbx.Params{
+		"userId": userID,
+		"query":  searchQuery.Text,
+	}
+	var filters []string
+	if searchQuery.Text != "" {
+		filters = append(filters, `(t.title LIKE '%' || {:query} || '%'
+    OR t.id IN (
+        SELECT parent_thread_id FROM messages WHERE json_extract(parts, '$.content') LIKE '%' || {:query} || '%'
+    ))`)
+	}
+	for i, tag := range searchQuery.Tags {
+		param := fmt.Sprintf("tag%d", i)
+		params[param] = tag
+		filters = append(filters, fmt.Sprintf(`(EXISTS (SELECT 1 FROM json_each(COALESCE(NULLIF(t.tags, ''), '[]')) WHERE value = {:%[1]s})
+    OR EXISTS (
+        SELECT 1 FROM messages mt, json_each(COALESCE(NULLIF(mt.tags, ''), '[]')) tt
+        WHERE mt.parent_thread_id = t.id AND tt.value = {:%[1]s}
+    ))`, param))
+	}
+	if searchQuery.ModelPattern != "" {
+		params["model"] = likePattern(searchQuery.ModelPattern)
+		filters = append(filters, `EXISTS (SELECT 1 FROM messages mm WHERE mm.parent_thread_id = t.id AND mm.model LIKE {:model} ESCAPE '\')`)
+	}
+	if !searchQuery.Before.IsZero() {
+		before, _ := types.ParseDateTime(searchQuery.Before)
+		params["before"] = before.String()
+		filters = append(filters, "t.created < {:before}")
+	}
+	if !searchQuery.After.IsZero() {
+		after, _ := types.ParseDateTime(searchQuery.After)
+		params["after"] = after.String()
+		filters = append(filters, "t.created >= {:after}")
+	}
+	filter := ""
+	for _, f := range filters {
+		filter += " AND\n    " + f
+	}
+
 	var results []SearchResultThread
 
-	err := a.PB.DB().NewQuery(`
+	err = a.PB.DB().NewQuery(`
 SELECT
     t.id AS id,
     t.title AS title,
+    COALESCE(NULLIF(t.tags, ''), '[]') AS tags,
     COALESCE(
         json_group_array(
             CASE
@@ -654,20 +857,17 @@ SELECT
 FROM threads t
 LEFT JOIN messages m
     ON m.parent_thread_id = t.id
+    AND {:query} != ''
     AND json_extract(m.parts, '$.content') LIKE '%' || {:query} || '%'
 WHERE
-    t.owner_user_id = {:userId} AND
-    (t.title LIKE '%' || {:query} || '%'
-    OR t.id IN (
-        SELECT parent_thread_id FROM messages WHERE json_extract(parts, '$.content') LIKE '%' || {:query} || '%'
-    ))
+    (t.owner_user_id = {:userId} OR EXISTS (
+        SELECT 1 FROM thread_members tm WHERE tm.thread_id = t.id AND tm.user_id = {:userId}
+    )) AND
+    (t.deleted_at IS NULL OR t.deleted_at = '')` + filter + `
 GROUP BY t.id, t.title
+ORDER BY t.updated DESC
 LIMIT 100;
-`).Bind(
-		dbx.Params{
-			"userId": userID,
-			"query":  query,
-		}).All(&results)
+`).Bind(params).All(&results)
 
 	if err != nil {
 		a.PB.Logger().Error("Failed to search threads", "error", err, "query", query)
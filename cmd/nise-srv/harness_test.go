@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/plugins/jsvm"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testMigrationsDir is the directory of the migrations, relative to the package.
+const testMigrationsDir = "../../pb_migrations"
+
+// testTitle is the title the fake upstream generates for every thread.
+const testTitle = "Test title"
+
+// The JS migrations are registered in the global migrations list, so only once for all the test apps.
+var registerTestMigrations sync.Once
+
+// fakeUpstream is an OpenAI compatible server standing in for OpenRouter. Streams are scripted by Script, which
+// replies with the last user message by default, and the other completions return Title.
+type fakeUpstream struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	requests      []upstreamRequest
+	titleRequests []upstreamRequest
+	// Script returns the script of the response to a streamed request
+	Script func(request mockRequest) MockScript
+	// Models is the catalog of the models endpoint, the supported parameters by model ID
+	Models map[string][]string
+	// Title is the content of the completions that aren't streamed, testTitle by default
+	Title string
+	// Complete returns the content of the completions that aren't streamed instead of Title when set
+	Complete func(request mockRequest) string
+}
+
+// upstreamRequest is a streamed request received by the fake upstream, with all the fields of its body in Params.
+type upstreamRequest struct {
+	mockRequest
+	Params map[string]json.RawMessage
+	// APIKey is the API key the request was sent with
+	APIKey string
+}
+
+func newFakeUpstream(t *testing.T) *fakeUpstream {
+	t.Helper()
+
+	upstream := &fakeUpstream{
+		Script: func(request mockRequest) MockScript {
+			return MockScript{Content: strings.SplitAfter("Reply to: "+request.lastUserText(), " ")}
+		},
+		Models: map[string][]string{
+			"test/model": {
+				"temperature", "top_p", "max_tokens", "stop", "seed", "presence_penalty", "frequency_penalty",
+				"response_format", "structured_outputs",
+			},
+			"test/basic": {"max_tokens"},
+		},
+		Title: testTitle,
+	}
+	upstream.Server = httptest.NewServer(http.HandlerFunc(upstream.handle))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func (u *fakeUpstream) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && r.URL.Path == "/models" {
+		u.mu.Lock()
+		models := make([]map[string]any, 0, len(u.Models))
+		for id, parameters := range u.Models {
+			models = append(models, map[string]any{"id": id, "object": "model", "supported_parameters": parameters})
+		}
+		u.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": models})
+		return
+	}
+	if r.Method != http.MethodPost || r.URL.Path != "/chat/completions" {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var request mockRequest
+	var params map[string]json.RawMessage
+	if err := json.Unmarshal(body, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_ = json.Unmarshal(body, &params)
+	apiKey := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	if string(params["stream"]) != "true" {
+		u.mu.Lock()
+		u.titleRequests = append(u.titleRequests, upstreamRequest{mockRequest: request, Params: params, APIKey: apiKey})
+		title := u.Title
+		if u.Complete != nil {
+			title = u.Complete(request)
+		}
+		u.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"id":      "fake-title",
+			"object":  "chat.completion",
+			"created": time.Now().Unix(),
+			"model":   request.Model,
+			"choices": []map[string]any{{
+				"index":         0,
+				"message":       map[string]any{"role": "assistant", "content": title},
+				"finish_reason": "stop",
+			}},
+		})
+		return
+	}
+
+	u.mu.Lock()
+	u.requests = append(u.requests, upstreamRequest{mockRequest: request, Params: params, APIKey: apiKey})
+	script := u.Script
+	u.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	_ = MockProvider{}.stream(r.Context(), flushWriter{w}, request, script(request))
+}
+
+// Requests returns the streamed requests received so far.
+func (u *fakeUpstream) Requests() []upstreamRequest {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]upstreamRequest(nil), u.requests...)
+}
+
+// TitleRequests returns the completions that aren't streamed received so far, the title generations.
+func (u *fakeUpstream) TitleRequests() []upstreamRequest {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]upstreamRequest(nil), u.titleRequests...)
+}
+
+// lastRequest returns the last streamed request received.
+func (u *fakeUpstream) lastRequest(t *testing.T) upstreamRequest {
+	t.Helper()
+
+	requests := u.Requests()
+	if len(requests) == 0 {
+		t.Fatalf("The upstream received no streamed request")
+	}
+	return requests[len(requests)-1]
+}
+
+// flushWriter flushes every write, so that streamed chunks reach the client one at a time.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// testServer is the API of an application with a temporary data dir, served over HTTP for the duration of a test.
+type testServer struct {
+	*httptest.Server
+
+	t        *testing.T
+	App      *Application
+	Upstream *fakeUpstream
+}
+
+// testUser is a user of a test server, with an OpenRouter API key.
+type testUser struct {
+	ID    string
+	Token string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	upstream := newFakeUpstream(t)
+	dataDir := t.TempDir()
+	app := NewApplicationWithConfig(ApplicationConfig{
+		DataDir:   dataDir,
+		AIBaseURL: upstream.URL,
+	})
+
+	registerTestMigrations.Do(func() {
+		jsvm.MustRegister(app.PB, jsvm.Config{
+			MigrationsDir: testMigrationsDir,
+			HooksDir:      filepath.Join(dataDir, "pb_hooks"),
+		})
+	})
+	app.bindHooks()
+
+	if err := app.PB.Bootstrap(); err != nil {
+		t.Fatalf("Failed to bootstrap the app: %v", err)
+	}
+	if err := app.PB.RunAllMigrations(); err != nil {
+		t.Fatalf("Failed to run the migrations: %v", err)
+	}
+
+	router, err := apis.NewRouter(app.PB)
+	if err != nil {
+		t.Fatalf("Failed to create the router: %v", err)
+	}
+	serveEvent := &core.ServeEvent{Router: router}
+	serveEvent.App = app.PB
+	var handler http.Handler
+	err = app.PB.OnServe().Trigger(serveEvent, func(e *core.ServeEvent) error {
+		mux, err := e.Router.BuildMux()
+		handler = mux
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to trigger the serve hooks: %v", err)
+	}
+
+	server := &testServer{
+		Server:   httptest.NewServer(handler),
+		t:        t,
+		App:      app,
+		Upstream: upstream,
+	}
+	t.Cleanup(func() {
+		server.Close()
+		_ = app.PB.OnTerminate().Trigger(&core.TerminateEvent{App: app.PB})
+		_ = app.PB.ResetBootstrapState()
+	})
+	return server
+}
+
+// createUser creates a verified user with an API key and returns its auth token.
+func (s *testServer) createUser(email string) testUser {
+	s.t.Helper()
+
+	users, err := s.App.PB.FindCollectionByNameOrId("users")
+	if err != nil {
+		s.t.Fatalf("Failed to find the users collection: %v", err)
+	}
+	user := core.NewRecord(users)
+	user.SetEmail(email)
+	user.SetPassword("password123")
+	user.SetVerified(true)
+	if err := s.App.PB.Save(user); err != nil {
+		s.t.Fatalf("Failed to create user %s: %v", email, err)
+	}
+
+	apiKeys, err := s.App.PB.FindCollectionByNameOrId("api_keys")
+	if err != nil {
+		s.t.Fatalf("Failed to find the api_keys collection: %v", err)
+	}
+	apiKey := core.NewRecord(apiKeys)
+	apiKey.Set("owner_user_id", user.Id)
+	apiKey.Set("provider", "openrouter")
+	apiKey.Set("key", "test-key")
+	if err := s.App.PB.Save(apiKey); err != nil {
+		s.t.Fatalf("Failed to create the API key of %s: %v", email, err)
+	}
+
+	token, err := user.NewAuthToken()
+	if err != nil {
+		s.t.Fatalf("Failed to create the auth token of %s: %v", email, err)
+	}
+	return testUser{ID: user.Id, Token: token}
+}
+
+// do sends a request as the user and returns the response, closed at the end of the test.
+func (s *testServer) do(user testUser, method, path string, body io.Reader, contentType string, header http.Header) *http.Response {
+	s.t.Helper()
+
+	req, err := http.NewRequest(method, s.URL+path, body)
+	if err != nil {
+		s.t.Fatalf("Failed to create request %s %s: %v", method, path, err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if user.Token != "" {
+		req.Header.Set("Authorization", user.Token)
+	}
+	res, err := s.Client().Do(req)
+	if err != nil {
+		s.t.Fatalf("Failed to send request %s %s: %v", method, path, err)
+	}
+	s.t.Cleanup(func() { _ = res.Body.Close() })
+	return res
+}
+
+// decode checks the status of a response and decodes its JSON body into out.
+func (s *testServer) decode(res *http.Response, status int, out any) {
+	s.t.Helper()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		s.t.Fatalf("Failed to read the response of %s: %v", res.Request.URL.Path, err)
+	}
+	if res.StatusCode != status {
+		s.t.Fatalf("%s %s returned %d, expected %d: %s", res.Request.Method, res.Request.URL.Path, res.StatusCode, status, body)
+	}
+	if out != nil {
+		if err := json.Unmarshal(body, out); err != nil {
+			s.t.Fatalf("Failed to decode the response of %s: %v: %s", res.Request.URL.Path, err, body)
+		}
+	}
+}
+
+// postForm sends a multipart form as the user, like the web client does for messages.
+func (s *testServer) postForm(user testUser, path string, fields map[string]string) *http.Response {
+	s.t.Helper()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for name, value := range fields {
+		if err := writer.WriteField(name, value); err != nil {
+			s.t.Fatalf("Failed to write form field %s: %v", name, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		s.t.Fatalf("Failed to close the form: %v", err)
+	}
+	return s.do(user, http.MethodPost, path, &body, writer.FormDataContentType(), nil)
+}
+
+// sendJSON sends a JSON body as the user.
+func (s *testServer) sendJSON(user testUser, method, path string, input any) *http.Response {
+	s.t.Helper()
+
+	body, err := json.Marshal(input)
+	if err != nil {
+		s.t.Fatalf("Failed to encode the body of %s: %v", path, err)
+	}
+	return s.do(user, method, path, bytes.NewReader(body), "application/json", nil)
+}
+
+// createThread creates a thread with a first message and returns the IDs of the thread and of the response.
+func (s *testServer) createThread(user testUser, content string) (threadID, responseID string) {
+	s.t.Helper()
+	return s.createThreadWithModel(user, content, ResponseModel{ProviderID: "test/model"})
+}
+
+// createThreadWithModel creates a thread with a first message answered by the response model.
+func (s *testServer) createThreadWithModel(user testUser, content string, responseModel ResponseModel) (threadID, responseID string) {
+	s.t.Helper()
+
+	responseModelJSON, err := json.Marshal(responseModel)
+	if err != nil {
+		s.t.Fatalf("Failed to encode the response model: %v", err)
+	}
+	var output struct {
+		Data NewThreadOutput `json:"data"`
+	}
+	res := s.postForm(user, "/api/threads", map[string]string{
+		"content":       content,
+		"responseModel": string(responseModelJSON),
+	})
+	s.decode(res, http.StatusOK, &output)
+	if output.Data.ResponseMessage == nil {
+		s.t.Fatalf("No response message for the new thread")
+	}
+	// The title is generated in the background, it must be done before the data dir is removed
+	s.waitTitle(output.Data.Thread.ID)
+	return output.Data.Thread.ID, output.Data.ResponseMessage.ID
+}
+
+// waitMessage waits for a message to stop streaming and returns its record.
+func (s *testServer) waitMessage(messageID string) *core.Record {
+	s.t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		record, err := s.App.PB.FindRecordById("messages", messageID)
+		if err != nil {
+			s.t.Fatalf("Failed to find message %s: %v", messageID, err)
+		}
+		status := MessageStatus(record.GetString("status"))
+		if status != MessageStatusPending && status != MessageStatusGenerating {
+			return record
+		}
+		if time.Now().After(deadline) {
+			s.t.Fatalf("Message %s is still %s", messageID, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitTitle waits for the title generation of a thread and returns its record.
+func (s *testServer) waitTitle(threadID string) *core.Record {
+	s.t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		record, err := s.App.PB.FindRecordById("threads", threadID)
+		if err != nil {
+			s.t.Fatalf("Failed to find thread %s: %v", threadID, err)
+		}
+		if record.GetString("title_generation_status") != ThreadTitleGenerationStatusGenerating.String() {
+			return record
+		}
+		if time.Now().After(deadline) {
+			s.t.Fatalf("The title of thread %s is still generating", threadID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readStream reads the chunks of the stream of a message until the server closes it, from after lastEventID when
+// it's not zero.
+func (s *testServer) readStream(user testUser, messageID string, lastEventID int) []Chunk {
+	s.t.Helper()
+
+	header := http.Header{}
+	if lastEventID > 0 {
+		header.Set("Last-Event-ID", strconv.Itoa(lastEventID))
+	}
+	res := s.do(user, http.MethodGet, "/api/messages/"+messageID+"/stream", nil, "", header)
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		s.t.Fatalf("Streaming message %s returned %d: %s", messageID, res.StatusCode, body)
+	}
+
+	var chunks []Chunk
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var chunk Chunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			s.t.Fatalf("Invalid chunk in the stream of message %s: %v: %s", messageID, err, data)
+		}
+		chunks = append(chunks, chunk)
+	}
+	if err := scanner.Err(); err != nil {
+		s.t.Fatalf("Failed to read the stream of message %s: %v", messageID, err)
+	}
+	return chunks
+}
+
+// chunksContent concatenates the content of the content chunks.
+func chunksContent(chunks []Chunk) string {
+	var content strings.Builder
+	for _, chunk := range chunks {
+		if chunk.Type == ChunkTypeContent {
+			content.WriteString(chunk.Content)
+		}
+	}
+	return content.String()
+}
+
+// messageParts returns the parts of a message record.
+func messageParts(t *testing.T, record *core.Record) MessageParts {
+	t.Helper()
+
+	var parts MessageParts
+	if err := record.UnmarshalJSONField("parts", &parts); err != nil {
+		t.Fatalf("Failed to unmarshal the parts of message %s: %v", record.Id, err)
+	}
+	return parts
+}
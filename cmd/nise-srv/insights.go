@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/openai/openai-go"
+	"github.com/pocketbase/pocketbase/core"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// MaxSummaryLength is the maximum number of characters of the summary of a thread
+	MaxSummaryLength      = 2000
+	threadInsightsTimeout = 30 * time.Second
+
+	threadInsightsPrompt = `You maintain the summary of a chat thread between a user and an AI assistant, and suggest what the user could ask next. You are given the current summary of the thread when there is one, and the messages that came after it. Reply with a JSON object with two fields: "summary", a concise summary of the whole thread in a few sentences that updates the current summary with the new messages, and "suggestions", 2 or 3 short follow-up prompts the user could send next, written as the user. Output only the JSON object.`
+)
+
+// threadInsightsFormat is the JSON schema the reply of the insights model is validated against.
+var threadInsightsFormat = &ResponseFormat{
+	Type: ResponseFormatTypeJSONSchema,
+	JSONSchema: &ResponseFormatJSONSchema{
+		Name: "thread_insights",
+		Schema: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"summary": {"type": "string", "minLength": 1},
+				"suggestions": {
+					"type": "array",
+					"items": {"type": "string", "minLength": 1, "maxLength": 500},
+					"minItems": 2,
+					"maxItems": 3
+				}
+			},
+			"required": ["summary", "suggestions"]
+		}`),
+	},
+}
+
+// ThreadInsights are the rolling summary of a thread and the follow-up prompts suggested after its latest response.
+type ThreadInsights struct {
+	Summary     string   `json:"summary"`
+	Suggestions []string `json:"suggestions"`
+}
+
+// parseThreadInsights validates the reply of the insights model and cleans it up.
+func parseThreadInsights(content string) (ThreadInsights, error) {
+	structured, err := structuredOutput(threadInsightsFormat, content)
+	if err != nil {
+		return ThreadInsights{}, err
+	}
+	var insights ThreadInsights
+	if err := json.Unmarshal(structured, &insights); err != nil {
+		return ThreadInsights{}, fmt.Errorf("failed to unmarshal thread insights: %w", err)
+	}
+	insights.Summary = truncateRunes(strings.TrimSpace(insights.Summary), MaxSummaryLength)
+	suggestions := make([]string, 0, len(insights.Suggestions))
+	for _, suggestion := range insights.Suggestions {
+		if suggestion = strings.TrimSpace(suggestion); suggestion != "" && !slices.Contains(suggestions, suggestion) {
+			suggestions = append(suggestions, suggestion)
+		}
+	}
+	insights.Suggestions = suggestions
+	return insights, nil
+}
+
+// latestTitleMessages returns the latest messages that fit in the conversation given to the titling model, so that
+// the newest ones are never left out.
+func latestTitleMessages(messages []TitleMessage) []TitleMessage {
+	length := 0
+	for i := len(messages) - 1; i >= 0; i-- {
+		length += utf8.RuneCountInString(truncateRunes(strings.TrimSpace(messages[i].Content), titleMessageMaxLength))
+		if length > titleConversationMaxLength {
+			return messages[i+1:]
+		}
+	}
+	return messages
+}
+
+// scheduleThreadInsights is the record hook updating the insights of a thread in the background once one of its
+// responses completes, when thread insights are enabled.
+func (a *Application) scheduleThreadInsights(e *core.RecordEvent) error {
+	if a.ThreadInsightsEnabled &&
+		e.Record.GetString("role") == MessageRoleAssistant.String() &&
+		e.Record.GetString("status") == MessageStatusCompleted.String() &&
+		e.Record.Original().GetString("status") != MessageStatusCompleted.String() {
+		go a.updateThreadInsights(e.Record.GetString("owner_user_id"), e.Record.GetString("parent_thread_id"), e.Record.Id)
+	}
+
+	return e.Next()
+}
+
+// updateThreadInsights updates the summary of a thread with the branch ending with the response, and suggests
+// follow-up prompts for the response. The summary is rolled forward from the previous one while the response
+// continues the summarized branch, and generated again from the whole branch when the branch changed.
+func (a *Application) updateThreadInsights(ownerUserID, threadID, messageID string) {
+	startTime := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), threadInsightsTimeout)
+	defer cancel()
+
+	threadRecord, err := a.PB.FindRecordById("threads", threadID)
+	if err != nil {
+		a.PB.Logger().Error("Failed to find thread record for insights", "error", err, "threadID", threadID)
+		return
+	}
+	messageRecord, err := a.PB.FindRecordById("messages", messageID)
+	if err != nil {
+		a.PB.Logger().Error("Failed to find message record for insights", "error", err, "messageID", messageID)
+		return
+	}
+	summary := threadRecord.GetString("summary")
+	summaryMessageID := threadRecord.GetString("summary_message_id")
+	var suggestions []string
+	_ = messageRecord.UnmarshalJSONField("suggestions", &suggestions)
+	if summaryMessageID == messageID && len(suggestions) > 0 {
+		return
+	}
+
+	branch, err := getThreadFiber(a.PB, ownerUserID, messageID)
+	if err != nil {
+		a.PB.Logger().Error("Failed to find the branch for insights", "error", err, "messageID", messageID)
+		return
+	}
+	// Only the messages after the summarized one are needed while on the same branch
+	newMessages := branch
+	if i := slices.IndexFunc(branch, func(m MessageDB) bool { return m.ID == summaryMessageID }); i >= 0 && summary != "" {
+		newMessages = branch[i+1:]
+		if len(newMessages) == 0 {
+			// The summary is up to date, the last exchange is enough to suggest follow-ups
+			newMessages = branch[max(0, len(branch)-2):]
+		}
+	} else {
+		summary = ""
+	}
+
+	input := formatTitleConversation(latestTitleMessages(titleMessages(newMessages)))
+	if summary != "" {
+		input = fmt.Sprintf("<summary>%s</summary>\n%s", summary, input)
+	}
+	// The member who asked for the response pays for its insights, like for the response itself
+	apiKeyUserID := ownerUserID
+	if authorUserID := messageRecord.GetString("author_user_id"); authorUserID != "" {
+		apiKeyUserID = authorUserID
+	}
+	settings := a.titleSettings(apiKeyUserID)
+	options, err := a.titlingRequestOptions(apiKeyUserID, settings)
+	if err != nil {
+		a.PB.Logger().Error("Failed to prepare the insights request", "error", err, "threadID", threadID)
+		return
+	}
+	chat, err := a.AIClient.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
+		Messages: []openai.ChatCompletionMessageParamUnion{
+			openai.SystemMessage(threadInsightsPrompt),
+			openai.UserMessage(input),
+		},
+		Model:               settings.Model,
+		MaxCompletionTokens: openai.Opt[int64](1000),
+	}, options...)
+	if err != nil {
+		a.PB.Logger().Error("Failed to generate thread insights", "error", err, "threadID", threadID)
+		return
+	}
+	if len(chat.Choices) == 0 {
+		a.PB.Logger().Error("No choices returned for thread insights", "threadID", threadID)
+		return
+	}
+	insights, err := parseThreadInsights(chat.Choices[0].Message.Content)
+	if err != nil {
+		a.PB.Logger().Error("Invalid thread insights", "error", err, "threadID", threadID)
+		return
+	}
+
+	err = a.PB.RunInTransaction(func(txApp core.App) error {
+		threadRecord, err := txApp.FindRecordById("threads", threadID)
+		if err != nil {
+			return fmt.Errorf("failed to find thread record: %w", err)
+		}
+		threadRecord.Set("summary", insights.Summary)
+		threadRecord.Set("summary_message_id", messageID)
+		if err := txApp.Save(threadRecord); err != nil {
+			return fmt.Errorf("failed to save thread summary: %w", err)
+		}
+		messageRecord, err := txApp.FindRecordById("messages", messageID)
+		if err != nil {
+			return fmt.Errorf("failed to find message record: %w", err)
+		}
+		messageRecord.Set("suggestions", insights.Suggestions)
+		if err := txApp.Save(messageRecord); err != nil {
+			return fmt.Errorf("failed to save message suggestions: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		a.PB.Logger().Error("Failed to save thread insights", "error", err, "threadID", threadID, "messageID", messageID)
+		return
+	}
+
+	a.ThreadEvents.Publish(ThreadEvent{
+		Type:      ThreadEventInsightsUpdated,
+		ThreadID:  threadID,
+		MessageID: messageID,
+	})
+	a.PB.Logger().Info("Updated thread insights", "threadID", threadID, "messageID", messageID, "rolled", summary != "", "timeTakenMs", time.Since(startTime).Milliseconds())
+}
+
+type ThreadInsightsOutput struct {
+	Summary string `json:"summary"`
+	// SummaryMessageID is the last message of the summarized branch, clients on another branch can ignore the summary
+	SummaryMessageID string `json:"summaryMessageId"`
+	// Suggestions are the follow-up prompts of the requested message, or of the summarized one
+	Suggestions []string `json:"suggestions"`
+}
+
+// threadInsightsHandler returns the summary of a thread and the follow-up suggestions of one of its messages.
+func (a *Application) threadInsightsHandler(e *core.RequestEvent) error {
+	threadID := e.Request.PathValue("threadId")
+	if len(threadID) != 26 {
+		a.PB.Logger().Warn("Invalid thread ID length", "threadID", threadID)
+		return e.JSON(400, InvalidInputErrorData)
+	}
+	messageID := e.Request.URL.Query().Get("messageId")
+	if messageID != "" && len(messageID) != 26 {
+		a.PB.Logger().Warn("Invalid message ID length", "messageID", messageID)
+		return e.JSON(400, InvalidInputErrorData)
+	}
+
+	_, err := findThreadAccess(a.PB, threadID, e.Auth.Id)
+	if errors.Is(err, errThreadAccessDenied) {
+		return e.JSON(404, map[string]string{"error": "Thread not found or access denied"})
+	}
+	if err != nil {
+		a.PB.Logger().Error("Failed to find thread access", "error", err, "threadID", threadID)
+		return e.JSON(500, UnexpectedErrorData)
+	}
+	threadRecord, err := a.PB.FindRecordById("threads", threadID)
+	if err != nil {
+		a.PB.Logger().Error("Failed to find thread record", "error", err, "threadID", threadID)
+		return e.JSON(500, UnexpectedErrorData)
+	}
+
+	output := ThreadInsightsOutput{
+		Summary:          threadRecord.GetString("summary"),
+		SummaryMessageID: threadRecord.GetString("summary_message_id"),
+		Suggestions:      []string{},
+	}
+	if messageID == "" {
+		messageID = output.SummaryMessageID
+	}
+	if messageID != "" {
+		messageRecord, err := a.PB.FindRecordById("messages", messageID)
+		if err != nil || messageRecord.GetString("parent_thread_id") != threadID {
+			a.PB.Logger().Warn("Message not found in thread", "error", err, "threadID", threadID, "messageID", messageID)
+			return e.JSON(404, map[string]string{"error": "Message not found in the thread"})
+		}
+		var suggestions []string
+		if err := messageRecord.UnmarshalJSONField("suggestions", &suggestions); err == nil && len(suggestions) > 0 {
+			output.Suggestions = suggestions
+		}
+	}
+
+	return e.JSON(200, output)
+}
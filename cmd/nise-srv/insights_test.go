@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitInsights waits for the summary of the thread to cover the branch ending with the message.
+func (s *testServer) waitInsights(user testUser, threadID, messageID string) ThreadInsightsOutput {
+	s.t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var output ThreadInsightsOutput
+		res := s.do(user, http.MethodGet, "/api/threads/"+threadID+"/insights?messageId="+messageID, nil, "", nil)
+		s.decode(res, http.StatusOK, &output)
+		if output.SummaryMessageID == messageID {
+			return output
+		}
+		if time.Now().After(deadline) {
+			s.t.Fatalf("The insights of thread %s don't cover message %s: %+v", threadID, messageID, output)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestParseThreadInsights(t *testing.T) {
+	insights, err := parseThreadInsights("```json\n" + `{"summary":"  About Go ","suggestions":["What about channels?"," What about channels? ","And generics?"]}` + "\n```")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := ThreadInsights{Summary: "About Go", Suggestions: []string{"What about channels?", "And generics?"}}
+	if !reflect.DeepEqual(insights, expected) {
+		t.Errorf("Insights are %+v, expected %+v", insights, expected)
+	}
+
+	if _, err := parseThreadInsights(`{"summary":"About Go","suggestions":["Only one"]}`); err == nil {
+		t.Errorf("Insights with a single suggestion were accepted")
+	}
+}
+
+func TestThreadInsights(t *testing.T) {
+	s := newTestServer(t)
+	s.App.ThreadInsightsEnabled = true
+	user := s.createUser("user@example.com")
+
+	var inputs []string
+	s.Upstream.Complete = func(request mockRequest) string {
+		if request.text(request.Messages[0].Content) != threadInsightsPrompt {
+			return testTitle
+		}
+		inputs = append(inputs, request.lastUserText())
+		n := len(inputs)
+		return fmt.Sprintf(`{"summary":"Summary %d","suggestions":["Follow-up %d.1","Follow-up %d.2"]}`, n, n, n)
+	}
+	insightsInput := func() string {
+		s.Upstream.mu.Lock()
+		defer s.Upstream.mu.Unlock()
+		return inputs[len(inputs)-1]
+	}
+
+	threadID, firstResponseID := s.createThread(user, "First question")
+	insights := s.waitInsights(user, threadID, firstResponseID)
+	if insights.Summary != "Summary 1" || !reflect.DeepEqual(insights.Suggestions, []string{"Follow-up 1.1", "Follow-up 1.2"}) {
+		t.Errorf("Insights of the first response are %+v", insights)
+	}
+	if input := insightsInput(); strings.Contains(input, "<summary>") || !strings.Contains(input, "<user>First question</user>") {
+		t.Errorf("First insights input is %q, expected the whole branch", input)
+	}
+
+	// Continuing the branch rolls the summary forward with the new messages only
+	var output struct {
+		ResponseMessageID string `json:"responseMessageId"`
+	}
+	res := s.postForm(user, "/api/threads/"+threadID+"/messages", map[string]string{
+		"content":         "Second question",
+		"parentMessageId": firstResponseID,
+		"responseModel":   testResponseModel,
+	})
+	s.decode(res, http.StatusOK, &output)
+	insights = s.waitInsights(user, threadID, output.ResponseMessageID)
+	if insights.Summary != "Summary 2" {
+		t.Errorf("Summary after the second response is %q", insights.Summary)
+	}
+	input := insightsInput()
+	if !strings.HasPrefix(input, "<summary>Summary 1</summary>") || strings.Contains(input, "First question") || !strings.Contains(input, "<user>Second question</user>") {
+		t.Errorf("Rolling insights input is %q", input)
+	}
+
+	// The suggestions of earlier responses are kept
+	var firstInsights ThreadInsightsOutput
+	res = s.do(user, http.MethodGet, "/api/threads/"+threadID+"/insights?messageId="+firstResponseID, nil, "", nil)
+	s.decode(res, http.StatusOK, &firstInsights)
+	if !reflect.DeepEqual(firstInsights.Suggestions, []string{"Follow-up 1.1", "Follow-up 1.2"}) {
+		t.Errorf("Suggestions of the first response are %q", firstInsights.Suggestions)
+	}
+
+	// Another branch is summarized from its start
+	var regenerated struct {
+		MessageID string `json:"messageId"`
+	}
+	res = s.sendJSON(user, http.MethodPost, "/api/threads/"+threadID+"/messages/"+firstResponseID+"/regenerate", map[string]any{
+		"responseModel": map[string]any{"providerId": "test/model"},
+	})
+	s.decode(res, http.StatusOK, &regenerated)
+	insights = s.waitInsights(user, threadID, regenerated.MessageID)
+	if insights.Summary != "Summary 3" || !reflect.DeepEqual(insights.Suggestions, []string{"Follow-up 3.1", "Follow-up 3.2"}) {
+		t.Errorf("Insights of the regenerated response are %+v", insights)
+	}
+	if input := insightsInput(); strings.Contains(input, "<summary>") || !strings.Contains(input, "<user>First question</user>") || strings.Contains(input, "Second question") {
+		t.Errorf("Insights input of another branch is %q, expected the whole branch", input)
+	}
+
+	// Only the users with access to the thread get its insights
+	other := s.createUser("other@example.com")
+	res = s.do(other, http.MethodGet, "/api/threads/"+threadID+"/insights", nil, "", nil)
+	s.decode(res, http.StatusNotFound, nil)
+}
+
+func TestThreadInsightsOfContributor(t *testing.T) {
+	s := newTestServer(t)
+	s.App.ThreadInsightsEnabled = true
+	owner := s.createUser("owner@example.com")
+	contributor := s.createUser("contributor@example.com")
+	s.Upstream.Complete = func(request mockRequest) string {
+		return `{"summary":"Summary","suggestions":["Follow-up 1","Follow-up 2"]}`
+	}
+	threadID, responseID := s.createThread(owner, "First question")
+	s.waitInsights(owner, threadID, responseID)
+	s.addThreadMember(owner, threadID, "contributor@example.com", ThreadRoleContributor)
+
+	apiKey, err := s.App.PB.FindFirstRecordByData("api_keys", "owner_user_id", contributor.ID)
+	if err != nil {
+		t.Fatalf("Failed to find the API key of the contributor: %v", err)
+	}
+	apiKey.Set("key", "contributor-key")
+	if err := s.App.PB.Save(apiKey); err != nil {
+		t.Fatalf("Failed to save the API key of the contributor: %v", err)
+	}
+	var output struct {
+		ResponseMessageID string `json:"responseMessageId"`
+	}
+	res := s.postForm(contributor, "/api/threads/"+threadID+"/messages", map[string]string{
+		"content":         "Second question",
+		"parentMessageId": responseID,
+		"responseModel":   testResponseModel,
+	})
+	s.decode(res, http.StatusOK, &output)
+	s.waitInsights(owner, threadID, output.ResponseMessageID)
+
+	// The contributor pays for the insights of their response, not the owner
+	requests := s.Upstream.TitleRequests()
+	if key := requests[len(requests)-1].APIKey; key != "contributor-key" {
+		t.Errorf("Insights were requested with API key %q, expected the one of the contributor", key)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/base32"
 	"fmt"
 	"github.com/google/uuid"
@@ -81,6 +82,27 @@ func main() {
 		"fallback the request to index.html on missing static path, e.g. when pretty urls are used with SPA",
 	)
 
+	app.PB.RootCmd.PersistentFlags().IntVar(
+		&app.TrashRetentionDays,
+		"trashRetentionDays",
+		DefaultTrashRetentionDays,
+		"the number of days deleted threads stay in the trash before being permanently deleted",
+	)
+
+	app.PB.RootCmd.PersistentFlags().BoolVar(
+		&app.ThreadInsightsEnabled,
+		"threadInsights",
+		false,
+		"summarize threads and suggest follow-up prompts in the background after every response, with the titling model",
+	)
+
+	app.PB.RootCmd.PersistentFlags().BoolVar(
+		&app.StreamService.MockProviderEnabled,
+		"mockProvider",
+		false,
+		"serve the mock/ models, e.g. mock/echo, with an in process mock provider for development and tests",
+	)
+
 	app.PB.RootCmd.ParseFlags(os.Args[1:])
 
 	// ---------------------------------------------------------------
@@ -105,11 +127,51 @@ func main() {
 	// GitHub selfupdate
 	ghupdate.MustRegister(app.PB, app.PB.RootCmd, ghupdate.Config{})
 
+	// chat command, for using Nise from a terminal
+	app.PB.RootCmd.AddCommand(app.newChatCommand())
+
+	// admin command, for maintaining the data dir
+	app.PB.RootCmd.AddCommand(app.newAdminCommand())
+
 	// ---------------------------------------------------------------
-	// Routes
+	// Hooks, routes and background workers
 	// ---------------------------------------------------------------
 
-	app.PB.OnFileDownloadRequest().BindFunc(func(e *core.FileDownloadRequestEvent) error {
+	app.bindHooks()
+
+	app.PB.OnServe().Bind(&hook.Handler[*core.ServeEvent]{
+		Func: func(e *core.ServeEvent) error {
+			if !e.Router.HasRoute(http.MethodGet, "/{path...}") {
+				e.Router.GET("/{path...}", apis.Static(dist.DistDirFS, true)).Bind(apis.Gzip())
+			}
+
+			return e.Next()
+		},
+		Priority: 100, // execute as latest as possible to allow users to provide their own route
+	})
+
+	// static route to serves files from the provided public dir
+	// (if publicDir exists and the route path is not already defined)
+	app.PB.OnServe().Bind(&hook.Handler[*core.ServeEvent]{
+		Func: func(e *core.ServeEvent) error {
+			if !e.Router.HasRoute(http.MethodGet, "/{path...}") {
+				e.Router.GET("/{path...}", apis.Static(os.DirFS(publicDir), indexFallback))
+			}
+
+			return e.Next()
+		},
+		Priority: 999, // execute as latest as possible to allow users to provide their own route
+	})
+
+	if err := app.PB.Start(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// bindHooks binds the record hooks, routes, background workers and cron jobs of the application, without the plugins
+// and static files that depend on the flags of the main command.
+func (a *Application) bindHooks() {
+	a.PB.OnFileDownloadRequest().BindFunc(func(e *core.FileDownloadRequestEvent) error {
 		if strings.HasSuffix(e.ServedName, ".js") || strings.HasSuffix(e.ServedName, ".mjs") {
 			e.Request.Header.Set("Content-Type", "text/javascript")
 		}
@@ -117,58 +179,134 @@ func main() {
 		return e.Next()
 	})
 
-	app.PB.OnServe().BindFunc(func(se *core.ServeEvent) error {
+	// Disabled users can't sign in or refresh their auth token
+	a.PB.OnRecordAuthRequest("users").BindFunc(func(e *core.RecordAuthRequestEvent) error {
+		if e.Record.GetBool("disabled") {
+			return apis.NewForbiddenError("The account is disabled.", nil)
+		}
+
+		return e.Next()
+	})
+
+	// Deleting a thread moves it to the trash, deleting it from the trash is permanent
+	a.PB.OnRecordDeleteRequest("threads").BindFunc(a.trashThreadOnDelete)
+
+	// Fallback chains must be lists of model IDs
+	a.PB.OnRecordValidate("model_fallbacks").BindFunc(validateModelFallbacks)
+
+	// Title settings must have valid provider preferences
+	a.PB.OnRecordValidate("title_settings").BindFunc(validateTitleSettings)
+
+	// Live updates for the viewers of a thread, whichever API changed it
+	a.PB.OnRecordAfterCreateSuccess("messages").BindFunc(a.publishMessageCreated)
+	a.PB.OnRecordAfterUpdateSuccess("threads").BindFunc(a.publishTitleUpdated)
+
+	// Summaries and follow-up suggestions once a response completes
+	a.PB.OnRecordAfterUpdateSuccess("messages").BindFunc(a.scheduleThreadInsights)
+
+	a.PB.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		// Accept personal access tokens on every route, before the PocketBase auth token is loaded
+		se.Router.Bind(a.loadAccessToken())
+
 		// POST /api/threads, create a new thread with the first message
-		se.Router.POST("/api/threads", app.newThreadHandler).Bind(apis.RequireAuth())
+		se.Router.POST("/api/threads", a.newThreadHandler).Bind(apis.RequireAuth())
 
 		// POST /api/threads/{threadId}/messages, create a new message in an existing thread
-		se.Router.POST("/api/threads/{threadId}/messages", app.newMessageInThreadHandler).Bind(apis.RequireAuth())
+		se.Router.POST("/api/threads/{threadId}/messages", a.newMessageInThreadHandler).Bind(apis.RequireAuth())
 
 		// PATCH /api/threads/{threadId}/messages/{messageId}, update an existing message
-		se.Router.PATCH("/api/messages/{messageId}", app.updateMessageInThreadHandler).Bind(apis.RequireAuth())
+		se.Router.PATCH("/api/messages/{messageId}", a.updateMessageInThreadHandler).Bind(apis.RequireAuth())
 
 		// POST /api/threads/{threadId}/messages/{messageId}/regenerate, regenerate an existing message in a thread
-		se.Router.POST("/api/threads/{threadId}/messages/{messageId}/regenerate", app.regenerateMessageInThreadHandler).Bind(apis.RequireAuth())
+		se.Router.POST("/api/threads/{threadId}/messages/{messageId}/regenerate", a.regenerateMessageInThreadHandler).Bind(apis.RequireAuth())
 
 		// GET /api/messages/{messageId}/stream, stream the content of a message in a thread
-		se.Router.GET("/api/messages/{messageId}/stream", app.streamMessageHandler).Bind(apis.RequireAuth())
+		se.Router.GET("/api/messages/{messageId}/stream", a.streamMessageHandler).Bind(apis.RequireAuth())
+
+		// POST /api/messages/{messageId}/cancel, stop the generation of a message that is still streaming
+		se.Router.POST("/api/messages/{messageId}/cancel", a.cancelMessageHandler).Bind(apis.RequireAuth())
+
+		// GET /api/ws, websocket for sending messages and receiving their streams over a single connection
+		se.Router.GET("/api/ws", a.websocketHandler)
+
+		// POST /api/tokens, create a personal access token for the API
+		se.Router.POST("/api/tokens", a.newAccessTokenHandler).Bind(apis.RequireAuth())
+
+		// POST /api/tokens/{tokenId}/revoke, revoke a personal access token
+		se.Router.POST("/api/tokens/{tokenId}/revoke", a.revokeAccessTokenHandler).Bind(apis.RequireAuth())
+
+		// POST /v1/chat/completions, OpenAI compatible chat completions authenticated with a personal access token
+		se.Router.POST("/v1/chat/completions", a.chatCompletionsHandler).Bind(a.requireAccessToken())
 
 		// GET /api/key{keyId}/info, get the info for a specific key
-		se.Router.GET("/api/key/{keyId}/info", app.getKeyInfoHandler).Bind(apis.RequireAuth())
+		se.Router.GET("/api/key/{keyId}/info", a.getKeyInfoHandler).Bind(apis.RequireAuth())
 
 		// GET /api/threads/search, search for threads
-		se.Router.GET("/api/threads/search", app.searchThreadsHandler).Bind(apis.RequireAuth())
+		se.Router.GET("/api/threads/search", a.searchThreadsHandler).Bind(apis.RequireAuth())
+
+		// GET /api/threads/trash, list the threads in the trash
+		se.Router.GET("/api/threads/trash", a.listTrashedThreadsHandler).Bind(apis.RequireAuth())
+
+		// POST /api/threads/{threadId}/restore, move a thread out of the trash
+		se.Router.POST("/api/threads/{threadId}/restore", a.restoreThreadHandler).Bind(apis.RequireAuth())
+
+		// POST /api/threads/{threadId}/retitle, regenerate the title of a thread from its conversation
+		se.Router.POST("/api/threads/{threadId}/retitle", a.retitleThreadHandler).Bind(apis.RequireAuth())
+
+		// GET /api/threads/{threadId}/insights, get the summary of a thread and the follow-up suggestions of a message
+		se.Router.GET("/api/threads/{threadId}/insights", a.threadInsightsHandler).Bind(apis.RequireAuth())
+
+		// POST /api/threads/{threadId}/move, move a thread into a project or out of its project
+		se.Router.POST("/api/threads/{threadId}/move", a.moveThreadHandler).Bind(apis.RequireAuth())
+
+		// GET /api/threads/{threadId}/members, list the owner and members of a thread
+		se.Router.GET("/api/threads/{threadId}/members", a.listThreadMembersHandler).Bind(apis.RequireAuth())
+
+		// POST /api/threads/{threadId}/members, add a member to a thread or change their role
+		se.Router.POST("/api/threads/{threadId}/members", a.addThreadMemberHandler).Bind(apis.RequireAuth())
+
+		// GET /api/threads/{threadId}/events, stream the live events and presence of a thread
+		se.Router.GET("/api/threads/{threadId}/events", a.threadEventsHandler).Bind(apis.RequireAuth())
+
+		// POST /api/threads/{threadId}/typing, tell the viewers of a thread that the user is writing
+		se.Router.POST("/api/threads/{threadId}/typing", a.typingHandler).Bind(apis.RequireAuth())
+
+		// POST /api/threads/{threadId}/tags, add tags to a thread
+		se.Router.POST("/api/threads/{threadId}/tags", a.addTagsHandler("threads", "threadId")).Bind(apis.RequireAuth())
+
+		// DELETE /api/threads/{threadId}/tags/{tag}, remove a tag from a thread
+		se.Router.DELETE("/api/threads/{threadId}/tags/{tag}", a.removeTagHandler("threads", "threadId")).Bind(apis.RequireAuth())
+
+		// POST /api/messages/{messageId}/tags, add tags to a message
+		se.Router.POST("/api/messages/{messageId}/tags", a.addTagsHandler("messages", "messageId")).Bind(apis.RequireAuth())
+
+		// DELETE /api/messages/{messageId}/tags/{tag}, remove a tag from a message
+		se.Router.DELETE("/api/messages/{messageId}/tags/{tag}", a.removeTagHandler("messages", "messageId")).Bind(apis.RequireAuth())
 
 		return se.Next()
 	})
 
-	app.PB.OnServe().Bind(&hook.Handler[*core.ServeEvent]{
-		Func: func(e *core.ServeEvent) error {
-			if !e.Router.HasRoute(http.MethodGet, "/{path...}") {
-				e.Router.GET("/{path...}", apis.Static(dist.DistDirFS, true)).Bind(apis.Gzip())
-			}
+	// ---------------------------------------------------------------
+	// Background workers
+	// ---------------------------------------------------------------
 
-			return e.Next()
-		},
-		Priority: 100, // execute as latest as possible to allow users to provide their own route
-	})
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	a.PB.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		go a.Webhooks.Run(workersCtx)
 
-	// static route to serves files from the provided public dir
-	// (if publicDir exists and the route path is not already defined)
-	app.PB.OnServe().Bind(&hook.Handler[*core.ServeEvent]{
-		Func: func(e *core.ServeEvent) error {
-			if !e.Router.HasRoute(http.MethodGet, "/{path...}") {
-				e.Router.GET("/{path...}", apis.Static(os.DirFS(publicDir), indexFallback))
-			}
+		return se.Next()
+	})
+	a.PB.OnTerminate().BindFunc(func(e *core.TerminateEvent) error {
+		stopWorkers()
 
-			return e.Next()
-		},
-		Priority: 999, // execute as latest as possible to allow users to provide their own route
+		return e.Next()
 	})
 
-	if err := app.PB.Start(); err != nil {
-		log.Fatal(err)
-	}
+	// Retention policies, the cron scheduler only runs while serving
+	a.PB.Cron().MustAdd(RetentionCronID, RetentionCronSchedule, a.runRetentionJob)
+
+	// Emptying the trash of threads deleted more than trashRetentionDays ago
+	a.PB.Cron().MustAdd(TrashCronID, TrashCronSchedule, a.runTrashJob)
 }
 
 // the default pb_public dir location is relative to the executable
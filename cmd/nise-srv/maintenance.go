@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"slices"
+	"strings"
+	"time"
+)
+
+// UserUsage is the activity of a user, with token usage summed over the assistant messages.
+type UserUsage struct {
+	UserID           string `db:"id"`
+	Email            string `db:"email"`
+	Threads          int    `db:"threads"`
+	Messages         int    `db:"messages"`
+	PromptTokens     int64  `db:"prompt_tokens"`
+	CompletionTokens int64  `db:"completion_tokens"`
+	LastActive       string `db:"last_active"`
+}
+
+// usageByUser returns the usage of every user from the given date, or of all time when since is zero.
+func (a *Application) usageByUser(since types.DateTime) ([]UserUsage, error) {
+	var usage []UserUsage
+	err := a.PB.DB().NewQuery(`
+SELECT
+	u.id,
+	u.email,
+	(SELECT COUNT(*) FROM threads t WHERE t.owner_user_id = u.id) AS threads,
+	COUNT(m.id) AS messages,
+	COALESCE(SUM(json_extract(m.meta, '$.usage.prompt_tokens')), 0) AS prompt_tokens,
+	COALESCE(SUM(json_extract(m.meta, '$.usage.completion_tokens')), 0) AS completion_tokens,
+	COALESCE(MAX(m.created), '') AS last_active
+FROM users u
+LEFT JOIN messages m ON m.owner_user_id = u.id AND m.role = {:role} AND m.created >= {:since}
+GROUP BY u.id
+ORDER BY completion_tokens DESC, u.email ASC;
+`).Bind(dbx.Params{"role": MessageRoleAssistant, "since": since.String()}).All(&usage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage: %w", err)
+	}
+	return usage, nil
+}
+
+// purgeUserThreads deletes every thread of the user, along with their messages and attachments.
+func (a *Application) purgeUserThreads(userID string) (int, error) {
+	threads, err := a.PB.FindAllRecords("threads", dbx.HashExp{"owner_user_id": userID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to find threads of user: %w", err)
+	}
+
+	err = a.PB.RunInTransaction(func(txApp core.App) error {
+		for _, thread := range threads {
+			// Messages are deleted by cascade, and their attachments once the transaction is committed
+			if err := txApp.Delete(thread); err != nil {
+				return fmt.Errorf("failed to delete thread %s: %w", thread.Id, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(threads), nil
+}
+
+// stuckMessageError is the error set on messages whose generation was interrupted, e.g. by a server restart.
+const stuckMessageError = "The generation was interrupted"
+
+// resetStuckMessages marks messages left pending or generating for longer than olderThan as failed. Messages
+// still streaming in this process are left alone.
+func (a *Application) resetStuckMessages(olderThan time.Duration) (int, error) {
+	before, err := types.ParseDateTime(time.Now().Add(-olderThan))
+	if err != nil {
+		return 0, err
+	}
+	messages, err := a.PB.FindRecordsByFilter(
+		"messages",
+		"(status = {:pending} || status = {:generating}) && updated <= {:before}",
+		"",
+		0,
+		0,
+		dbx.Params{"pending": MessageStatusPending, "generating": MessageStatusGenerating, "before": before},
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find stuck messages: %w", err)
+	}
+
+	reset := 0
+	for _, message := range messages {
+		if _, streaming, _ := a.StreamService.GetActiveStream(message.Id, message.GetString("owner_user_id")); streaming {
+			continue
+		}
+
+		var parts MessageParts
+		if err := message.UnmarshalJSONField("parts", &parts); err != nil {
+			return reset, fmt.Errorf("failed to unmarshal parts of message %s: %w", message.Id, err)
+		}
+		var meta MessageMeta
+		if err := message.UnmarshalJSONField("meta", &meta); err != nil {
+			return reset, fmt.Errorf("failed to unmarshal meta of message %s: %w", message.Id, err)
+		}
+		parts.Error = stuckMessageError
+		meta.FinishReason = FinishReasonError
+
+		message.Set("parts", parts)
+		message.Set("meta", meta)
+		message.Set("status", MessageStatusFailed)
+		if err := a.PB.Save(message); err != nil {
+			return reset, fmt.Errorf("failed to save message %s: %w", message.Id, err)
+		}
+		reset++
+	}
+	return reset, nil
+}
+
+// vacuumAttachments finds attachment files of the messages collection that no message refers to anymore, and
+// deletes them unless dryRun is set. It returns the keys of the orphaned files.
+func (a *Application) vacuumAttachments(dryRun bool) ([]string, error) {
+	messagesCollection, err := a.PB.FindCollectionByNameOrId("messages")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find messages collection: %w", err)
+	}
+
+	fsys, err := a.PB.NewFilesystem()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create filesystem: %w", err)
+	}
+	defer fsys.Close()
+
+	objects, err := fsys.List(messagesCollection.Id + "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list attachment files: %w", err)
+	}
+
+	// Keys are collectionId/recordId/fileName, or collectionId/recordId/thumbs_fileName/thumbName for thumbnails
+	attachments := make(map[string][]string)
+	var orphans []string
+	for _, object := range objects {
+		segments := strings.Split(object.Key, "/")
+		if len(segments) < 3 {
+			continue
+		}
+		recordID, fileName := segments[1], strings.TrimPrefix(segments[2], "thumbs_")
+
+		recordAttachments, ok := attachments[recordID]
+		if !ok {
+			record, err := a.PB.FindRecordById(messagesCollection, recordID)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return orphans, fmt.Errorf("failed to find message %s: %w", recordID, err)
+			}
+			if record != nil {
+				recordAttachments = record.GetStringSlice("attachments")
+			}
+			attachments[recordID] = recordAttachments
+		}
+		if slices.Contains(recordAttachments, fileName) {
+			continue
+		}
+
+		orphans = append(orphans, object.Key)
+		if !dryRun {
+			if err := fsys.Delete(object.Key); err != nil {
+				return orphans, fmt.Errorf("failed to delete %s: %w", object.Key, err)
+			}
+		}
+	}
+	return orphans, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"time"
+)
+
+type ThreadRole string
+
+const (
+	ThreadRoleOwner       ThreadRole = "owner"
+	ThreadRoleContributor ThreadRole = "contributor"
+	ThreadRoleViewer      ThreadRole = "viewer"
+)
+
+func (r ThreadRole) String() string {
+	return string(r)
+}
+
+// CanWrite reports whether the role allows adding, editing and regenerating messages in the thread.
+func (r ThreadRole) CanWrite() bool {
+	return r == ThreadRoleOwner || r == ThreadRoleContributor
+}
+
+// errThreadAccessDenied is returned when a thread doesn't exist or the user isn't allowed to access it.
+var errThreadAccessDenied = errors.New("thread not found or access denied")
+
+// ThreadAccess is what a user can do in a thread. Messages of a thread are always owned by the thread owner,
+// whoever wrote them, so that the owner keeps control over the data of their threads.
+type ThreadAccess struct {
+	ThreadID    string
+	OwnerUserID string
+	Role        ThreadRole
+	// Shared tells that the user is neither the owner nor a member, and only sees the thread through its public share
+	Shared bool
+}
+
+// findThreadAccess returns the access of the user to the thread: the owner, a member with their role, or a viewer
+// while the thread is publicly shared. Only the owner can access a thread in the trash.
+func findThreadAccess(app core.App, threadID, userID string) (ThreadAccess, error) {
+	threadRecord, err := app.FindRecordById("threads", threadID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ThreadAccess{}, errThreadAccessDenied
+	}
+	if err != nil {
+		return ThreadAccess{}, fmt.Errorf("failed to find thread %s: %w", threadID, err)
+	}
+	access := ThreadAccess{ThreadID: threadID, OwnerUserID: threadRecord.GetString("owner_user_id")}
+	if access.OwnerUserID == userID {
+		access.Role = ThreadRoleOwner
+		return access, nil
+	}
+	if !threadRecord.GetDateTime("deleted_at").IsZero() {
+		return ThreadAccess{}, errThreadAccessDenied
+	}
+
+	memberRecord, err := app.FindFirstRecordByFilter(
+		"thread_members",
+		"thread_id = {:threadID} && user_id = {:userID}",
+		dbx.Params{"threadID": threadID, "userID": userID},
+	)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return ThreadAccess{}, fmt.Errorf("failed to find membership of thread %s: %w", threadID, err)
+	}
+	if memberRecord != nil {
+		access.Role = ThreadRole(memberRecord.GetString("role"))
+		return access, nil
+	}
+
+	shared := threadRecord.GetDateTime("shared")
+	if !shared.IsZero() && shared.Time().Before(time.Now()) {
+		access.Role = ThreadRoleViewer
+		access.Shared = true
+		return access, nil
+	}
+	return ThreadAccess{}, errThreadAccessDenied
+}
+
+// findWritableThreadAccess returns the access of a user who can add messages to the thread. Threads in the trash
+// can't be written to, even by their owner.
+func findWritableThreadAccess(app core.App, threadID, userID string) (ThreadAccess, error) {
+	access, err := findThreadAccess(app, threadID, userID)
+	if err != nil {
+		return ThreadAccess{}, err
+	}
+	if !access.Role.CanWrite() {
+		return ThreadAccess{}, errThreadAccessDenied
+	}
+	threadRecord, err := app.FindRecordById("threads", threadID)
+	if err != nil {
+		return ThreadAccess{}, fmt.Errorf("failed to find thread %s: %w", threadID, err)
+	}
+	if !threadRecord.GetDateTime("deleted_at").IsZero() {
+		return ThreadAccess{}, errThreadAccessDenied
+	}
+	return access, nil
+}
+
+type AddThreadMemberInput struct {
+	Email string     `json:"email" validate:"required,email"`
+	Role  ThreadRole `json:"role" validate:"required,oneof=viewer contributor"`
+}
+
+// ThreadMember is a user with access to a thread, as listed to the members of the thread.
+type ThreadMember struct {
+	UserID string     `json:"userId" db:"user_id"`
+	Name   string     `json:"name" db:"name"`
+	Role   ThreadRole `json:"role" db:"role"`
+}
+
+// addThreadMemberHandler adds a user of the instance to a thread of the owner, or changes their role if they
+// already are a member.
+func (a *Application) addThreadMemberHandler(e *core.RequestEvent) error {
+	threadID := e.Request.PathValue("threadId")
+	if len(threadID) != 26 {
+		a.PB.Logger().Warn("Invalid thread ID length", "threadID", threadID)
+		return e.JSON(400, InvalidInputErrorData)
+	}
+
+	var input AddThreadMemberInput
+	if err := json.NewDecoder(e.Request.Body).Decode(&input); err != nil {
+		a.PB.Logger().Warn("Failed to decode add thread member request", "error", err)
+		return e.JSON(400, InvalidInputErrorData)
+	}
+	if err := validate.Struct(input); err != nil {
+		a.PB.Logger().Warn("Validation failed for add thread member input", "error", err)
+		return e.JSON(400, InvalidInputErrorData)
+	}
+
+	access, err := findWritableThreadAccess(a.PB, threadID, e.Auth.Id)
+	if err != nil || access.Role != ThreadRoleOwner {
+		a.PB.Logger().Warn("Thread not found or user is not the owner", "error", err, "threadID", threadID, "userID", e.Auth.Id)
+		return e.JSON(404, map[string]string{"error": "Thread not found or access denied"})
+	}
+
+	user, err := a.PB.FindAuthRecordByEmail("users", input.Email)
+	if err != nil || user.GetBool("disabled") {
+		a.PB.Logger().Warn("User to add as thread member not found", "error", err, "threadID", threadID)
+		return e.JSON(404, map[string]string{"error": "User not found"})
+	}
+	if user.Id == e.Auth.Id {
+		return e.JSON(400, map[string]string{"error": "The owner of a thread can't be a member of it"})
+	}
+
+	memberRecord, err := a.PB.FindFirstRecordByFilter(
+		"thread_members",
+		"thread_id = {:threadID} && user_id = {:userID}",
+		dbx.Params{"threadID": threadID, "userID": user.Id},
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		membersCollection, err := a.PB.FindCollectionByNameOrId("thread_members")
+		if err != nil {
+			a.PB.Logger().Error("Failed to find thread members collection", "error", err)
+			return e.JSON(500, UnexpectedErrorData)
+		}
+		memberRecord = core.NewRecord(membersCollection)
+		memberRecord.Set("thread_id", threadID)
+		memberRecord.Set("user_id", user.Id)
+	} else if err != nil {
+		a.PB.Logger().Error("Failed to find thread member", "error", err, "threadID", threadID)
+		return e.JSON(500, UnexpectedErrorData)
+	}
+	memberRecord.Set("role", input.Role.String())
+	if err := a.PB.Save(memberRecord); err != nil {
+		a.PB.Logger().Error("Failed to save thread member", "error", err, "threadID", threadID)
+		return e.JSON(500, UnexpectedErrorData)
+	}
+	a.PB.Logger().Info("Saved thread member", "threadID", threadID, "memberUserID", user.Id, "role", input.Role)
+
+	return e.JSON(200, ThreadMember{UserID: user.Id, Name: user.GetString("name"), Role: input.Role})
+}
+
+// listThreadMembersHandler lists the owner and members of a thread, for any user with access to it, so that
+// messages can be attributed to their authors.
+func (a *Application) listThreadMembersHandler(e *core.RequestEvent) error {
+	threadID := e.Request.PathValue("threadId")
+	if len(threadID) != 26 {
+		a.PB.Logger().Warn("Invalid thread ID length", "threadID", threadID)
+		return e.JSON(400, InvalidInputErrorData)
+	}
+
+	access, err := findThreadAccess(a.PB, threadID, e.Auth.Id)
+	if err != nil {
+		a.PB.Logger().Warn("Thread not found or access denied", "error", err, "threadID", threadID, "userID", e.Auth.Id)
+		return e.JSON(404, map[string]string{"error": "Thread not found or access denied"})
+	}
+
+	var members []ThreadMember
+	err = a.PB.DB().NewQuery(`
+SELECT u.id AS user_id, u.name AS name, {:owner} AS role
+FROM users u
+WHERE u.id = {:ownerUserID}
+UNION ALL
+SELECT u.id AS user_id, u.name AS name, tm.role AS role
+FROM thread_members tm
+JOIN users u ON u.id = tm.user_id
+WHERE tm.thread_id = {:threadID};
+`).Bind(dbx.Params{
+		"owner":       ThreadRoleOwner.String(),
+		"ownerUserID": access.OwnerUserID,
+		"threadID":    threadID,
+	}).All(&members)
+	if err != nil {
+		a.PB.Logger().Error("Failed to list thread members", "error", err, "threadID", threadID)
+		return e.JSON(500, UnexpectedErrorData)
+	}
+
+	return e.JSON(200, map[string]any{"members": members})
+}
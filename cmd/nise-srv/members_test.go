@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addThreadMember shares the thread of the owner with the user of the email.
+func (s *testServer) addThreadMember(owner testUser, threadID, email string, role ThreadRole) {
+	s.t.Helper()
+
+	res := s.sendJSON(owner, http.MethodPost, "/api/threads/"+threadID+"/members", map[string]any{"email": email, "role": role})
+	s.decode(res, http.StatusOK, nil)
+}
+
+// accessToken creates a personal access token of the user with the scopes.
+func (s *testServer) accessToken(user testUser, scopes ...AccessTokenScope) testUser {
+	s.t.Helper()
+
+	var token struct {
+		Token string `json:"token"`
+	}
+	res := s.sendJSON(user, http.MethodPost, "/api/tokens", map[string]any{"name": "test", "scopes": scopes})
+	s.decode(res, http.StatusOK, &token)
+	return testUser{ID: user.ID, Token: "Bearer " + token.Token}
+}
+
+func TestContributorAccess(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.createUser("owner@example.com")
+	contributor := s.createUser("contributor@example.com")
+	viewer := s.createUser("viewer@example.com")
+	threadID, responseID := s.createThread(owner, "Tell me about penguins")
+	s.waitMessage(responseID)
+	s.addThreadMember(owner, threadID, "contributor@example.com", ThreadRoleContributor)
+	s.addThreadMember(owner, threadID, "viewer@example.com", ThreadRoleViewer)
+
+	// Shared threads are searched
+	var search struct {
+		Threads []SearchResultThread `json:"threads"`
+	}
+	res := s.do(contributor, http.MethodGet, "/api/threads/search?query="+url.QueryEscape("penguins"), nil, "", nil)
+	s.decode(res, http.StatusOK, &search)
+	if len(search.Threads) != 1 || search.Threads[0].ID != threadID {
+		t.Errorf("Search of the contributor returned %+v, expected thread %s", search.Threads, threadID)
+	}
+
+	// Contributors can continue the thread through chat completions, viewers can't
+	completionBody := func() *strings.Reader {
+		body, _ := json.Marshal(map[string]any{
+			"model":     "test/model",
+			"messages":  []map[string]any{{"role": "user", "content": "And emperor penguins?"}},
+			"thread_id": threadID,
+		})
+		return strings.NewReader(string(body))
+	}
+	var completion ChatCompletionResponse
+	res = s.do(s.accessToken(contributor, AccessTokenScopeChat), http.MethodPost, "/v1/chat/completions", completionBody(), "application/json", nil)
+	s.decode(res, http.StatusOK, &completion)
+	if completion.ThreadID != threadID {
+		t.Errorf("Completion thread is %s, expected %s", completion.ThreadID, threadID)
+	}
+	message, err := s.App.PB.FindRecordById("messages", strings.TrimPrefix(completion.ID, "chatcmpl-"))
+	if err != nil {
+		t.Fatalf("Failed to find the completion message: %v", err)
+	}
+	if message.GetString("author_user_id") != contributor.ID || message.GetString("owner_user_id") != owner.ID {
+		t.Errorf("Completion message is authored by %s and owned by %s", message.GetString("author_user_id"), message.GetString("owner_user_id"))
+	}
+	res = s.do(s.accessToken(viewer, AccessTokenScopeChat), http.MethodPost, "/v1/chat/completions", completionBody(), "application/json", nil)
+	s.decode(res, http.StatusNotFound, nil)
+
+	// Contributors without an API key don't use the one of the owner
+	apiKey, err := s.App.PB.FindFirstRecordByData("api_keys", "owner_user_id", contributor.ID)
+	if err != nil {
+		t.Fatalf("Failed to find the API key of the contributor: %v", err)
+	}
+	if err := s.App.PB.Delete(apiKey); err != nil {
+		t.Fatalf("Failed to delete the API key of the contributor: %v", err)
+	}
+	requests := len(s.Upstream.Requests())
+	var output struct {
+		ResponseMessageID string `json:"responseMessageId"`
+	}
+	res = s.postForm(contributor, "/api/threads/"+threadID+"/messages", map[string]string{
+		"content":         "What about seals?",
+		"parentMessageId": responseID,
+		"responseModel":   testResponseModel,
+	})
+	s.decode(res, http.StatusOK, &output)
+	response := s.waitMessage(output.ResponseMessageID)
+	if parts := messageParts(t, response); parts.ErrorCode != ErrorCodeAuthFailed {
+		t.Errorf("Response of a contributor without an API key has error code %q, expected %q", parts.ErrorCode, ErrorCodeAuthFailed)
+	}
+	if count := len(s.Upstream.Requests()); count != requests {
+		t.Errorf("The upstream received %d requests, expected %d", count, requests)
+	}
+
+	res = s.sendJSON(contributor, http.MethodPost, "/api/threads/"+threadID+"/retitle", map[string]any{})
+	s.decode(res, http.StatusBadRequest, nil)
+}
+
+func TestChatCompletionsThreadNotFound(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("user@example.com")
+	other := s.createUser("other@example.com")
+	token := s.accessToken(user, AccessTokenScopeChat)
+	otherThreadID, otherResponseID := s.createThread(other, "Hello")
+	trashedThreadID, trashedResponseID := s.createThread(user, "Hello")
+	s.waitMessage(otherResponseID)
+	s.waitMessage(trashedResponseID)
+	thread, err := s.App.PB.FindRecordById("threads", trashedThreadID)
+	if err != nil {
+		t.Fatalf("Failed to find thread: %v", err)
+	}
+	thread.Set("deleted_at", types.NowDateTime())
+	if err := s.App.PB.Save(thread); err != nil {
+		t.Fatalf("Failed to move the thread to the trash: %v", err)
+	}
+
+	for name, threadID := range map[string]string{
+		"unknown": strings.Repeat("a", 26),
+		"other":   otherThreadID,
+		"trashed": trashedThreadID,
+	} {
+		t.Run(name, func(t *testing.T) {
+			body, _ := json.Marshal(map[string]any{
+				"model":     "test/model",
+				"messages":  []map[string]any{{"role": "user", "content": "Hello again"}},
+				"thread_id": threadID,
+			})
+			var output struct {
+				Error struct {
+					Type string `json:"type"`
+				} `json:"error"`
+			}
+			res := s.do(token, http.MethodPost, "/v1/chat/completions", strings.NewReader(string(body)), "application/json", nil)
+			s.decode(res, http.StatusNotFound, &output)
+			if output.Error.Type != "invalid_request_error" {
+				t.Errorf("Error type is %q, expected invalid_request_error", output.Error.Type)
+			}
+		})
+	}
+
+	// The parent message must be in the thread
+	threadID, responseID := s.createThread(user, "Hello")
+	s.waitMessage(responseID)
+	body, _ := json.Marshal(map[string]any{
+		"model":             "test/model",
+		"messages":          []map[string]any{{"role": "user", "content": "Hello again"}},
+		"thread_id":         threadID,
+		"parent_message_id": otherResponseID,
+	})
+	res := s.do(token, http.MethodPost, "/v1/chat/completions", strings.NewReader(string(body)), "application/json", nil)
+	s.decode(res, http.StatusNotFound, nil)
+}
+
+func TestContributorForeignParentMessage(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.createUser("owner@example.com")
+	contributor := s.createUser("contributor@example.com")
+	other := s.createUser("other@example.com")
+	threadID, responseID := s.createThread(owner, "Shared question")
+	_, privateResponseID := s.createThread(owner, "Private question")
+	_, otherResponseID := s.createThread(other, "Question of another user")
+	for _, id := range []string{responseID, privateResponseID, otherResponseID} {
+		s.waitMessage(id)
+	}
+	s.addThreadMember(owner, threadID, "contributor@example.com", ThreadRoleContributor)
+
+	// Replying to a message of another thread would put its branch in the transcript
+	requests := len(s.Upstream.Requests())
+	for name, parentID := range map[string]string{"thread of the owner": privateResponseID, "thread of another user": otherResponseID} {
+		t.Run(name, func(t *testing.T) {
+			res := s.postForm(contributor, "/api/threads/"+threadID+"/messages", map[string]string{
+				"content":         "What did I ask before?",
+				"parentMessageId": parentID,
+				"responseModel":   testResponseModel,
+			})
+			s.decode(res, http.StatusNotFound, nil)
+		})
+	}
+	if count := len(s.Upstream.Requests()); count != requests {
+		t.Errorf("The upstream received %d requests, expected %d", count, requests)
+	}
+}
+
+func TestSharedViewerPresence(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.createUser("owner@example.com")
+	member := s.createUser("member@example.com")
+	stranger := s.createUser("stranger@example.com")
+	threadID, responseID := s.createThread(owner, "Hello")
+	s.waitMessage(responseID)
+	s.addThreadMember(owner, threadID, "member@example.com", ThreadRoleViewer)
+	thread, err := s.App.PB.FindRecordById("threads", threadID)
+	if err != nil {
+		t.Fatalf("Failed to find thread: %v", err)
+	}
+	thread.Set("shared", types.NowDateTime().Add(-time.Minute))
+	if err := s.App.PB.Save(thread); err != nil {
+		t.Fatalf("Failed to share thread: %v", err)
+	}
+
+	subscribe := func(user testUser) *ThreadSubscription {
+		access, err := findThreadAccess(s.App.PB, threadID, user.ID)
+		if err != nil {
+			t.Fatalf("User %s has no access to the thread: %v", user.ID, err)
+		}
+		sub := s.App.ThreadEvents.Subscribe(threadID, user.ID, access.Shared)
+		t.Cleanup(func() { s.App.ThreadEvents.Unsubscribe(sub) })
+		return sub
+	}
+	ownerSub := subscribe(owner)
+	subscribe(member)
+	strangerSub := subscribe(stranger)
+
+	// Viewers of the public share aren't listed, and don't learn who else is there
+	var presence ThreadEvent
+	for len(ownerSub.Events) > 0 {
+		presence = <-ownerSub.Events
+	}
+	expected := []string{owner.ID, member.ID}
+	slices.Sort(expected)
+	if !slices.Equal(presence.Viewers, expected) {
+		t.Errorf("Viewers are %v, expected the owner and member %v", presence.Viewers, expected)
+	}
+	if count := len(strangerSub.Events); count != 0 {
+		t.Errorf("Viewer of the public share received %d presence events", count)
+	}
+}
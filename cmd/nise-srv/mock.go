@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MockModelPrefix selects the mock provider for model IDs like mock/echo, when it's enabled. A duration suffix like
+// mock/echo:50ms is waited before every chunk.
+const MockModelPrefix = "mock/"
+
+// isMockModel reports whether a model ID is served by the mock provider.
+func isMockModel(modelID string) bool {
+	return strings.HasPrefix(modelID, MockModelPrefix)
+}
+
+type MockToolCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// MockScript is what the mock provider streams for a response, in order: reasoning, content, tool calls and refusal,
+// each entry being a chunk.
+type MockScript struct {
+	Reasoning []string       `json:"reasoning,omitempty"`
+	Content   []string       `json:"content,omitempty"`
+	ToolCalls []MockToolCall `json:"toolCalls,omitempty"`
+	Refusal   []string       `json:"refusal,omitempty"`
+	// FinishReason is stop by default, or tool_calls when there are tool calls
+	FinishReason string `json:"finishReason,omitempty"`
+	// StatusCode fails the request with this status and Error, before any chunk
+	StatusCode int `json:"statusCode,omitempty"`
+	// RetryAfter is sent as the Retry-After header of a failed request, in seconds
+	RetryAfter int `json:"retryAfter,omitempty"`
+	// Error without a StatusCode fails the stream after ErrorAfter chunks
+	Error      string `json:"error,omitempty"`
+	ErrorAfter int    `json:"errorAfter,omitempty"`
+	// DelayMs is waited before every chunk
+	DelayMs int `json:"delayMs,omitempty"`
+}
+
+// mockScenarios are the scripts of the mock models, mock/echo and mock/script are built from the request instead.
+var mockScenarios = map[string]MockScript{
+	"reasoning": {
+		Reasoning: []string{"The user ", "wants an answer, ", "let me think."},
+		Content:   []string{"Here is ", "the answer."},
+	},
+	"tools": {
+		Content:   []string{"Let me check the weather."},
+		ToolCalls: []MockToolCall{{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+	},
+	"refusal": {
+		Refusal: []string{"I can't ", "help with that."},
+	},
+	"content-filter": {
+		Content:      []string{"This response was "},
+		FinishReason: FinishReasonContentFilter.String(),
+	},
+	"midstream-error": {
+		Content:    []string{"This response ", "stops "},
+		Error:      "The provider disconnected",
+		ErrorAfter: 2,
+	},
+	"no-credits": {
+		StatusCode: http.StatusPaymentRequired,
+		Error:      "Insufficient credits",
+	},
+	"rate-limited": {
+		StatusCode: http.StatusTooManyRequests,
+		RetryAfter: 1,
+		Error:      "Rate limit exceeded",
+	},
+	"unavailable": {
+		StatusCode: http.StatusServiceUnavailable,
+		Error:      "No endpoints available",
+	},
+}
+
+type mockRequest struct {
+	Model    string `json:"model"`
+	Messages []struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	} `json:"messages"`
+}
+
+// text returns the text of a message content, given either as a string or as a list of parts.
+func (r mockRequest) text(content json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		return text
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	_ = json.Unmarshal(content, &parts)
+	texts := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// lastUserText returns the text of the last user message of the request.
+func (r mockRequest) lastUserText() string {
+	for i := len(r.Messages) - 1; i >= 0; i-- {
+		if r.Messages[i].Role == MessageRoleUser.String() {
+			return r.text(r.Messages[i].Content)
+		}
+	}
+	return ""
+}
+
+// promptTokens counts the words of the request as its tokens, so that usage is deterministic.
+func (r mockRequest) promptTokens() int {
+	tokens := 0
+	for _, message := range r.Messages {
+		tokens += len(strings.Fields(r.text(message.Content)))
+	}
+	return tokens
+}
+
+// mockScript returns the script of a mock model: mock/echo repeats the last user message, mock/script reads the
+// script from it as JSON, and the other models are scenarios.
+func mockScript(request mockRequest) (MockScript, error) {
+	name, delay, _ := strings.Cut(strings.TrimPrefix(request.Model, MockModelPrefix), ":")
+
+	var script MockScript
+	switch name {
+	case "echo":
+		words := strings.SplitAfter("You said: "+request.lastUserText(), " ")
+		script.Content = words
+	case "script":
+		if err := json.Unmarshal([]byte(request.lastUserText()), &script); err != nil {
+			return script, fmt.Errorf("the last user message is not a mock script: %w", err)
+		}
+	default:
+		scenario, ok := mockScenarios[name]
+		if !ok {
+			return script, fmt.Errorf("unknown mock model %q", request.Model)
+		}
+		script = scenario
+	}
+
+	if delay != "" {
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			return script, fmt.Errorf("invalid delay of mock model %q: %w", request.Model, err)
+		}
+		script.DelayMs = int(d.Milliseconds())
+	}
+	return script, nil
+}
+
+// MockProvider is an OpenAI compatible provider running in process, streaming scripted responses for the mock
+// models so that streams can be exercised without network access. It is used as the transport of the AI client.
+type MockProvider struct{}
+
+func (p MockProvider) RoundTrip(req *http.Request) (*http.Response, error) {
+	var request mockRequest
+	if req.Body != nil {
+		defer req.Body.Close()
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			return mockErrorResponse(req, http.StatusBadRequest, "Invalid request body: "+err.Error(), 0), nil
+		}
+	}
+
+	script, err := mockScript(request)
+	if err != nil {
+		return mockErrorResponse(req, http.StatusNotFound, err.Error(), 0), nil
+	}
+	if script.StatusCode != 0 {
+		return mockErrorResponse(req, script.StatusCode, script.Error, script.RetryAfter), nil
+	}
+
+	body, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(p.stream(req.Context(), writer, request, script))
+	}()
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       body,
+		Request:    req,
+	}, nil
+}
+
+// stream writes the chunks of a script as server-sent events, waiting the delay of the script before each one.
+func (p MockProvider) stream(ctx context.Context, w io.Writer, request mockRequest, script MockScript) error {
+	// Every chunk of a completion has the same ID, the accumulator of the client ignores the others
+	id := "mock-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	created := time.Now().Unix()
+	completionTokens := 0
+	write := func(data any) error {
+		if script.DelayMs > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(script.DelayMs) * time.Millisecond):
+			}
+		}
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "data: %s\n\n", encoded)
+		return err
+	}
+	chunk := func(delta map[string]any, finishReason any) map[string]any {
+		return map[string]any{
+			"id":      id,
+			"object":  "chat.completion.chunk",
+			"created": created,
+			"model":   request.Model,
+			"choices": []map[string]any{{"index": 0, "delta": delta, "finish_reason": finishReason}},
+		}
+	}
+
+	var deltas []map[string]any
+	for _, reasoning := range script.Reasoning {
+		deltas = append(deltas, map[string]any{"role": "assistant", "reasoning": reasoning})
+	}
+	for _, content := range script.Content {
+		deltas = append(deltas, map[string]any{"role": "assistant", "content": content})
+	}
+	for i, toolCall := range script.ToolCalls {
+		deltas = append(deltas, map[string]any{"role": "assistant", "tool_calls": []map[string]any{{
+			"index":    i,
+			"id":       fmt.Sprintf("call_mock_%d", i),
+			"type":     "function",
+			"function": map[string]any{"name": toolCall.Name, "arguments": toolCall.Arguments},
+		}}})
+	}
+	for _, refusal := range script.Refusal {
+		deltas = append(deltas, map[string]any{"role": "assistant", "refusal": refusal})
+	}
+
+	for i, delta := range deltas {
+		if script.Error != "" && i == script.ErrorAfter {
+			break
+		}
+		if err := write(chunk(delta, nil)); err != nil {
+			return err
+		}
+		completionTokens++
+	}
+	if script.Error != "" {
+		return write(map[string]any{"error": map[string]any{"code": http.StatusBadGateway, "message": script.Error}})
+	}
+
+	finishReason := script.FinishReason
+	if finishReason == "" {
+		finishReason = FinishReasonStop.String()
+		if len(script.ToolCalls) > 0 {
+			finishReason = "tool_calls"
+		}
+	}
+	final := chunk(map[string]any{}, finishReason)
+	promptTokens := request.promptTokens()
+	final["usage"] = map[string]any{
+		"prompt_tokens":     promptTokens,
+		"completion_tokens": completionTokens,
+		"total_tokens":      promptTokens + completionTokens,
+	}
+	if err := write(final); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "data: [DONE]\n\n")
+	return err
+}
+
+func mockErrorResponse(req *http.Request, statusCode int, message string, retryAfter int) *http.Response {
+	body, _ := json.Marshal(map[string]any{"error": map[string]any{"code": statusCode, "message": message}})
+	header := http.Header{"Content-Type": []string{"application/json"}}
+	if retryAfter > 0 {
+		header.Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+	return &http.Response{
+		StatusCode:    statusCode,
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/openai/openai-go/option"
+	"regexp"
+)
+
+type ResponseFormatType string
+
+const (
+	ResponseFormatTypeText       ResponseFormatType = "text"
+	ResponseFormatTypeJSONObject ResponseFormatType = "json_object"
+	ResponseFormatTypeJSONSchema ResponseFormatType = "json_schema"
+)
+
+func (t ResponseFormatType) String() string {
+	return string(t)
+}
+
+// ResponseFormat asks the model for JSON, any JSON object in JSON mode or one matching the schema otherwise.
+type ResponseFormat struct {
+	Type ResponseFormatType `json:"type" validate:"required,oneof=text json_object json_schema"`
+	// JSONSchema is required with the json_schema type, and only allowed with it
+	JSONSchema *ResponseFormatJSONSchema `json:"jsonSchema,omitempty,omitzero" validate:"required_if=Type json_schema"`
+}
+
+type ResponseFormatJSONSchema struct {
+	Name        string          `json:"name" validate:"required,max=64"`
+	Description string          `json:"description,omitempty,omitzero" validate:"max=1000"`
+	Schema      json.RawMessage `json:"schema" validate:"required,max=100000"`
+	Strict      *bool           `json:"strict,omitempty,omitzero"`
+}
+
+// ProviderPreferences are the OpenRouter provider routing preferences of a request,
+// see https://openrouter.ai/docs/features/provider-routing
+type ProviderPreferences struct {
+	Order          []string `json:"order,omitempty,omitzero" validate:"omitempty,max=20,dive,min=1,max=100"`
+	AllowFallbacks *bool    `json:"allowFallbacks,omitempty,omitzero"`
+	// RequireParameters only routes to the providers supporting all the parameters of the request
+	RequireParameters bool     `json:"requireParameters,omitempty,omitzero"`
+	DataCollection    string   `json:"dataCollection,omitempty,omitzero" validate:"omitempty,oneof=allow deny"`
+	Only              []string `json:"only,omitempty,omitzero" validate:"omitempty,max=20,dive,min=1,max=100"`
+	Ignore            []string `json:"ignore,omitempty,omitzero" validate:"omitempty,max=20,dive,min=1,max=100"`
+	Quantizations     []string `json:"quantizations,omitempty,omitzero" validate:"omitempty,dive,oneof=int4 int8 fp4 fp6 fp8 fp16 bf16 fp32 unknown"`
+	Sort              string   `json:"sort,omitempty,omitzero" validate:"omitempty,oneof=price throughput latency"`
+}
+
+// openRouterParams returns the preferences in the format of the provider field of OpenRouter requests.
+func (p *ProviderPreferences) openRouterParams() map[string]any {
+	params := map[string]any{}
+	if len(p.Order) > 0 {
+		params["order"] = p.Order
+	}
+	if p.AllowFallbacks != nil {
+		params["allow_fallbacks"] = *p.AllowFallbacks
+	}
+	if p.RequireParameters {
+		params["require_parameters"] = true
+	}
+	if p.DataCollection != "" {
+		params["data_collection"] = p.DataCollection
+	}
+	if len(p.Only) > 0 {
+		params["only"] = p.Only
+	}
+	if len(p.Ignore) > 0 {
+		params["ignore"] = p.Ignore
+	}
+	if len(p.Quantizations) > 0 {
+		params["quantizations"] = p.Quantizations
+	}
+	if p.Sort != "" {
+		params["sort"] = p.Sort
+	}
+	return params
+}
+
+// errInvalidModelOptions is the error of model options that are invalid beyond their struct tags, or not supported
+// by the model.
+var errInvalidModelOptions = errors.New("invalid model options")
+
+var jsonSchemaNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// checkResponseFormat checks what the struct tags of a response format can't: that the schema is a JSON object with
+// a name OpenAI compatible providers accept, and only given with the json_schema type.
+func checkResponseFormat(format *ResponseFormat) error {
+	if format == nil {
+		return nil
+	}
+	if format.Type != ResponseFormatTypeJSONSchema {
+		if format.JSONSchema != nil {
+			return fmt.Errorf("%w: a JSON schema is only allowed with the %s response format", errInvalidModelOptions, ResponseFormatTypeJSONSchema)
+		}
+		return nil
+	}
+	if !jsonSchemaNamePattern.MatchString(format.JSONSchema.Name) {
+		return fmt.Errorf("%w: the name of the JSON schema can only contain letters, digits, underscores and dashes", errInvalidModelOptions)
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(format.JSONSchema.Schema, &schema); err != nil || schema == nil {
+		return fmt.Errorf("%w: the JSON schema must be a JSON object", errInvalidModelOptions)
+	}
+	return nil
+}
+
+// requestedParameters returns the names of the generation parameters set in the options, as listed in the supported
+// parameters of the models in the catalog.
+func (o *ResponseModelOptions) requestedParameters() []string {
+	var parameters []string
+	if o.Temperature != nil {
+		parameters = append(parameters, "temperature")
+	}
+	if o.TopP != nil {
+		parameters = append(parameters, "top_p")
+	}
+	if o.MaxTokens != nil {
+		parameters = append(parameters, "max_tokens")
+	}
+	if len(o.Stop) > 0 {
+		parameters = append(parameters, "stop")
+	}
+	if o.Seed != nil {
+		parameters = append(parameters, "seed")
+	}
+	if o.PresencePenalty != nil {
+		parameters = append(parameters, "presence_penalty")
+	}
+	if o.FrequencyPenalty != nil {
+		parameters = append(parameters, "frequency_penalty")
+	}
+	if o.ResponseFormat != nil {
+		switch o.ResponseFormat.Type {
+		case ResponseFormatTypeJSONObject:
+			parameters = append(parameters, "response_format")
+		case ResponseFormatTypeJSONSchema:
+			parameters = append(parameters, "structured_outputs")
+		}
+	}
+	return parameters
+}
+
+// generationRequestOptions returns the request options setting the generation parameters and provider preferences
+// of the options on the request body.
+func (o *ResponseModelOptions) generationRequestOptions() []option.RequestOption {
+	var options []option.RequestOption
+	if o.Temperature != nil {
+		options = append(options, option.WithJSONSet("temperature", *o.Temperature))
+	}
+	if o.TopP != nil {
+		options = append(options, option.WithJSONSet("top_p", *o.TopP))
+	}
+	if o.MaxTokens != nil {
+		options = append(options, option.WithJSONSet("max_tokens", *o.MaxTokens))
+	}
+	if len(o.Stop) > 0 {
+		options = append(options, option.WithJSONSet("stop", o.Stop))
+	}
+	if o.Seed != nil {
+		options = append(options, option.WithJSONSet("seed", *o.Seed))
+	}
+	if o.PresencePenalty != nil {
+		options = append(options, option.WithJSONSet("presence_penalty", *o.PresencePenalty))
+	}
+	if o.FrequencyPenalty != nil {
+		options = append(options, option.WithJSONSet("frequency_penalty", *o.FrequencyPenalty))
+	}
+	if o.ResponseFormat != nil && o.ResponseFormat.Type != ResponseFormatTypeText {
+		responseFormat := map[string]any{"type": o.ResponseFormat.Type}
+		if schema := o.ResponseFormat.JSONSchema; schema != nil {
+			jsonSchema := map[string]any{
+				"name":   schema.Name,
+				"schema": json.RawMessage(bytes.TrimSpace(schema.Schema)),
+			}
+			if schema.Description != "" {
+				jsonSchema["description"] = schema.Description
+			}
+			if schema.Strict != nil {
+				jsonSchema["strict"] = *schema.Strict
+			}
+			responseFormat["json_schema"] = jsonSchema
+		}
+		options = append(options, option.WithJSONSet("response_format", responseFormat))
+	}
+	if o.Provider != nil {
+		if params := o.Provider.openRouterParams(); len(params) > 0 {
+			options = append(options, option.WithJSONSet("provider", params))
+		}
+	}
+	return options
+}
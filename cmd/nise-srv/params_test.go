@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGenerationParameters(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("user@example.com")
+
+	temperature, topP, penalty := 0.0, 0.9, 0.5
+	maxTokens, seed := int64(100), int64(42)
+	allowFallbacks := false
+	options := &ResponseModelOptions{
+		Temperature:      &temperature,
+		TopP:             &topP,
+		MaxTokens:        &maxTokens,
+		Stop:             []string{"END"},
+		Seed:             &seed,
+		PresencePenalty:  &penalty,
+		FrequencyPenalty: &penalty,
+		ResponseFormat:   &ResponseFormat{Type: ResponseFormatTypeJSONObject},
+		Provider: &ProviderPreferences{
+			Order:          []string{"groq"},
+			AllowFallbacks: &allowFallbacks,
+			Sort:           "price",
+		},
+	}
+	threadID, responseID := s.createThreadWithModel(user, "Hello there", ResponseModel{ProviderID: "test/model", Options: options})
+	response := s.waitMessage(responseID)
+
+	expected := map[string]string{
+		"temperature":       `0`,
+		"top_p":             `0.9`,
+		"max_tokens":        `100`,
+		"stop":              `["END"]`,
+		"seed":              `42`,
+		"presence_penalty":  `0.5`,
+		"frequency_penalty": `0.5`,
+		"response_format":   `{"type":"json_object"}`,
+		"provider":          `{"allow_fallbacks":false,"order":["groq"],"sort":"price"}`,
+	}
+	checkParams := func(request upstreamRequest) {
+		t.Helper()
+		for name, value := range expected {
+			if got := string(request.Params[name]); got != value {
+				t.Errorf("Upstream %s is %s, expected %s", name, got, value)
+			}
+		}
+	}
+	checkParams(s.Upstream.lastRequest(t))
+
+	var meta MessageMeta
+	if err := response.UnmarshalJSONField("meta", &meta); err != nil {
+		t.Fatalf("Failed to unmarshal the meta of the response: %v", err)
+	}
+	if !reflect.DeepEqual(meta.ModelOptions, options) {
+		t.Errorf("Stored model options are %+v, expected %+v", meta.ModelOptions, options)
+	}
+
+	// Regenerating without options uses the stored ones
+	var output struct {
+		MessageID string `json:"messageId"`
+	}
+	res := s.sendJSON(user, http.MethodPost, "/api/threads/"+threadID+"/messages/"+responseID+"/regenerate", map[string]any{
+		"responseModel": map[string]any{},
+	})
+	s.decode(res, http.StatusOK, &output)
+	regenerated := s.waitMessage(output.MessageID)
+	if model := regenerated.GetString("model"); model != "test/model" {
+		t.Errorf("Regenerated message model is %q, expected the one of the original", model)
+	}
+	checkParams(s.Upstream.lastRequest(t))
+
+	// A new model doesn't get the options of the original
+	res = s.sendJSON(user, http.MethodPost, "/api/threads/"+threadID+"/messages/"+responseID+"/regenerate", map[string]any{
+		"responseModel": map[string]any{"providerId": "test/other"},
+	})
+	s.decode(res, http.StatusOK, &output)
+	s.waitMessage(output.MessageID)
+	for name := range expected {
+		if value, ok := s.Upstream.lastRequest(t).Params[name]; ok {
+			t.Errorf("Upstream %s is %s for a new model without options", name, value)
+		}
+	}
+
+	// Options given without a model are checked against the model of the original
+	basicThreadID, basicResponseID := s.createThreadWithModel(user, "Hello there", ResponseModel{ProviderID: "test/basic"})
+	s.waitMessage(basicResponseID)
+	var errorOutput struct {
+		Error string `json:"error"`
+	}
+	res = s.sendJSON(user, http.MethodPost, "/api/threads/"+basicThreadID+"/messages/"+basicResponseID+"/regenerate", map[string]any{
+		"responseModel": map[string]any{"options": map[string]any{"temperature": 1}},
+	})
+	s.decode(res, http.StatusBadRequest, &errorOutput)
+	if !strings.Contains(errorOutput.Error, "temperature") {
+		t.Errorf("Error is %q, expected the unsupported temperature", errorOutput.Error)
+	}
+}
+
+func TestGenerationParametersValidation(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("user@example.com")
+
+	tests := []struct {
+		name    string
+		model   string
+		options string
+		status  int
+		error   string
+	}{
+		{name: "temperature out of range", model: "test/model", options: `{"temperature":3}`, status: http.StatusBadRequest},
+		{name: "too many stop sequences", model: "test/model", options: `{"stop":["a","b","c","d","e"]}`, status: http.StatusBadRequest},
+		{name: "unknown provider sort", model: "test/model", options: `{"provider":{"sort":"vibes"}}`, status: http.StatusBadRequest},
+		{name: "json schema without schema", model: "test/model", options: `{"responseFormat":{"type":"json_schema"}}`, status: http.StatusBadRequest},
+		{
+			name:    "schema that isn't an object",
+			model:   "test/model",
+			options: `{"responseFormat":{"type":"json_schema","jsonSchema":{"name":"answer","schema":[1]}}}`,
+			status:  http.StatusBadRequest,
+			error:   "JSON object",
+		},
+		{
+			name:    "schema with another type",
+			model:   "test/model",
+			options: `{"responseFormat":{"type":"json_object","jsonSchema":{"name":"answer","schema":{}}}}`,
+			status:  http.StatusBadRequest,
+			error:   "only allowed",
+		},
+		{name: "unsupported by the model", model: "test/basic", options: `{"temperature":1,"seed":1}`, status: http.StatusBadRequest, error: "temperature, seed"},
+		{name: "supported by the model", model: "test/basic", options: `{"maxTokens":10}`, status: http.StatusOK},
+		{name: "model not in the catalog", model: "test/unknown", options: `{"temperature":1}`, status: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := s.postForm(user, "/api/threads", map[string]string{
+				"content":       "Hello there",
+				"responseModel": `{"providerId":"` + test.model + `","options":` + test.options + `}`,
+			})
+			var output struct {
+				Error string `json:"error"`
+				Data  struct {
+					Thread          NewThreadOutputThread         `json:"thread"`
+					ResponseMessage *NewThreadOutputThreadMessage `json:"responseMessage"`
+				} `json:"data"`
+			}
+			s.decode(res, test.status, &output)
+			if !strings.Contains(output.Error, test.error) {
+				t.Errorf("Error is %q, expected it to contain %q", output.Error, test.error)
+			}
+			if output.Data.ResponseMessage != nil {
+				s.waitMessage(output.Data.ResponseMessage.ID)
+				s.waitTitle(output.Data.Thread.ID)
+			}
+		})
+	}
+}
+
+func TestChatCompletionsGenerationParameters(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("user@example.com")
+
+	var token struct {
+		Token string `json:"token"`
+	}
+	res := s.sendJSON(user, http.MethodPost, "/api/tokens", map[string]any{"name": "test", "scopes": []string{"chat"}})
+	s.decode(res, http.StatusOK, &token)
+
+	s.Upstream.Script = func(request mockRequest) MockScript {
+		return MockScript{Content: []string{`{"answer":"yes"}`}}
+	}
+	body, _ := json.Marshal(map[string]any{
+		"model":                 "test/model",
+		"messages":              []map[string]any{{"role": "user", "content": "Hello there"}},
+		"temperature":           0.2,
+		"max_completion_tokens": 50,
+		"stop":                  "END",
+		"response_format": map[string]any{
+			"type":        "json_schema",
+			"json_schema": map[string]any{"name": "answer", "schema": map[string]any{"type": "object"}},
+		},
+	})
+	var completion ChatCompletionResponse
+	res = s.do(testUser{Token: "Bearer " + token.Token}, http.MethodPost, "/v1/chat/completions", strings.NewReader(string(body)), "application/json", nil)
+	s.decode(res, http.StatusOK, &completion)
+	s.waitTitle(completion.ThreadID)
+
+	request := s.Upstream.lastRequest(t)
+	expected := map[string]string{
+		"temperature":     `0.2`,
+		"max_tokens":      `50`,
+		"stop":            `["END"]`,
+		"response_format": `{"json_schema":{"name":"answer","schema":{"type":"object"}},"type":"json_schema"}`,
+	}
+	for name, value := range expected {
+		if got := string(request.Params[name]); got != value {
+			t.Errorf("Upstream %s is %s, expected %s", name, got, value)
+		}
+	}
+}
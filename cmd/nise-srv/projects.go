@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/openai/openai-go"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+)
+
+type MoveThreadInput struct {
+	// ProjectID is the project to move the thread to, or empty to take it out of its project
+	ProjectID string `json:"projectId" validate:"omitempty,max=15,min=15"`
+}
+
+// findThreadProject returns the project of a thread of the user, or nil when the thread isn't in a project.
+func findThreadProject(PB *pocketbase.PocketBase, userID, threadID string) (*core.Record, error) {
+	threadRecord, err := PB.FindRecordById("threads", threadID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find thread %s: %w", threadID, err)
+	}
+	projectID := threadRecord.GetString("project_id")
+	if projectID == "" {
+		return nil, nil
+	}
+
+	projectRecord, err := PB.FindRecordById("projects", projectID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find project %s: %w", projectID, err)
+	}
+	if projectRecord.GetString("owner_user_id") != userID {
+		return nil, nil
+	}
+	return projectRecord, nil
+}
+
+// getProjectTranscriptContext returns the messages every transcript of a thread in a project starts with: the
+// system prompt of the project, then its reference documents. It's empty for threads outside of a project.
+func getProjectTranscriptContext(PB *pocketbase.PocketBase, fsys *filesystem.System, userID, threadID string) ([]openai.ChatCompletionMessageParamUnion, error) {
+	projectRecord, err := findThreadProject(PB, userID, threadID)
+	if err != nil || projectRecord == nil {
+		return nil, err
+	}
+
+	var projectContext []openai.ChatCompletionMessageParamUnion
+	if systemPrompt := projectRecord.GetString("system_prompt"); systemPrompt != "" {
+		projectContext = append(projectContext, openai.SystemMessage(systemPrompt))
+	}
+
+	documents := projectRecord.GetStringSlice("documents")
+	if len(documents) > 0 {
+		documentsContent := []openai.ChatCompletionContentPartUnionParam{
+			{
+				OfText: &openai.ChatCompletionContentPartTextParam{
+					Text: fmt.Sprintf("Reference documents of the project %q:", projectRecord.GetString("name")),
+					Type: "text",
+				},
+			},
+		}
+		for _, document := range documents {
+			part, err := attachmentContentPart(fsys, projectRecord.BaseFilesPath()+"/"+document, document)
+			if err != nil {
+				return nil, err
+			}
+			documentsContent = append(documentsContent, part)
+		}
+		projectContext = append(projectContext, openai.UserMessage(documentsContent))
+	}
+
+	return projectContext, nil
+}
+
+// moveThreadHandler moves a thread of the user into one of their projects, or out of its project.
+func (a *Application) moveThreadHandler(e *core.RequestEvent) error {
+	threadID := e.Request.PathValue("threadId")
+	if len(threadID) != 26 {
+		a.PB.Logger().Warn("Invalid thread ID length", "threadID", threadID)
+		return e.JSON(400, InvalidInputErrorData)
+	}
+
+	var input MoveThreadInput
+	if err := json.NewDecoder(e.Request.Body).Decode(&input); err != nil {
+		a.PB.Logger().Warn("Failed to decode move thread request", "error", err)
+		return e.JSON(400, InvalidInputErrorData)
+	}
+	if err := validate.Struct(input); err != nil {
+		a.PB.Logger().Warn("Validation failed for move thread input", "error", err)
+		return e.JSON(400, InvalidInputErrorData)
+	}
+
+	threadRecord, err := a.PB.FindRecordById("threads", threadID)
+	if err != nil || threadRecord.GetString("owner_user_id") != e.Auth.Id || !threadRecord.GetDateTime("deleted_at").IsZero() {
+		a.PB.Logger().Warn("Thread not found or user is not the owner", "error", err, "threadID", threadID, "userID", e.Auth.Id)
+		return e.JSON(404, map[string]string{"error": "Thread not found or access denied"})
+	}
+
+	if input.ProjectID != "" {
+		projectRecord, err := a.PB.FindRecordById("projects", input.ProjectID)
+		if err != nil || projectRecord.GetString("owner_user_id") != e.Auth.Id {
+			a.PB.Logger().Warn("Project not found or user is not the owner", "error", err, "projectID", input.ProjectID, "userID", e.Auth.Id)
+			return e.JSON(404, map[string]string{"error": "Project not found or access denied"})
+		}
+	}
+
+	threadRecord.Set("project_id", input.ProjectID)
+	if err := a.PB.Save(threadRecord); err != nil {
+		a.PB.Logger().Error("Failed to move thread", "error", err, "threadID", threadID, "projectID", input.ProjectID)
+		return e.JSON(500, UnexpectedErrorData)
+	}
+	a.PB.Logger().Info("Moved thread", "threadID", threadID, "projectID", input.ProjectID, "userID", e.Auth.Id)
+
+	return e.NoContent(204)
+}
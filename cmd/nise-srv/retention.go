@@ -0,0 +1,315 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"slices"
+	"time"
+)
+
+// RetentionCronID identifies the retention job in the PocketBase cron scheduler.
+const RetentionCronID = "niseRetention"
+
+// RetentionCronSchedule runs the retention job every night.
+const RetentionCronSchedule = "30 3 * * *"
+
+type RetentionAuditKind string
+
+const (
+	RetentionAuditKindThreads     RetentionAuditKind = "threads"
+	RetentionAuditKindAttachments RetentionAuditKind = "attachments"
+)
+
+func (k RetentionAuditKind) String() string {
+	return string(k)
+}
+
+// RetentionPolicy is how long threads and attachments are kept, zero keeps them forever. The instance-wide
+// policy is the retention_policies record without an owner.
+type RetentionPolicy struct {
+	ThreadMaxAgeDays     int `json:"threadMaxAgeDays"`
+	AttachmentMaxAgeDays int `json:"attachmentMaxAgeDays"`
+}
+
+// shortestRetention returns the shortest of two retention ages, ignoring ages of zero which keep forever.
+func shortestRetention(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// Merge returns the policy keeping data for the shortest time of both, so users can only shorten the instance-wide
+// retention.
+func (p RetentionPolicy) Merge(other RetentionPolicy) RetentionPolicy {
+	return RetentionPolicy{
+		ThreadMaxAgeDays:     shortestRetention(p.ThreadMaxAgeDays, other.ThreadMaxAgeDays),
+		AttachmentMaxAgeDays: shortestRetention(p.AttachmentMaxAgeDays, other.AttachmentMaxAgeDays),
+	}
+}
+
+// RetentionAuditThread is a thread deleted by the retention job.
+type RetentionAuditThread struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Messages int    `json:"messages"`
+	Files    int    `json:"files"`
+}
+
+// RetentionAuditAttachments are the attachments removed from a message by the retention job.
+type RetentionAuditAttachments struct {
+	ThreadID  string   `json:"threadId"`
+	MessageID string   `json:"messageId"`
+	Files     []string `json:"files"`
+}
+
+// RetentionResult is what the retention job purged for a user, saved as retention_audits records.
+type RetentionResult struct {
+	UserID      string
+	Policy      RetentionPolicy
+	Threads     []RetentionAuditThread
+	Attachments []RetentionAuditAttachments
+}
+
+// findRetentionPolicy returns the retention policy of the user, or the instance-wide one for an empty userID.
+func (a *Application) findRetentionPolicy(userID string) (RetentionPolicy, error) {
+	record, err := a.PB.FindFirstRecordByData("retention_policies", "owner_user_id", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RetentionPolicy{}, nil
+	}
+	if err != nil {
+		return RetentionPolicy{}, fmt.Errorf("failed to find retention policy: %w", err)
+	}
+	return RetentionPolicy{
+		ThreadMaxAgeDays:     record.GetInt("thread_max_age_days"),
+		AttachmentMaxAgeDays: record.GetInt("attachment_max_age_days"),
+	}, nil
+}
+
+// retentionCutoff returns the date before which data older than maxAgeDays is purged.
+func retentionCutoff(maxAgeDays int) types.DateTime {
+	cutoff, _ := types.ParseDateTime(time.Now().AddDate(0, 0, -maxAgeDays))
+	return cutoff
+}
+
+// enforceRetention applies the retention policies of every user, writing an audit record for everything purged.
+// With dryRun set nothing is deleted or recorded, and the results tell what would be purged.
+func (a *Application) enforceRetention(dryRun bool) ([]RetentionResult, error) {
+	instancePolicy, err := a.findRetentionPolicy("")
+	if err != nil {
+		return nil, err
+	}
+	users, err := a.PB.FindAllRecords("users")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find users: %w", err)
+	}
+
+	var results []RetentionResult
+	for _, user := range users {
+		userPolicy, err := a.findRetentionPolicy(user.Id)
+		if err != nil {
+			return results, err
+		}
+		result := RetentionResult{UserID: user.Id, Policy: instancePolicy.Merge(userPolicy)}
+
+		if result.Policy.ThreadMaxAgeDays > 0 {
+			result.Threads, err = a.purgeExpiredThreads(user.Id, retentionCutoff(result.Policy.ThreadMaxAgeDays), dryRun)
+			if err != nil {
+				return results, fmt.Errorf("failed to purge threads of user %s: %w", user.Id, err)
+			}
+		}
+		if result.Policy.AttachmentMaxAgeDays > 0 {
+			result.Attachments, err = a.stripExpiredAttachments(user.Id, retentionCutoff(result.Policy.AttachmentMaxAgeDays), dryRun)
+			if err != nil {
+				return results, fmt.Errorf("failed to strip attachments of user %s: %w", user.Id, err)
+			}
+			// In a dry run the expired threads are still there, don't count their attachments twice
+			result.Attachments = slices.DeleteFunc(result.Attachments, func(attachments RetentionAuditAttachments) bool {
+				return slices.ContainsFunc(result.Threads, func(thread RetentionAuditThread) bool {
+					return thread.ID == attachments.ThreadID
+				})
+			})
+		}
+
+		if len(result.Threads) == 0 && len(result.Attachments) == 0 {
+			continue
+		}
+		results = append(results, result)
+		if dryRun {
+			continue
+		}
+		if err := a.saveRetentionAudit(result); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// purgeExpiredThreads deletes the unpinned threads of the user without any message since the cutoff, along with
+// their messages and attachments.
+func (a *Application) purgeExpiredThreads(userID string, cutoff types.DateTime, dryRun bool) ([]RetentionAuditThread, error) {
+	var expired []struct {
+		ID    string `db:"id"`
+		Title string `db:"title"`
+	}
+	err := a.PB.DB().NewQuery(`
+SELECT t.id, t.title
+FROM threads t
+WHERE t.owner_user_id = {:userID}
+AND (t.pinned_at IS NULL OR t.pinned_at = '')
+AND t.created < {:cutoff}
+AND NOT EXISTS (
+	SELECT 1 FROM messages m
+	WHERE m.parent_thread_id = t.id
+	AND (m.created >= {:cutoff} OR m.updated >= {:cutoff})
+);
+`).Bind(dbx.Params{"userID": userID, "cutoff": cutoff.String()}).All(&expired)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find expired threads: %w", err)
+	}
+
+	var purged []RetentionAuditThread
+	err = a.PB.RunInTransaction(func(txApp core.App) error {
+		for _, thread := range expired {
+			messages, err := txApp.FindAllRecords("messages", dbx.HashExp{"parent_thread_id": thread.ID})
+			if err != nil {
+				return fmt.Errorf("failed to find messages of thread %s: %w", thread.ID, err)
+			}
+			files := 0
+			for _, message := range messages {
+				files += len(message.GetStringSlice("attachments"))
+			}
+			purged = append(purged, RetentionAuditThread{ID: thread.ID, Title: thread.Title, Messages: len(messages), Files: files})
+			if dryRun {
+				continue
+			}
+
+			threadRecord, err := txApp.FindRecordById("threads", thread.ID)
+			if err != nil {
+				return fmt.Errorf("failed to find thread %s: %w", thread.ID, err)
+			}
+			// Messages are deleted by cascade, and their files once the transaction is committed
+			if err := txApp.Delete(threadRecord); err != nil {
+				return fmt.Errorf("failed to delete thread %s: %w", thread.ID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return purged, nil
+}
+
+// stripExpiredAttachments removes the attachments of the user's messages created before the cutoff, except in
+// pinned threads. The messages themselves are kept.
+func (a *Application) stripExpiredAttachments(userID string, cutoff types.DateTime, dryRun bool) ([]RetentionAuditAttachments, error) {
+	messages, err := a.PB.FindRecordsByFilter(
+		"messages",
+		"owner_user_id = {:userID} && attachments:length > 0 && created < {:cutoff} && parent_thread_id.pinned_at = ''",
+		"",
+		0,
+		0,
+		dbx.Params{"userID": userID, "cutoff": cutoff},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find messages with expired attachments: %w", err)
+	}
+
+	var stripped []RetentionAuditAttachments
+	err = a.PB.RunInTransaction(func(txApp core.App) error {
+		for _, message := range messages {
+			stripped = append(stripped, RetentionAuditAttachments{
+				ThreadID:  message.GetString("parent_thread_id"),
+				MessageID: message.Id,
+				Files:     message.GetStringSlice("attachments"),
+			})
+			if dryRun {
+				continue
+			}
+			// The removed files are deleted once the transaction is committed
+			message.Set("attachments", []string{})
+			if err := txApp.Save(message); err != nil {
+				return fmt.Errorf("failed to save message %s: %w", message.Id, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stripped, nil
+}
+
+// saveRetentionAudit records what the retention job purged for a user, one record per kind of data.
+func (a *Application) saveRetentionAudit(result RetentionResult) error {
+	auditsCollection, err := a.PB.FindCollectionByNameOrId("retention_audits")
+	if err != nil {
+		return fmt.Errorf("failed to find retention audits collection: %w", err)
+	}
+
+	if len(result.Threads) > 0 {
+		messages, files := 0, 0
+		for _, thread := range result.Threads {
+			messages += thread.Messages
+			files += thread.Files
+		}
+		audit := core.NewRecord(auditsCollection)
+		audit.Set("owner_user_id", result.UserID)
+		audit.Set("kind", RetentionAuditKindThreads)
+		audit.Set("max_age_days", result.Policy.ThreadMaxAgeDays)
+		audit.Set("threads", len(result.Threads))
+		audit.Set("messages", messages)
+		audit.Set("files", files)
+		audit.Set("details", result.Threads)
+		if err := a.PB.Save(audit); err != nil {
+			return fmt.Errorf("failed to save retention audit: %w", err)
+		}
+	}
+
+	if len(result.Attachments) > 0 {
+		threads := make(map[string]struct{})
+		files := 0
+		for _, attachments := range result.Attachments {
+			threads[attachments.ThreadID] = struct{}{}
+			files += len(attachments.Files)
+		}
+		audit := core.NewRecord(auditsCollection)
+		audit.Set("owner_user_id", result.UserID)
+		audit.Set("kind", RetentionAuditKindAttachments)
+		audit.Set("max_age_days", result.Policy.AttachmentMaxAgeDays)
+		audit.Set("threads", len(threads))
+		audit.Set("messages", len(result.Attachments))
+		audit.Set("files", files)
+		audit.Set("details", result.Attachments)
+		if err := a.PB.Save(audit); err != nil {
+			return fmt.Errorf("failed to save retention audit: %w", err)
+		}
+	}
+	return nil
+}
+
+// runRetentionJob is the cron job enforcing the retention policies.
+func (a *Application) runRetentionJob() {
+	startTime := time.Now()
+	results, err := a.enforceRetention(false)
+	if err != nil {
+		a.PB.Logger().Error("Failed to enforce retention policies", "error", err)
+	}
+	threads, attachments := 0, 0
+	for _, result := range results {
+		threads += len(result.Threads)
+		attachments += len(result.Attachments)
+	}
+	a.PB.Logger().Info(
+		"Enforced retention policies",
+		"users", len(results),
+		"threads", threads,
+		"messagesWithAttachments", attachments,
+		"duration", time.Since(startTime),
+	)
+}
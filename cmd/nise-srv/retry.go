@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"github.com/openai/openai-go"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	streamMaxAttempts    = 4
+	streamBaseRetryDelay = 1 * time.Second
+	streamMaxRetryDelay  = 30 * time.Second
+)
+
+// StreamAttempt is a failed request to the upstream provider while generating a message, saved in the message meta.
+type StreamAttempt struct {
+	Attempt int    `json:"attempt"`
+	Model   string `json:"model"`
+	// StatusCode is the HTTP status of the upstream response, zero for network errors
+	StatusCode int            `json:"statusCode,omitempty"`
+	Error      string         `json:"error"`
+	Started    types.DateTime `json:"started"`
+	// RetryDelayMs is how long the stream waited before the next attempt, zero when it gave up
+	RetryDelayMs int64 `json:"retryDelayMs,omitempty"`
+}
+
+// retryableStreamError tells whether an upstream error is worth retrying: rate limits, server errors and network
+// errors. It returns the HTTP status of the error, and the delay asked for by a Retry-After header if any.
+func retryableStreamError(err error) (bool, int, time.Duration) {
+	var apiErr *openai.Error
+	if errors.As(err, &apiErr) {
+		retryable := apiErr.StatusCode == http.StatusTooManyRequests ||
+			apiErr.StatusCode == http.StatusRequestTimeout ||
+			apiErr.StatusCode >= 500
+		var retryAfter time.Duration
+		if apiErr.Response != nil {
+			retryAfter = parseRetryAfter(apiErr.Response.Header.Get("Retry-After"))
+		}
+		return retryable, apiErr.StatusCode, retryAfter
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true, 0, 0
+	}
+	return false, 0, 0
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// streamRetryDelay doubles the delay with every failed attempt up to a maximum, with up to 20% jitter. A delay
+// asked for by the provider takes precedence, and the stream gives up when it's longer than the maximum.
+func streamRetryDelay(attempt int, retryAfter time.Duration) (time.Duration, bool) {
+	if retryAfter > 0 {
+		return retryAfter, retryAfter <= streamMaxRetryDelay
+	}
+	delay := streamBaseRetryDelay << (attempt - 1)
+	if delay <= 0 || delay > streamMaxRetryDelay {
+		delay = streamMaxRetryDelay
+	}
+	jitter := time.Duration(rand.Int64N(int64(delay) / 5))
+	return delay - jitter, true
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxSchemaViolations is how many violations are reported for a value, the first ones are enough to tell what's wrong.
+const maxSchemaViolations = 20
+
+// SchemaMismatchError is the error of a structured output that isn't valid JSON or doesn't match the JSON schema of
+// its response format.
+type SchemaMismatchError struct {
+	Violations []string
+}
+
+func (e *SchemaMismatchError) Error() string {
+	return "the response doesn't match the JSON schema: " + strings.Join(e.Violations, "; ")
+}
+
+// structuredOutput parses the content of a response generated with a JSON response format and validates it against
+// the schema of the format. It returns nil without a JSON response format, and a SchemaMismatchError when the content
+// doesn't conform.
+func structuredOutput(format *ResponseFormat, content string) (json.RawMessage, error) {
+	if format == nil || format.Type == ResponseFormatTypeText || format.Type == "" {
+		return nil, nil
+	}
+
+	// Some models wrap the JSON in a markdown code block even in JSON mode
+	content = strings.TrimSpace(content)
+	if len(content) >= 6 && strings.HasPrefix(content, "```") && strings.HasSuffix(content, "```") {
+		content = strings.TrimSpace(content[3 : len(content)-3])
+		// Skip the language of the block, like json
+		if language, rest, ok := strings.Cut(content, "\n"); ok && !strings.ContainsAny(language, "{[\"") {
+			content = rest
+		}
+	}
+
+	var value any
+	if err := json.Unmarshal([]byte(content), &value); err != nil {
+		return nil, &SchemaMismatchError{Violations: []string{fmt.Sprintf("the response isn't valid JSON: %v", err)}}
+	}
+
+	var violations []string
+	if format.Type == ResponseFormatTypeJSONObject || format.JSONSchema == nil {
+		if _, ok := value.(map[string]any); !ok {
+			violations = append(violations, "the response isn't a JSON object")
+		}
+	} else {
+		var schema map[string]any
+		if err := json.Unmarshal(format.JSONSchema.Schema, &schema); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal the JSON schema: %w", err)
+		}
+		validator := schemaValidator{root: schema}
+		validator.validate(schema, value, "")
+		violations = validator.violations
+	}
+	if len(violations) > 0 {
+		return nil, &SchemaMismatchError{Violations: violations}
+	}
+
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, []byte(content)); err != nil {
+		return nil, fmt.Errorf("failed to compact the structured output: %w", err)
+	}
+	return compacted.Bytes(), nil
+}
+
+// schemaValidator validates values against the subset of JSON schema that structured outputs support: types, enums,
+// constants, object properties, array items, string and number bounds, combinations and local references. Other
+// keywords are ignored.
+type schemaValidator struct {
+	root       map[string]any
+	violations []string
+	// depth guards against recursive references
+	depth int
+}
+
+func (v *schemaValidator) fail(path, format string, args ...any) {
+	if len(v.violations) >= maxSchemaViolations {
+		return
+	}
+	if path == "" {
+		path = "/"
+	}
+	v.violations = append(v.violations, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (v *schemaValidator) validate(schema map[string]any, value any, path string) {
+	if v.depth > 64 {
+		v.fail(path, "the schema nests too deeply")
+		return
+	}
+	v.depth++
+	defer func() { v.depth-- }()
+
+	if ref, ok := schema["$ref"].(string); ok {
+		resolved, ok := v.resolve(ref)
+		if !ok {
+			v.fail(path, "unresolvable reference %q", ref)
+			return
+		}
+		v.validate(resolved, value, path)
+	}
+
+	if types, ok := schemaTypes(schema["type"]); ok && !allowsType(types, value) {
+		v.fail(path, "expected %s, got %s", strings.Join(types, " or "), jsonType(value))
+		return
+	}
+	if enum, ok := schema["enum"].([]any); ok && !containsJSONValue(enum, value) {
+		v.fail(path, "value isn't one of the allowed values")
+	}
+	if constant, ok := schema["const"]; ok && !reflect.DeepEqual(constant, value) {
+		v.fail(path, "value isn't the expected constant")
+	}
+
+	switch value := value.(type) {
+	case map[string]any:
+		v.validateObject(schema, value, path)
+	case []any:
+		v.validateArray(schema, value, path)
+	case string:
+		length := float64(utf8.RuneCountInString(value))
+		if minLength, ok := schema["minLength"].(float64); ok && length < minLength {
+			v.fail(path, "string is shorter than %v characters", minLength)
+		}
+		if maxLength, ok := schema["maxLength"].(float64); ok && length > maxLength {
+			v.fail(path, "string is longer than %v characters", maxLength)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(value) {
+				v.fail(path, "string doesn't match the pattern %q", pattern)
+			}
+		}
+	case float64:
+		if minimum, ok := schema["minimum"].(float64); ok && value < minimum {
+			v.fail(path, "number is less than %v", minimum)
+		}
+		if maximum, ok := schema["maximum"].(float64); ok && value > maximum {
+			v.fail(path, "number is greater than %v", maximum)
+		}
+		if minimum, ok := schema["exclusiveMinimum"].(float64); ok && value <= minimum {
+			v.fail(path, "number isn't greater than %v", minimum)
+		}
+		if maximum, ok := schema["exclusiveMaximum"].(float64); ok && value >= maximum {
+			v.fail(path, "number isn't less than %v", maximum)
+		}
+	}
+
+	if allOf, ok := schema["allOf"].([]any); ok {
+		for _, sub := range allOf {
+			if sub, ok := sub.(map[string]any); ok {
+				v.validate(sub, value, path)
+			}
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]any); ok && v.matching(anyOf, value, path) == 0 {
+		v.fail(path, "value doesn't match any of the allowed schemas")
+	}
+	if oneOf, ok := schema["oneOf"].([]any); ok {
+		if matching := v.matching(oneOf, value, path); matching != 1 {
+			v.fail(path, "value matches %d of the schemas instead of exactly one", matching)
+		}
+	}
+	if not, ok := schema["not"].(map[string]any); ok && v.matching([]any{not}, value, path) == 1 {
+		v.fail(path, "value matches a disallowed schema")
+	}
+}
+
+func (v *schemaValidator) validateObject(schema map[string]any, object map[string]any, path string) {
+	properties, _ := schema["properties"].(map[string]any)
+	if required, ok := schema["required"].([]any); ok {
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				if _, ok := object[name]; !ok {
+					v.fail(path, "missing required property %q", name)
+				}
+			}
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(object)) {
+		property := object[name]
+		propertyPath := path + "/" + escapeJSONPointer(name)
+		if propertySchema, ok := properties[name].(map[string]any); ok {
+			v.validate(propertySchema, property, propertyPath)
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				v.fail(path, "unexpected property %q", name)
+			}
+		case map[string]any:
+			v.validate(additional, property, propertyPath)
+		}
+	}
+}
+
+func (v *schemaValidator) validateArray(schema map[string]any, array []any, path string) {
+	length := float64(len(array))
+	if minItems, ok := schema["minItems"].(float64); ok && length < minItems {
+		v.fail(path, "array has fewer than %v items", minItems)
+	}
+	if maxItems, ok := schema["maxItems"].(float64); ok && length > maxItems {
+		v.fail(path, "array has more than %v items", maxItems)
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		for i, item := range array {
+			v.validate(items, item, fmt.Sprintf("%s/%d", path, i))
+		}
+	}
+}
+
+// matching returns how many of the schemas the value matches, without reporting the violations of the others.
+func (v *schemaValidator) matching(schemas []any, value any, path string) int {
+	matching := 0
+	for _, sub := range schemas {
+		sub, ok := sub.(map[string]any)
+		if !ok {
+			continue
+		}
+		trial := schemaValidator{root: v.root, depth: v.depth}
+		trial.validate(sub, value, path)
+		if len(trial.violations) == 0 {
+			matching++
+		}
+	}
+	return matching
+}
+
+// resolve finds the schema of a local reference like #/$defs/name.
+func (v *schemaValidator) resolve(ref string) (map[string]any, bool) {
+	if ref == "#" {
+		return v.root, true
+	}
+	pointer, ok := strings.CutPrefix(ref, "#/")
+	if !ok {
+		return nil, false
+	}
+	var current any = v.root
+	for _, token := range strings.Split(pointer, "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		object, ok := current.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		current = object[token]
+	}
+	schema, ok := current.(map[string]any)
+	return schema, ok
+}
+
+// schemaTypes returns the types allowed by the type keyword, given as a string or an array of strings.
+func schemaTypes(keyword any) ([]string, bool) {
+	switch keyword := keyword.(type) {
+	case string:
+		return []string{keyword}, true
+	case []any:
+		var types []string
+		for _, t := range keyword {
+			if t, ok := t.(string); ok {
+				types = append(types, t)
+			}
+		}
+		return types, len(types) > 0
+	default:
+		return nil, false
+	}
+}
+
+func allowsType(types []string, value any) bool {
+	actual := jsonType(value)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonType returns the JSON schema type of a decoded JSON value, integer for the numbers without a fraction.
+func jsonType(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return "unknown"
+	}
+}
+
+func containsJSONValue(values []any, value any) bool {
+	for _, v := range values {
+		if reflect.DeepEqual(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func escapeJSONPointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
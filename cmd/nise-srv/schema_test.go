@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStructuredOutput(t *testing.T) {
+	schema := `{
+		"type": "object",
+		"properties": {
+			"answer": {"type": "integer", "minimum": 0},
+			"unit": {"enum": ["m", "km"]},
+			"tags": {"type": "array", "items": {"type": "string", "maxLength": 5}, "maxItems": 2},
+			"source": {"$ref": "#/$defs/source"}
+		},
+		"required": ["answer"],
+		"additionalProperties": false,
+		"$defs": {
+			"source": {"anyOf": [{"type": "string", "pattern": "^https://"}, {"type": "null"}]}
+		}
+	}`
+	schemaFormat := &ResponseFormat{
+		Type:       ResponseFormatTypeJSONSchema,
+		JSONSchema: &ResponseFormatJSONSchema{Name: "answer", Schema: json.RawMessage(schema)},
+	}
+	jsonObject := &ResponseFormat{Type: ResponseFormatTypeJSONObject}
+
+	tests := []struct {
+		name       string
+		format     *ResponseFormat
+		content    string
+		structured string
+		violations []string
+	}{
+		{name: "without response format", content: "Hello", structured: ""},
+		{name: "text response format", format: &ResponseFormat{Type: ResponseFormatTypeText}, content: "Hello", structured: ""},
+		{name: "json object", format: jsonObject, content: ` { "any": [1, 2] } `, structured: `{"any":[1,2]}`},
+		{name: "json object that isn't an object", format: jsonObject, content: `[1]`, violations: []string{"the response isn't a JSON object"}},
+		{name: "matching the schema", format: schemaFormat, content: `{"answer": 42, "unit": "km", "tags": ["a"], "source": null}`, structured: `{"answer":42,"unit":"km","tags":["a"],"source":null}`},
+		{name: "in a code block", format: schemaFormat, content: "```json\n{\"answer\": 1}\n```", structured: `{"answer":1}`},
+		{name: "invalid JSON", format: schemaFormat, content: `{"answer": `, violations: []string{"the response isn't valid JSON: unexpected end of JSON input"}},
+		{name: "missing required property", format: schemaFormat, content: `{}`, violations: []string{`/: missing required property "answer"`}},
+		{
+			name:    "wrong values",
+			format:  schemaFormat,
+			content: `{"answer": 1.5, "unit": "mi", "tags": ["a", "toolong", "c"], "source": "http://example.com", "extra": true}`,
+			violations: []string{
+				"/answer: expected integer, got number",
+				`/: unexpected property "extra"`,
+				"/source: value doesn't match any of the allowed schemas",
+				"/tags: array has more than 2 items",
+				"/tags/1: string is longer than 5 characters",
+				"/unit: value isn't one of the allowed values",
+			},
+		},
+		{name: "below the minimum", format: schemaFormat, content: `{"answer": -1}`, violations: []string{"/answer: number is less than 0"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			structured, err := structuredOutput(test.format, test.content)
+			var schemaErr *SchemaMismatchError
+			if test.violations != nil {
+				if !errors.As(err, &schemaErr) {
+					t.Fatalf("Error is %v, expected a schema mismatch", err)
+				}
+				if !reflect.DeepEqual(schemaErr.Violations, test.violations) {
+					t.Errorf("Violations are %q, expected %q", schemaErr.Violations, test.violations)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(structured) != test.structured {
+				t.Errorf("Structured output is %s, expected %s", structured, test.structured)
+			}
+		})
+	}
+}
+
+func TestStructuredOutputMessage(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("user@example.com")
+	// The upstream replies with the message as is, so that it's the content to validate
+	s.Upstream.Script = func(request mockRequest) MockScript {
+		return MockScript{Content: []string{request.lastUserText()}}
+	}
+	model := ResponseModel{ProviderID: "test/model", Options: &ResponseModelOptions{
+		ResponseFormat: &ResponseFormat{
+			Type: ResponseFormatTypeJSONSchema,
+			JSONSchema: &ResponseFormatJSONSchema{
+				Name:   "answer",
+				Schema: json.RawMessage(`{"type":"object","properties":{"answer":{"type":"integer"}},"required":["answer"]}`),
+			},
+		},
+	}}
+
+	_, responseID := s.createThreadWithModel(user, `{"answer": 42}`, model)
+	response := s.waitMessage(responseID)
+	if status := MessageStatus(response.GetString("status")); status != MessageStatusCompleted {
+		t.Errorf("Message status is %s, expected %s", status, MessageStatusCompleted)
+	}
+	if structured := string(messageParts(t, response).Structured); structured != `{"answer":42}` {
+		t.Errorf("Structured output is %s", structured)
+	}
+
+	_, responseID = s.createThreadWithModel(user, `{"answer": "forty-two"}`, model)
+	chunks := s.readStream(user, responseID, 0)
+	response = s.waitMessage(responseID)
+	if status := MessageStatus(response.GetString("status")); status != MessageStatusFailed {
+		t.Errorf("Message status is %s, expected %s", status, MessageStatusFailed)
+	}
+	parts := messageParts(t, response)
+	expected := []string{"/answer: expected integer, got string"}
+	if parts.ErrorCode != ErrorCodeSchemaMismatch || !reflect.DeepEqual(parts.SchemaErrors, expected) || parts.Structured != nil {
+		t.Errorf("Message parts are %+v, expected a schema mismatch with %q", parts, expected)
+	}
+	if parts.Content != `{"answer": "forty-two"}` {
+		t.Errorf("Content is %q, expected it to be kept", parts.Content)
+	}
+
+	var errorChunk *Chunk
+	for _, chunk := range chunks {
+		if chunk.Type == ChunkTypeError {
+			errorChunk = &chunk
+		}
+	}
+	if errorChunk == nil || errorChunk.Error == nil || !strings.Contains(strings.Join(errorChunk.Error.Details, ";"), "expected integer") {
+		t.Errorf("Streamed error chunk is %+v, expected the schema violations", errorChunk)
+	}
+}
@@ -3,10 +3,11 @@ package main
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/openai/openai-go"
-	"github.com/openai/openai-go/option"
 	"github.com/openai/openai-go/packages/param"
 	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase"
@@ -47,6 +48,21 @@ func (r ResponseModelReasoningEffort) String() string {
 type ResponseModelOptions struct {
 	WebSearch       bool                          `json:"webSearch,omitempty,omitzero"`
 	ReasoningEffort *ResponseModelReasoningEffort `json:"reasoningEffort,omitempty,omitzero" validate:"omitempty,oneof=off low medium high"`
+	// IncludeRefusals keeps the refused responses in the transcript, they are left out by default with the prompts
+	// they refused so that the model doesn't keep refusing because it did before
+	IncludeRefusals bool `json:"includeRefusals,omitempty,omitzero"`
+
+	// Generation parameters, the ones not set are left to the defaults of the model
+	Temperature      *float64        `json:"temperature,omitempty,omitzero" validate:"omitempty,min=0,max=2"`
+	TopP             *float64        `json:"topP,omitempty,omitzero" validate:"omitempty,gt=0,max=1"`
+	MaxTokens        *int64          `json:"maxTokens,omitempty,omitzero" validate:"omitempty,min=1,max=1000000"`
+	Stop             []string        `json:"stop,omitempty,omitzero" validate:"omitempty,max=4,dive,min=1,max=256"`
+	Seed             *int64          `json:"seed,omitempty,omitzero"`
+	PresencePenalty  *float64        `json:"presencePenalty,omitempty,omitzero" validate:"omitempty,min=-2,max=2"`
+	FrequencyPenalty *float64        `json:"frequencyPenalty,omitempty,omitzero" validate:"omitempty,min=-2,max=2"`
+	ResponseFormat   *ResponseFormat `json:"responseFormat,omitempty,omitzero"`
+	// Provider are the OpenRouter provider routing preferences
+	Provider *ProviderPreferences `json:"provider,omitempty,omitzero"`
 }
 
 type ResponseModel struct {
@@ -72,11 +88,22 @@ type MessageMeta struct {
 	Usage             openai.CompletionUsage `json:"usage,omitempty,omitzero"`
 	FinishReason      FinishReason           `json:"finishReason,omitempty,omitzero"`
 	ModelOptions      *ResponseModelOptions  `json:"modelOptions,omitempty,omitzero"`
+	// Attempts are the failed requests to the provider while generating the message, the last one included
+	// when the message failed
+	Attempts []StreamAttempt `json:"attempts,omitempty,omitzero"`
+	// AnsweredModel is the model of the fallback chain that generated the message, and SkippedModels the ones that
+	// failed before it
+	AnsweredModel string         `json:"answeredModel,omitempty,omitzero"`
+	SkippedModels []SkippedModel `json:"skippedModels,omitempty,omitzero"`
+	// Stats are the timings of the stream that generated the message
+	Stats StreamStats `json:"stats,omitempty,omitzero"`
 }
 
 type MessageScalar struct {
-	ID              string         `json:"id" db:"id"`
-	OwnerUserID     string         `json:"ownerUserId" db:"owner_user_id"`
+	ID          string `json:"id" db:"id"`
+	OwnerUserID string `json:"ownerUserId" db:"owner_user_id"`
+	// AuthorUserID is the user who wrote the message or asked for the response, the thread owner when empty
+	AuthorUserID    string         `json:"authorUserId,omitempty" db:"author_user_id"`
 	ParentThreadID  string         `json:"parentThreadId" db:"parent_thread_id"`
 	ParentMessageID string         `json:"parentMessageId" db:"parent_message_id"`
 	Model           string         `json:"model" db:"model"`
@@ -98,6 +125,8 @@ type Message struct {
 	Attachments []string     `json:"attachments,omitempty" db:"attachments"` // List of attachment file IDs
 	Parts       MessageParts `json:"parts" db:"parts"`
 	Meta        MessageMeta  `json:"meta,omitempty" db:"meta"`
+	// Suggestions are the follow-up prompts generated for a response once it completed
+	Suggestions []string `json:"suggestions,omitempty" db:"suggestions"`
 }
 
 type MessageStatus string
@@ -116,9 +145,42 @@ func (s MessageStatus) String() string {
 	return string(s)
 }
 
+// messageFromRecord converts a messages record into its typed representation.
+func messageFromRecord(record *core.Record) (Message, error) {
+	message := Message{
+		MessageScalar: MessageScalar{
+			ID:              record.Id,
+			OwnerUserID:     record.GetString("owner_user_id"),
+			AuthorUserID:    record.GetString("author_user_id"),
+			ParentThreadID:  record.GetString("parent_thread_id"),
+			ParentMessageID: record.GetString("parent_message_id"),
+			Model:           record.GetString("model"),
+			Role:            MessageRole(record.GetString("role")),
+			Status:          MessageStatus(record.GetString("status")),
+			Created:         record.GetDateTime("created"),
+			Updated:         record.GetDateTime("updated"),
+		},
+		Attachments: record.GetStringSlice("attachments"),
+	}
+	if err := record.UnmarshalJSONField("parts", &message.Parts); err != nil {
+		return Message{}, fmt.Errorf("failed to unmarshal message parts: %w", err)
+	}
+	if err := record.UnmarshalJSONField("meta", &message.Meta); err != nil {
+		return Message{}, fmt.Errorf("failed to unmarshal message meta: %w", err)
+	}
+	if err := record.UnmarshalJSONField("suggestions", &message.Suggestions); err != nil {
+		return Message{}, fmt.Errorf("failed to unmarshal message suggestions: %w", err)
+	}
+	return message, nil
+}
+
+// errParentMessageNotFound is returned when the message to reply to doesn't exist or is in another thread.
+var errParentMessageNotFound = errors.New("parent message not found in the thread")
+
 func (a *Application) createNewMessageWithResponse(
 	txPB core.App,
 	ownerUserId string,
+	authorUserId string,
 	parentThreadId string,
 	input UserMessage,
 	responseModel ResponseModel,
@@ -127,13 +189,23 @@ func (a *Application) createNewMessageWithResponse(
 	// TODO: Check for invariants:
 	// - The user must be the owner of the thread
 	// - The thread must exist
-	// - The parent message ID must be valid (if provided)
 	// - Add a param to know if this is for a new thread or an existing one, is existing, check invariants
 	messagesCollection, err := txPB.FindCollectionByNameOrId("messages")
 	if err != nil {
 		return nil, nil, fmt.Errorf("createNewMessageWithResponse failed to find messages collection: %w", err)
 	}
 
+	// The parent message must be in the thread, or its branch from another thread would end up in the transcript
+	if input.ParentMessageID != "" {
+		parentMessageRecord, err := txPB.FindRecordById("messages", input.ParentMessageID)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && parentMessageRecord.GetString("parent_thread_id") != parentThreadId) {
+			return nil, nil, fmt.Errorf("%w: message %s in thread %s", errParentMessageNotFound, input.ParentMessageID, parentThreadId)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("createNewMessageWithResponse failed to find parent message: %w", err)
+		}
+	}
+
 	userMessageRecord := core.NewRecord(messagesCollection)
 	userMessageId, err := NewUUIDv7b32()
 	if err != nil {
@@ -143,6 +215,7 @@ func (a *Application) createNewMessageWithResponse(
 	userMessageRecord.Set("parent_thread_id", parentThreadId)
 	userMessageRecord.Set("parent_message_id", input.ParentMessageID)
 	userMessageRecord.Set("owner_user_id", ownerUserId)
+	userMessageRecord.Set("author_user_id", authorUserId)
 	userMessageRecord.Set("role", MessageRoleUser)
 	userMessageRecord.Set("status", MessageStatusCompleted)
 	userMessageParts := MessageParts{
@@ -170,15 +243,11 @@ func (a *Application) createNewMessageWithResponse(
 	responseMessageRecord.Set("parent_thread_id", parentThreadId)
 	responseMessageRecord.Set("parent_message_id", userMessageId.String())
 	responseMessageRecord.Set("owner_user_id", ownerUserId)
+	responseMessageRecord.Set("author_user_id", authorUserId)
 	responseMessageRecord.Set("role", MessageRoleAssistant)
 	responseMessageRecord.Set("status", MessageStatusPending) // Initial status is pending
 	responseMessageParts := MessageParts{}
 
-	if responseModel.ProviderID == "echo" {
-		responseMessageParts.Content = "DEV: This is a response to " + input.Content // Placeholder content
-		responseMessageRecord.Set("status", MessageStatusCompleted)                  // Set status to completed for echo model
-	}
-
 	responseMessageRecord.Set("parts", responseMessageParts)
 	responseMessageRecord.Set("model", responseModel.ProviderID)
 	responseMessageMeta := MessageMeta{
@@ -230,20 +299,62 @@ func (a *Application) createNewMessageWithResponse(
 		}, nil
 }
 
-func (a *Application) regenerateMessage(userID, threadID, messageID string, input RegenerateMessageInThreadInput) error {
+// sendMessageInThread adds a user message to an existing thread and starts streaming the response to it. The user
+// must be the owner or a contributor of the thread, which must not be in the trash. The messages are owned by the
+// thread owner.
+func (a *Application) sendMessageInThread(
+	userID string,
+	threadID string,
+	input UserMessage,
+	responseModel ResponseModel,
+	attachments []*multipart.FileHeader,
+) (*NewThreadOutputThreadMessage, *NewThreadOutputThreadMessage, error) {
+	access, err := findWritableThreadAccess(a.PB, threadID, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	userMessage, responseMessage, err := a.createNewMessageWithResponse(
+		a.PB,
+		access.OwnerUserID,
+		userID,
+		threadID,
+		input,
+		responseModel,
+		attachments,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create new message with response: %w", err)
+	}
+
+	_, err = a.StreamService.StartStream(responseMessage.ID, access.OwnerUserID, responseModel)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start stream for message %s: %w", responseMessage.ID, err)
+	}
+
+	return userMessage, responseMessage, nil
+}
+
+// regenerateMessage copies an assistant message into a new sibling, either with user edited content or with a
+// fresh stream from the given model, and returns the ID of the new message.
+func (a *Application) regenerateMessage(ctx context.Context, userID, threadID, messageID string, input RegenerateMessageInThreadInput) (string, error) {
 	// Find the message to regenerate
 	messagesCollection, err := a.PB.FindCollectionByNameOrId("messages")
 	if err != nil {
 		a.PB.Logger().Error("Failed to find messages collection", "error", err)
-		return fmt.Errorf("failed to find messages collection: %w", err)
+		return "", fmt.Errorf("failed to find messages collection: %w", err)
 	}
 	messageRecord, err := a.PB.FindRecordById(messagesCollection.Name, messageID)
 	if err != nil {
 		a.PB.Logger().Error("Failed to find message record", "error", err, "messageID", messageID)
-		return fmt.Errorf("failed to find message record: %w", err)
+		return "", fmt.Errorf("failed to find message record: %w", err)
+	}
+	access, err := findWritableThreadAccess(a.PB, threadID, userID)
+	if err != nil && !errors.Is(err, errThreadAccessDenied) {
+		return "", err
 	}
 	if messageRecord.GetString("parent_thread_id") != threadID ||
-		messageRecord.GetString("owner_user_id") != userID ||
+		!access.Role.CanWrite() ||
 		messageRecord.GetString("role") != string(MessageRoleAssistant) {
 		a.PB.Logger().Warn("Message invariants not met for regeneration",
 			"messageID", messageID,
@@ -251,27 +362,51 @@ func (a *Application) regenerateMessage(userID, threadID, messageID string, inpu
 			"userID", userID,
 			"role", messageRecord.GetString("role"),
 		)
-		return fmt.Errorf("message not found or does not belong to the user or thread")
+		if messageRecord.GetString("parent_thread_id") != threadID || !access.Role.CanWrite() {
+			return "", fmt.Errorf("message %s can't be regenerated by user %s: %w", messageID, userID, errThreadAccessDenied)
+		}
+		return "", fmt.Errorf("message not found or does not belong to the user or thread")
 	}
 
 	newMessageId, err := NewUUIDv7b32()
 	if err != nil {
 		a.PB.Logger().Error("Failed to generate new message ID for regeneration", "error", err)
-		return fmt.Errorf("failed to generate new message ID: %w", err)
+		return "", fmt.Errorf("failed to generate new message ID: %w", err)
 	}
 	messageRecord.MarkAsNew()
 	messageRecord.Set("id", newMessageId.String())    // Set a new ID for the regenerated message
 	messageRecord.Set("status", MessageStatusPending) // Set status to pending for regeneration
+	messageRecord.Set("author_user_id", userID)
+	messageRecord.Set("suggestions", nil) // Suggestions are generated for the new response
 
 	// Get the parts of the message, replace content if provided by user, reset them if not
 	var messageParts MessageParts
 	err = messageRecord.UnmarshalJSONField("parts", &messageParts)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal message parts: %w", err)
+		return "", fmt.Errorf("failed to unmarshal message parts: %w", err)
 	}
 	// Get metadata of the message
 	var messageMeta MessageMeta
 
+	// Regenerating without a model uses the one of the message, and its options unless others are given, so that it's
+	// generated the same way. A new model only gets the options given with it.
+	if input.ResponseModel.ProviderID == "" {
+		var originalMeta MessageMeta
+		if err := messageRecord.UnmarshalJSONField("meta", &originalMeta); err != nil {
+			return "", fmt.Errorf("failed to unmarshal message meta: %w", err)
+		}
+		input.ResponseModel.ProviderID = messageRecord.GetString("model")
+		if input.ResponseModel.Options == nil {
+			input.ResponseModel.Options = originalMeta.ModelOptions
+		}
+	}
+	// The options are checked against the model they are generated with, known only now
+	if input.Content == "" {
+		if err := a.checkResponseModel(ctx, input.ResponseModel); err != nil {
+			return "", err
+		}
+	}
+
 	messageRecord.Set("model", input.ResponseModel.ProviderID)
 	messageMeta.ModelOptions = input.ResponseModel.Options
 
@@ -293,7 +428,7 @@ func (a *Application) regenerateMessage(userID, threadID, messageID string, inpu
 	err = a.PB.Save(messageRecord)
 	if err != nil {
 		a.PB.Logger().Error("Failed to save regenerated message", "error", err, "messageID", messageID)
-		return fmt.Errorf("failed to save regenerated message: %w", err)
+		return "", fmt.Errorf("failed to save regenerated message: %w", err)
 	}
 	a.PB.Logger().Info("Regenerated message",
 		"newMessageId", newMessageId.String(),
@@ -304,14 +439,14 @@ func (a *Application) regenerateMessage(userID, threadID, messageID string, inpu
 
 	// If message is supposed to be streamed, start the stream
 	if messageRecord.GetString("status") == string(MessageStatusPending) {
-		_, err := a.StreamService.StartStream(messageRecord.Id, userID, input.ResponseModel)
+		_, err := a.StreamService.StartStream(messageRecord.Id, access.OwnerUserID, input.ResponseModel)
 		if err != nil {
 			a.PB.Logger().Error("Failed to start stream for regenerated message", "error", err, "messageID", messageID)
-			return fmt.Errorf("failed to start stream for regenerated message: %w", err)
+			return "", fmt.Errorf("failed to start stream for regenerated message: %w", err)
 		}
 	}
 
-	return nil
+	return messageRecord.Id, nil
 }
 
 func getThreadFiber(PB *pocketbase.PocketBase, userID, markerMessageID string) ([]MessageDB, error) {
@@ -365,7 +500,53 @@ func mimeTypeFromFileName(fileName string) (string, error) {
 	}
 }
 
-func getThreadTranscriptByLeaf(PB *pocketbase.PocketBase, userID, leafMessageID string) ([]openai.ChatCompletionMessageParamUnion, error) {
+// attachmentContentPart reads a stored attachment and returns it as an image or file content part, inlined as a
+// base64 data URL.
+func attachmentContentPart(fsys *filesystem.System, attachmentKey, fileName string) (openai.ChatCompletionContentPartUnionParam, error) {
+	r, err := fsys.GetReader(attachmentKey)
+	if err != nil {
+		return openai.ChatCompletionContentPartUnionParam{}, fmt.Errorf("failed to get attachment reader for %s: %w", attachmentKey, err)
+	}
+	attachmentContent := new(bytes.Buffer)
+	_, err = io.Copy(attachmentContent, r)
+	r.Close()
+	if err != nil {
+		return openai.ChatCompletionContentPartUnionParam{}, fmt.Errorf("failed to read attachment content for %s: %w", attachmentKey, err)
+	}
+	// Make a base64 encoded url for the attachment
+	mimeType, err := mimeTypeFromFileName(fileName)
+	if err != nil {
+		return openai.ChatCompletionContentPartUnionParam{}, fmt.Errorf("failed to determine MIME type for attachment %s: %w", fileName, err)
+	}
+	attachmentURL := fmt.Sprintf("data:%s;base64,%s", mimeType, base64.StdEncoding.EncodeToString(attachmentContent.Bytes()))
+
+	if mimeType == "image/png" || mimeType == "image/jpeg" {
+		return openai.ChatCompletionContentPartUnionParam{
+			OfImageURL: &openai.ChatCompletionContentPartImageParam{
+				ImageURL: openai.ChatCompletionContentPartImageImageURLParam{
+					URL: attachmentURL,
+				},
+				Type: "image_url",
+			},
+		}, nil
+	}
+	return openai.ChatCompletionContentPartUnionParam{
+		OfFile: &openai.ChatCompletionContentPartFileParam{
+			File: openai.ChatCompletionContentPartFileFileParam{
+				FileData: param.Opt[string]{
+					Value: attachmentURL,
+				},
+				FileID: param.Opt[string]{},
+				Filename: param.Opt[string]{
+					Value: attachmentKey,
+				},
+			},
+			Type: "file",
+		},
+	}, nil
+}
+
+func getThreadTranscriptByLeaf(PB *pocketbase.PocketBase, userID, leafMessageID string, includeRefusals bool) ([]openai.ChatCompletionMessageParamUnion, error) {
 	// Fetch the thread messages in reverse order
 	messages, err := getThreadFiber(PB, userID, leafMessageID)
 	if err != nil {
@@ -384,9 +565,29 @@ func getThreadTranscriptByLeaf(PB *pocketbase.PocketBase, userID, leafMessageID
 	}
 	messagesCollection.BaseFilesPath()
 
-	// Convert messages to OpenAI chat completion message format
-	transcript := make([]openai.ChatCompletionMessageParamUnion, 0, len(messages))
+	// Convert messages to OpenAI chat completion message format, after the context of the thread's project if any
+	transcript := make([]openai.ChatCompletionMessageParamUnion, 0, len(messages)+2)
+	if len(messages) > 0 {
+		projectContext, err := getProjectTranscriptContext(PB, fsys, userID, messages[0].ParentThreadID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get project context: %w", err)
+		}
+		transcript = append(transcript, projectContext...)
+	}
+	// Refused responses are left out with the prompts they refused, so that the prompt isn't asked again and the
+	// transcript keeps alternating between the user and the assistant
+	refusedPrompts := make(map[string]bool)
+	if !includeRefusals {
+		for _, msg := range messages {
+			if msg.Status == MessageStatusRefused {
+				refusedPrompts[msg.ParentMessageID] = true
+			}
+		}
+	}
 	for _, msg := range messages {
+		if !includeRefusals && (msg.Status == MessageStatusRefused || (msg.Role == MessageRoleUser && refusedPrompts[msg.ID])) {
+			continue
+		}
 		var message openai.ChatCompletionMessageParamUnion
 		if msg.Role == MessageRoleUser {
 			attachments := msg.Attachments
@@ -417,56 +618,23 @@ func getThreadTranscriptByLeaf(PB *pocketbase.PocketBase, userID, leafMessageID
 				}
 
 				for _, attachment := range msg.Attachments {
-
 					attachmentKey := messagesCollection.BaseFilesPath() + "/" + baseMessageId + "/" + attachment
-					r, err := fsys.GetReader(attachmentKey)
+					part, err := attachmentContentPart(fsys, attachmentKey, attachment)
 					if err != nil {
-						return nil, fmt.Errorf("failed to get attachment reader for %s: %w", attachmentKey, err)
+						return nil, err
 					}
-					attachmentContent := new(bytes.Buffer)
-					_, err = io.Copy(attachmentContent, r)
-					r.Close()
-					if err != nil {
-						return nil, fmt.Errorf("failed to read attachment content for %s: %w", attachmentKey, err)
-					}
-					// Make a base64 encoded url for the attachment
-					mimeType, err := mimeTypeFromFileName(attachment)
-					if err != nil {
-						return nil, fmt.Errorf("failed to determine MIME type for attachment %s: %w", attachment, err)
-					}
-					attachmentURL := fmt.Sprintf("data:%s;base64,%s", mimeType, base64.StdEncoding.EncodeToString(attachmentContent.Bytes()))
-
-					if mimeType == "image/png" || mimeType == "image/jpeg" {
-						messageContent = append(messageContent, openai.ChatCompletionContentPartUnionParam{
-							OfImageURL: &openai.ChatCompletionContentPartImageParam{
-								ImageURL: openai.ChatCompletionContentPartImageImageURLParam{
-									URL: attachmentURL,
-								},
-								Type: "image_url",
-							},
-						})
-					} else {
-						messageContent = append(messageContent, openai.ChatCompletionContentPartUnionParam{
-							OfFile: &openai.ChatCompletionContentPartFileParam{
-								File: openai.ChatCompletionContentPartFileFileParam{
-									FileData: param.Opt[string]{
-										Value: attachmentURL,
-									},
-									FileID: param.Opt[string]{},
-									Filename: param.Opt[string]{
-										Value: attachmentKey,
-									},
-								},
-								Type: "file",
-							},
-						})
-					}
-
+					messageContent = append(messageContent, part)
 				}
 				message = openai.UserMessage(messageContent)
 			}
+		} else if msg.Role == MessageRoleSystem {
+			message = openai.SystemMessage(msg.Parts.Get("content").(string))
 		} else {
-			message = openai.AssistantMessage(msg.Parts.Get("content").(string))
+			content := msg.Parts.Get("content").(string)
+			if refusal, ok := msg.Parts.Get("refusal").(string); ok && refusal != "" && content == "" {
+				content = refusal
+			}
+			message = openai.AssistantMessage(content)
 		}
 
 		transcript = append(transcript, message)
@@ -475,7 +643,7 @@ func getThreadTranscriptByLeaf(PB *pocketbase.PocketBase, userID, leafMessageID
 	return transcript, nil
 }
 
-func getThreadTranscriptUntilParent(PB *pocketbase.PocketBase, userID, leafMessageID string) ([]openai.ChatCompletionMessageParamUnion, error) {
+func getThreadTranscriptUntilParent(PB *pocketbase.PocketBase, userID, leafMessageID string, includeRefusals bool) ([]openai.ChatCompletionMessageParamUnion, error) {
 	// Get parent, if it exists, get transcript for it, otherwise return empty transcript
 	leafMessage, err := PB.FindRecordById("messages", leafMessageID)
 	if err != nil {
@@ -485,28 +653,7 @@ func getThreadTranscriptUntilParent(PB *pocketbase.PocketBase, userID, leafMessa
 	if parentMessageID == "" {
 		return []openai.ChatCompletionMessageParamUnion{}, nil // No parent, return empty transcript
 	}
-	return getThreadTranscriptByLeaf(PB, userID, parentMessageID)
-}
-
-const TitlingModel = "meta-llama/llama-3.1-8b-instruct"
-
-// Not using structured output for now to use faster models
-
-type GeneratedTitle struct {
-	Title string `json:"title" validate:"required,max=250,min=1"`
-}
-
-var generatedTitleSchema = map[string]any{
-	"type": "object",
-	"properties": map[string]any{
-		"title": map[string]any{
-			"type":        "string",
-			"description": "The generated title for the thread",
-			"maxLength":   250,
-			"minLength":   1,
-		},
-	},
-	"required": []string{"title"},
+	return getThreadTranscriptByLeaf(PB, userID, parentMessageID, includeRefusals)
 }
 
 func (a *Application) setThreadTitleFromFirstMessage(userID, threadID, messageID string) error {
@@ -534,19 +681,9 @@ func (a *Application) setThreadTitleFromFirstMessage(userID, threadID, messageID
 }
 
 // generateAndSetThreadTitle generates a title for a thread based on the first message content
-// and sets it on the thread record. It includes a 5-second timeout.
+// and sets it on the thread record, unless the title was already set in the meantime.
 func (a *Application) generateAndSetThreadTitle(userID, threadID, messageContent string) {
 	startTime := time.Now()
-	// Create a context with a 5-second timeout for the title generation
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	//schemaParam := openai.ResponseFormatJSONSchemaJSONSchemaParam{
-	//	Name:        "generated-title",
-	//	Description: openai.String("The generated title for the thread"),
-	//	Schema:      generatedTitleSchema,
-	//	Strict:      openai.Bool(true),
-	//}
 
 	var success bool
 	defer func() {
@@ -563,41 +700,9 @@ func (a *Application) generateAndSetThreadTitle(userID, threadID, messageContent
 		}
 	}()
 
-	// Get user's api key from the database
-	apiKeyRecord, err := a.PB.FindFirstRecordByData("api_keys", "owner_user_id", userID)
-	if err != nil {
-		a.PB.Logger().Error("failed to find API key record", "error", err, "userID", userID)
-		return
-	}
-	if apiKeyRecord == nil {
-		a.PB.Logger().Error("no API key found for user", "userID", userID)
-		return
-	}
-	apiKey := apiKeyRecord.GetString("key")
-
-	chat, err := a.AIClient.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
-		Messages: []openai.ChatCompletionMessageParamUnion{
-			openai.SystemMessage("You are generating a title for a chat thread between a user and an AI assistant. You are given the first message in the thread by the user. Generate a concise and descriptive title for the thread based on this message. Output only the title and nothing else."),
-			openai.UserMessage(fmt.Sprintf(`<first_message>%s</first_message>`, messageContent)),
-		},
-		Model:               TitlingModel,
-		MaxCompletionTokens: openai.Opt[int64](330),
-		//ResponseFormat: openai.ChatCompletionNewParamsResponseFormatUnion{
-		//	OfJSONSchema: &openai.ResponseFormatJSONSchemaParam{JSONSchema: schemaParam},
-		//},
-	},
-		// OpenRouter options
-		option.WithJSONSet("provider", map[string]any{
-			"require_parameters": true,
-			"order": []string{
-				"cerebras/fp16",
-				"groq",
-			},
-			"allow_fallbacks": true,
-			"data_collection": "deny",
-		}),
-		option.WithAPIKey(apiKey),
-	)
+	title, err := a.generateTitle(context.Background(), userID, a.titleSettings(userID), []TitleMessage{
+		{Role: MessageRoleUser, Content: messageContent},
+	})
 	if err != nil {
 		a.PB.Logger().Error("failed to generate title", "error", err, "threadID", threadID)
 		return
@@ -614,34 +719,7 @@ func (a *Application) generateAndSetThreadTitle(userID, threadID, messageContent
 		success = true
 		return
 	}
-	if len(chat.Choices) == 0 {
-		a.PB.Logger().Error("no choices returned from AI client, cannot set thread title", "threadID", threadID)
-		return
-	}
 
-	//var generatedTitle GeneratedTitle
-	//err = json.Unmarshal([]byte(chat.Choices[0].Message.Content), &generatedTitle)
-	//if err != nil {
-	//	a.PB.Logger().Error("failed to unmarshal generated title", "error", err, "threadID", threadID)
-	//	return
-	//}
-	//err = validate.Struct(&generatedTitle)
-	//if err != nil {
-	//	a.PB.Logger().Error("generated title validation failed", "error", err, "threadID", threadID)
-	//	return
-	//}
-
-	title := chat.Choices[0].Message.Content
-	// Limit the title to 250 characters
-	if len(title) > 250 {
-		title = title[:250]
-	}
-	// If the title is surrounded by quotes, remove them, ', ", or `
-	if len(title) > 1 && ((title[0] == '"' && title[len(title)-1] == '"') ||
-		(title[0] == '\'' && title[len(title)-1] == '\'') ||
-		(title[0] == '`' && title[len(title)-1] == '`')) {
-		title = title[1 : len(title)-1]
-	}
 	threadRecord.Set("title", title)
 	threadRecord.Set("title_generation_status", ThreadTitleGenerationStatusCompleted)
 	err = a.PB.Save(threadRecord)
@@ -650,6 +728,9 @@ func (a *Application) generateAndSetThreadTitle(userID, threadID, messageContent
 		return
 	}
 	success = true
+	a.Webhooks.Dispatch(userID, WebhookEventThreadTitleGenerated, WebhookThreadData{
+		Thread: WebhookThread{ID: threadRecord.Id, Title: title},
+	})
 	endTime := time.Now()
 	a.PB.Logger().Info("successfully set thread title", "threadID", threadID, "title", title, "timeTakenMs", endTime.Sub(startTime).Milliseconds())
 }
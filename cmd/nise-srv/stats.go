@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/openai/openai-go"
+	"math"
+	"time"
+)
+
+// StreamStats are the timings of a stream, saved in the message meta and sent as a stats chunk at the end of the
+// stream, so that clients can show how long the model thought.
+type StreamStats struct {
+	// TimeToFirstTokenMs is the time from the start of the stream to its first reasoning, content or refusal,
+	// retries and fallbacks included
+	TimeToFirstTokenMs int64 `json:"timeToFirstTokenMs,omitempty"`
+	// ReasoningMs is the time from the first reasoning to the first content, or to the end without content
+	ReasoningMs int64 `json:"reasoningMs,omitempty"`
+	TotalMs     int64 `json:"totalMs"`
+	// TokensPerSecond is the rate of the completion tokens from the first token to the end
+	TokensPerSecond float64 `json:"tokensPerSecond,omitempty"`
+	// ReasoningTokens is the part of the completion tokens spent reasoning, as reported by the provider
+	ReasoningTokens int64 `json:"reasoningTokens,omitempty"`
+}
+
+// stats computes the stats of a stream finished at the given time, from the times of its first chunks and the usage
+// of the response.
+func (s *ActiveStream) stats(finished time.Time, usage openai.CompletionUsage) StreamStats {
+	s.chunkMutex.Lock()
+	defer s.chunkMutex.Unlock()
+
+	stats := StreamStats{
+		TotalMs:         finished.Sub(s.started).Milliseconds(),
+		ReasoningTokens: usage.CompletionTokensDetails.ReasoningTokens,
+	}
+	if !s.firstToken.IsZero() {
+		stats.TimeToFirstTokenMs = s.firstToken.Sub(s.started).Milliseconds()
+		if generation := finished.Sub(s.firstToken).Seconds(); generation > 0 && usage.CompletionTokens > 0 {
+			stats.TokensPerSecond = math.Round(float64(usage.CompletionTokens)/generation*10) / 10
+		}
+	}
+	if !s.firstReasoning.IsZero() {
+		reasoningEnd := s.firstContent
+		if reasoningEnd.Before(s.firstReasoning) {
+			reasoningEnd = finished
+		}
+		stats.ReasoningMs = reasoningEnd.Sub(s.firstReasoning).Milliseconds()
+	}
+	return stats
+}
@@ -8,43 +8,74 @@ import (
 	"github.com/openai/openai-go/option"
 	"github.com/openai/openai-go/packages/ssestream"
 	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"net/http"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 )
 
-type StreamSubscriber struct {
-	ID      string
-	Channel chan Chunk
+// StreamCursor reads the chunk log of an ActiveStream from its own position, so a slow reader catches up
+// on everything it missed instead of losing chunks, and never holds up the producer.
+type StreamCursor struct {
+	stream *ActiveStream
+	next   int // index of the next chunk to read in the stream's log
 }
 
 type MessageParts struct {
 	Content   string `json:"content"`
 	Reasoning string `json:"reasoning,omitempty"` // Optional reasoning field
 	// What else do we need?
-	Error string `json:"error,omitempty"` // Optional error field
+	Error     string    `json:"error,omitempty"`     // Optional error field
+	ErrorCode ErrorCode `json:"errorCode,omitempty"` // Kind of the error, set along with it
+	Refusal   string    `json:"refusal,omitempty"`   // Why the model refused to answer, for refused messages
+	// Structured is the parsed content of responses with a JSON response format, when it matches the schema
+	Structured json.RawMessage `json:"structured,omitempty"`
+	// SchemaErrors are the violations of the JSON schema when the content doesn't match it
+	SchemaErrors []string `json:"schemaErrors,omitempty"`
 }
 
 type Chunk struct {
+	// ID is the 1-based sequence number of the chunk within its stream, sent as the SSE event ID.
+	// Zero for chunks that are not part of a live stream, e.g. ones rebuilt from a stored message.
+	ID      int       `json:"i,omitempty"`
 	Type    ChunkType `json:"t"`
 	Content string    `json:"c"`
+	// Error is set on error chunks
+	Error *StreamError `json:"e,omitempty"`
 }
 
+// completedStreamRetention is how long a finished stream is kept in memory so that clients
+// reconnecting with a Last-Event-ID can still resume from its chunk log.
+const completedStreamRetention = 1 * time.Minute
+
 type ActiveStream struct {
-	MessageID  string
+	MessageID string
+	// UserID is the owner of the thread, ThreadID and AuthorID tell which members can watch and who asked for it
 	UserID     string
+	ThreadID   string
+	AuthorID   string
 	Transcript []openai.ChatCompletionMessageParamUnion
 	Model      ResponseModel
 
+	// chunks is an append-only log, entries are never modified once added
 	chunks         []Chunk
 	builtContent   strings.Builder
 	builtReasoning strings.Builder
 	chunkMutex     sync.Mutex
-
-	subscribers     map[string]*StreamSubscriber
-	subscriberMutex sync.Mutex
+	// updated is closed and replaced whenever a chunk is added or the stream completes, waking up readers
+	updated chan struct{}
+	// started is when the stream was created, and the others when the first chunk of their kind was added
+	started        time.Time
+	firstToken     time.Time
+	firstReasoning time.Time
+	firstContent   time.Time
 
 	complete bool
+	// finished is closed once the stream has completed and the message record has been saved
+	finished chan struct{}
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -60,11 +91,11 @@ func NewActiveStream(messageID, userID string, transcript []openai.ChatCompletio
 
 		chunks:     []Chunk{},
 		chunkMutex: sync.Mutex{},
-
-		subscribers:     make(map[string]*StreamSubscriber),
-		subscriberMutex: sync.Mutex{},
+		updated:    make(chan struct{}),
+		started:    time.Now(),
 
 		complete: false,
+		finished: make(chan struct{}),
 
 		ctx:    ctx,
 		cancel: cancel,
@@ -74,13 +105,20 @@ func NewActiveStream(messageID, userID string, transcript []openai.ChatCompletio
 type StreamService struct {
 	PB            *pocketbase.PocketBase
 	aiClient      openai.Client
+	webhooks      *WebhookService
+	events        *ThreadEventBus
 	activeStreams sync.Map // map[string]*ActiveStream
+
+	// MockProviderEnabled serves the mock/ models with the in process MockProvider, for development and tests
+	MockProviderEnabled bool
 }
 
-func NewStreamService(app *pocketbase.PocketBase, aiClient openai.Client) *StreamService {
+func NewStreamService(app *pocketbase.PocketBase, aiClient openai.Client, webhooks *WebhookService, events *ThreadEventBus) *StreamService {
 	return &StreamService{
 		PB:            app,
 		aiClient:      aiClient,
+		webhooks:      webhooks,
+		events:        events,
 		activeStreams: sync.Map{},
 	}
 }
@@ -90,7 +128,8 @@ func (s *StreamService) StartStream(messageID, userID string, model ResponseMode
 
 	var transcript []openai.ChatCompletionMessageParamUnion
 
-	transcript, err := getThreadTranscriptUntilParent(s.PB, userID, messageID)
+	includeRefusals := model.Options != nil && model.Options.IncludeRefusals
+	transcript, err := getThreadTranscriptUntilParent(s.PB, userID, messageID, includeRefusals)
 	if err != nil {
 		s.PB.Logger().Error("Failed to get thread transcript", "messageID", messageID, "userID", userID, "error", err)
 		return nil, fmt.Errorf("failed to get thread transcript: %w", err)
@@ -103,6 +142,8 @@ func (s *StreamService) StartStream(messageID, userID string, model ResponseMode
 		s.PB.Logger().Error("Failed to find message record", "messageID", messageID, "error", err)
 		return nil, fmt.Errorf("failed to find message record: %w", err)
 	}
+	stream.ThreadID = messageRecord.GetString("parent_thread_id")
+	stream.AuthorID = messageRecord.GetString("author_user_id")
 	messageRecord.Set("status", MessageStatusGenerating)
 	if err := s.PB.Save(messageRecord); err != nil {
 		s.PB.Logger().Error("Failed to save message record", "messageID", messageID, "error", err)
@@ -110,13 +151,20 @@ func (s *StreamService) StartStream(messageID, userID string, model ResponseMode
 	}
 
 	s.activeStreams.Store(messageID, stream)
+	s.events.Publish(ThreadEvent{
+		Type:      ThreadEventStreamStarted,
+		ThreadID:  stream.ThreadID,
+		MessageID: messageID,
+		UserID:    stream.AuthorID,
+	})
 
 	go s.consumeStream(stream)
 
 	return stream, nil
 }
 
-// GetActiveStream retrieves an active stream by its message ID.
+// GetActiveStream retrieves an active stream by its message ID, for the owner or any other user with access to
+// its thread.
 func (s *StreamService) GetActiveStream(messageID, userID string) (*ActiveStream, bool, error) {
 	stream, ok := s.activeStreams.Load(messageID)
 	if !ok {
@@ -128,43 +176,113 @@ func (s *StreamService) GetActiveStream(messageID, userID string) (*ActiveStream
 		return nil, false, fmt.Errorf("active stream for message ID %s is not of type *ActiveStream", messageID)
 	}
 
-	// Check if the user ID matches
+	// Check if the user can access the thread of the stream
 	if activeStream.UserID != userID {
-		return nil, false, fmt.Errorf("active stream for message ID %s does not belong to user ID %s", messageID, userID)
+		if _, err := findThreadAccess(s.PB, activeStream.ThreadID, userID); err != nil {
+			return nil, false, fmt.Errorf("active stream for message ID %s is not accessible to user ID %s: %w", messageID, userID, err)
+		}
 	}
 
 	return activeStream, true, nil
 }
 
-// TODO: Track reasoning time
+// CancelStream stops the generation of an active stream, the message is saved with what was generated so far.
+// Only the owner and contributors of the thread can cancel it.
+func (s *StreamService) CancelStream(messageID, userID string) (bool, error) {
+	stream, ok, err := s.GetActiveStream(messageID, userID)
+	if err != nil || !ok {
+		return false, err
+	}
+	if stream.UserID != userID {
+		access, err := findThreadAccess(s.PB, stream.ThreadID, userID)
+		if err != nil {
+			return false, err
+		}
+		if !access.Role.CanWrite() {
+			return false, fmt.Errorf("user ID %s can't cancel the stream for message ID %s: %w", userID, messageID, errThreadAccessDenied)
+		}
+	}
+	s.PB.Logger().Debug("Cancelling stream", "messageID", messageID, "userID", userID)
+	stream.cancel()
+	return true, nil
+}
+
+// dispatchMessageWebhook notifies the user's webhooks that a message has finished generating, cancelled
+// messages are not reported.
+func (s *StreamService) dispatchMessageWebhook(userID string, messageRecord *core.Record) {
+	var event WebhookEvent
+	switch MessageStatus(messageRecord.GetString("status")) {
+	case MessageStatusCompleted:
+		event = WebhookEventMessageCompleted
+	case MessageStatusFailed:
+		event = WebhookEventMessageFailed
+	case MessageStatusRefused:
+		event = WebhookEventMessageRefused
+	default:
+		return
+	}
+
+	message, err := messageFromRecord(messageRecord)
+	if err != nil {
+		s.PB.Logger().Error("Failed to build webhook payload for message", "error", err, "messageID", messageRecord.Id)
+		return
+	}
+	s.webhooks.Dispatch(userID, event, WebhookMessageData{Message: message})
+}
 
 func (s *StreamService) consumeStream(stream *ActiveStream) {
 	startTime := time.Now()
 	var streamErr error
 	var finishReason FinishReason
 	var acc openai.ChatCompletionAccumulator
+	var attemptHistory []StreamAttempt
+	var answeredModel string
+	var skippedModels []SkippedModel
 
+	defer close(stream.finished)
 	defer func() {
 		model := stream.Model
-		// If error occurred, send a finish reason chunk
+		// Responses with a JSON response format fail when the content doesn't match the schema
+		var structured json.RawMessage
+		if streamErr == nil && model.Options != nil && len(acc.ChatCompletion.Choices) > 0 &&
+			acc.ChatCompletion.Choices[0].Message.Refusal == "" && finishReason != FinishReasonContentFilter {
+			structured, streamErr = structuredOutput(model.Options.ResponseFormat, acc.ChatCompletion.Choices[0].Message.Content)
+		}
+		// If error occurred, send an error chunk before the finish reason chunk
+		var classifiedErr StreamError
 		if streamErr != nil {
-			s.PB.Logger().Error("Stream error occurred", "messageID", stream.MessageID, "error", streamErr)
-			stream.addChunk("Error: "+streamErr.Error(), ChunkTypeError)
+			classifiedErr = classifyStreamError(streamErr)
+		}
+		if streamErr != nil && finishReason != FinishReasonCancelled {
+			s.PB.Logger().Error("Stream error occurred", "messageID", stream.MessageID, "error", streamErr, "code", classifiedErr.Code)
+			stream.addErrorChunk(classifiedErr)
 			finishReason = FinishReasonError
 		}
 		if finishReason == "" {
 			finishReason = FinishReasonUnknown
 		}
+		refusal := ""
+		if len(acc.ChatCompletion.Choices) > 0 {
+			refusal = acc.ChatCompletion.Choices[0].Message.Refusal
+		}
+		if streamErr == nil && refusal == "" && finishReason == FinishReasonContentFilter {
+			// Content filters stop the response without saying why, the refusal part tells the user what happened
+			refusal = contentFilterRefusal
+			stream.addChunk(refusal, ChunkTypeRefusal)
+		}
 		stream.addChunk(string(finishReason), ChunkTypeFinishReason)
 
-		s.activeStreams.Delete(stream.MessageID)
+		stats := stream.stats(time.Now(), acc.Usage)
+		if statsJSON, err := json.Marshal(stats); err == nil {
+			stream.addChunk(string(statsJSON), ChunkTypeStats)
+		}
+
+		time.AfterFunc(completedStreamRetention, func() {
+			s.activeStreams.CompareAndDelete(stream.MessageID, stream)
+		})
 		stream.cancel()
 
-		stream.subscriberMutex.Lock()
-		for _, subscriber := range stream.subscribers {
-			close(subscriber.Channel)
-		}
-		stream.subscriberMutex.Unlock()
+		stream.markComplete()
 		s.PB.Logger().Debug("Stream consumed and cleaned up", "messageID", stream.MessageID, "duration", time.Since(startTime))
 
 		// Always update the message in the database with error if any
@@ -188,24 +306,34 @@ func (s *StreamService) consumeStream(stream *ActiveStream) {
 		}
 		message.Set("content", content)
 
-		errStr := ""
+		messageParts := MessageParts{Content: content, Structured: structured}
 		if streamErr != nil {
-			errStr = streamErr.Error()
+			messageParts.Error = classifiedErr.Message
+			messageParts.ErrorCode = classifiedErr.Code
+			messageParts.SchemaErrors = classifiedErr.Details
 		}
-		messageParts := MessageParts{Content: content, Error: errStr}
 		messageMeta := MessageMeta{
-			Edited:       false,
-			Usage:        acc.Usage,
-			FinishReason: finishReason,
-			ModelOptions: model.Options,
+			Edited:        false,
+			Usage:         acc.Usage,
+			FinishReason:  finishReason,
+			ModelOptions:  model.Options,
+			Attempts:      attemptHistory,
+			AnsweredModel: answeredModel,
+			SkippedModels: skippedModels,
+			Stats:         stats,
 		}
 		// Add reasoning if it exists
 		reasoning := stream.builtReasoning.String()
 		if reasoning != "" {
 			messageParts.Reasoning = reasoning
 		}
-		if streamErr != nil {
+		if finishReason == FinishReasonCancelled {
+			message.Set("status", MessageStatusCancelled)
+		} else if streamErr != nil {
 			message.Set("status", MessageStatusFailed)
+		} else if refusal != "" {
+			messageParts.Refusal = refusal
+			message.Set("status", MessageStatusRefused)
 		} else {
 			message.Set("status", MessageStatusCompleted)
 		}
@@ -218,25 +346,42 @@ func (s *StreamService) consumeStream(stream *ActiveStream) {
 			return
 		}
 
+		s.dispatchMessageWebhook(stream.UserID, message)
+		s.events.Publish(ThreadEvent{
+			Type:      ThreadEventStreamFinished,
+			ThreadID:  stream.ThreadID,
+			MessageID: stream.MessageID,
+			UserID:    stream.AuthorID,
+			Status:    MessageStatus(message.GetString("status")),
+		})
+
 		s.PB.Logger().Debug("Stream consume finished", "messageID", stream.MessageID)
 	}()
 
-	// Get user's api key from the database
-	apiKeyRecord, err := s.PB.FindFirstRecordByData("api_keys", "owner_user_id", stream.UserID)
-	if err != nil {
-		s.PB.Logger().Error("Failed to find API key record", "userID", stream.UserID, "error", err)
-		stream.addChunk("Error: Failed to find API key record", ChunkTypeError)
-		streamErr = fmt.Errorf("no API key found for user %s: %w", stream.UserID, err)
-		finishReason = FinishReasonError
-		return
+	// Get user's api key from the database, the member who asked for the response pays for it rather than the owner
+	apiKeyUserID := stream.UserID
+	if stream.AuthorID != "" {
+		apiKeyUserID = stream.AuthorID
 	}
-	key := apiKeyRecord.GetString("key")
-	if key == "" {
-		s.PB.Logger().Error("API key not found or empty", "userID", stream.UserID)
-		stream.addChunk("Error: API key not found or empty", ChunkTypeError)
-		streamErr = fmt.Errorf("API key not found or empty")
-		finishReason = FinishReasonError
-		return
+	var key string
+	if s.MockProviderEnabled && isMockModel(stream.Model.ProviderID) {
+		// The mock provider doesn't check API keys
+		key = "mock"
+	} else {
+		apiKeyRecord, err := s.PB.FindFirstRecordByData("api_keys", "owner_user_id", apiKeyUserID)
+		if err != nil {
+			s.PB.Logger().Error("Failed to find API key record", "userID", apiKeyUserID, "error", err)
+			streamErr = fmt.Errorf("%w found for user %s: %w", errNoAPIKey, apiKeyUserID, err)
+			finishReason = FinishReasonError
+			return
+		}
+		key = apiKeyRecord.GetString("key")
+		if key == "" {
+			s.PB.Logger().Error("API key not found or empty", "userID", apiKeyUserID)
+			streamErr = fmt.Errorf("%w found for user %s: the key is empty", errNoAPIKey, apiKeyUserID)
+			finishReason = FinishReasonError
+			return
+		}
 	}
 
 	options := []option.RequestOption{
@@ -262,11 +407,93 @@ func (s *StreamService) consumeStream(stream *ActiveStream) {
 			}
 			options = append(options, reasoningOption)
 		}
+
+		options = append(options, stream.Model.Options.generationRequestOptions()...)
+	}
+
+	// Retries are handled here rather than by the client, so that subscribers are told about them
+	options = append(options, option.WithMaxRetries(0))
+
+	chain, err := modelChain(s.PB, apiKeyUserID, stream.Model.ProviderID)
+	if err != nil {
+		s.PB.Logger().Error("Failed to find model fallbacks, using the requested model only", "error", err, "messageID", stream.MessageID)
+	}
+	for i, modelID := range chain {
+		if i > 0 {
+			s.PB.Logger().Warn("Falling back to the next model", "messageID", stream.MessageID, "model", modelID, "skipped", chain[i-1])
+			stream.addChunk(modelID, ChunkTypeFallback)
+		}
+		var emitted bool
+		finishReason, emitted, streamErr = s.streamWithRetries(stream, modelID, options, &acc, &attemptHistory)
+		if streamErr == nil || emitted {
+			answeredModel = modelID
+			break
+		}
+		if finishReason == FinishReasonCancelled {
+			break
+		}
+		_, statusCode, _ := retryableStreamError(streamErr)
+		skippedModels = append(skippedModels, SkippedModel{Model: modelID, StatusCode: statusCode, Reason: streamErr.Error()})
+	}
+
+	s.PB.Logger().Debug("Stream completed", "messageID", stream.MessageID)
+}
+
+// streamWithRetries streams the response of a model, retrying transient upstream failures with backoff as long as
+// no content was emitted. The failed attempts are appended to attemptHistory.
+func (s *StreamService) streamWithRetries(stream *ActiveStream, modelID string, options []option.RequestOption, acc *openai.ChatCompletionAccumulator, attemptHistory *[]StreamAttempt) (FinishReason, bool, error) {
+	for attempt := 1; ; attempt++ {
+		started := types.NowDateTime()
+		*acc = openai.ChatCompletionAccumulator{}
+		finishReason, emitted, streamErr := s.streamAttempt(stream, modelID, options, acc)
+		// Once content was emitted, retrying would duplicate it for the subscribers
+		if streamErr == nil || finishReason == FinishReasonCancelled || emitted {
+			return finishReason, emitted, streamErr
+		}
+
+		retryable, statusCode, retryAfter := retryableStreamError(streamErr)
+		failedAttempt := StreamAttempt{Attempt: attempt, Model: modelID, StatusCode: statusCode, Error: streamErr.Error(), Started: started}
+		delay, ok := streamRetryDelay(attempt, retryAfter)
+		if !retryable || !ok || attempt >= streamMaxAttempts {
+			*attemptHistory = append(*attemptHistory, failedAttempt)
+			return finishReason, emitted, streamErr
+		}
+		failedAttempt.RetryDelayMs = delay.Milliseconds()
+		*attemptHistory = append(*attemptHistory, failedAttempt)
+
+		retryInfo, err := json.Marshal(failedAttempt)
+		if err != nil {
+			s.PB.Logger().Error("Failed to marshal stream attempt", "error", err, "messageID", stream.MessageID)
+		}
+		stream.addChunk(string(retryInfo), ChunkTypeRetry)
+		s.PB.Logger().Warn("Retrying stream after upstream error", "messageID", stream.MessageID, "model", modelID, "attempt", attempt, "statusCode", statusCode, "delay", delay, "error", streamErr)
+
+		retryTimer := time.NewTimer(delay)
+		select {
+		case <-stream.ctx.Done():
+			retryTimer.Stop()
+			s.PB.Logger().Debug("Stream context cancelled while waiting to retry", "messageID", stream.MessageID)
+			stream.addErrorChunk(StreamError{Code: ErrorCodeCancelled, Message: errStreamCancelled.Error()})
+			return FinishReasonCancelled, false, errStreamCancelled
+		case <-retryTimer.C:
+		}
+	}
+}
+
+// streamAttempt makes a single request to the upstream provider and adds the chunks of its response to the stream.
+// It reports whether content or reasoning was emitted, after which a failed request can't be retried.
+func (s *StreamService) streamAttempt(stream *ActiveStream, modelID string, options []option.RequestOption, acc *openai.ChatCompletionAccumulator) (FinishReason, bool, error) {
+	var finishReason FinishReason
+	var streamErr error
+	emitted := false
+
+	if s.MockProviderEnabled && isMockModel(modelID) {
+		options = append(slices.Clip(options), option.WithHTTPClient(&http.Client{Transport: MockProvider{}}))
 	}
 
 	aiStream := s.aiClient.Chat.Completions.NewStreaming(stream.ctx, openai.ChatCompletionNewParams{
 		Messages: stream.Transcript,
-		Model:    stream.Model.ProviderID,
+		Model:    modelID,
 	}, options...)
 	defer func(aiStream *ssestream.Stream[openai.ChatCompletionChunk]) {
 		err := aiStream.Close()
@@ -277,8 +504,6 @@ func (s *StreamService) consumeStream(stream *ActiveStream) {
 		}
 	}(aiStream)
 
-	acc = openai.ChatCompletionAccumulator{}
-
 	done := false
 
 	for {
@@ -289,15 +514,20 @@ func (s *StreamService) consumeStream(stream *ActiveStream) {
 		select {
 		case <-stream.ctx.Done():
 			s.PB.Logger().Debug("Stream context cancelled", "messageID", stream.MessageID)
-			stream.addChunk("", ChunkTypeError)
-			streamErr = fmt.Errorf("stream cancelled")
+			stream.addErrorChunk(StreamError{Code: ErrorCodeCancelled, Message: errStreamCancelled.Error()})
+			streamErr = errStreamCancelled
 			done = true
 			finishReason = FinishReasonCancelled
 			break
 		default:
 			if !aiStream.Next() {
-				if err := aiStream.Err(); err != nil {
-					stream.addChunk("Error: "+err.Error(), ChunkTypeError)
+				if stream.ctx.Err() != nil {
+					// Cancelling the context aborts the upstream request, so it surfaces here as a stream error
+					s.PB.Logger().Debug("Stream context cancelled", "messageID", stream.MessageID)
+					stream.addErrorChunk(StreamError{Code: ErrorCodeCancelled, Message: errStreamCancelled.Error()})
+					streamErr = errStreamCancelled
+					finishReason = FinishReasonCancelled
+				} else if err := aiStream.Err(); err != nil {
 					streamErr = fmt.Errorf("stream error: %w", err)
 					s.PB.Logger().Error("Stream error", "error", err)
 					finishReason = FinishReasonError
@@ -320,8 +550,8 @@ func (s *StreamService) consumeStream(stream *ActiveStream) {
 
 			acc.AddChunk(chunk)
 			if content, ok := acc.JustFinishedContent(); ok {
+				// The content was already streamed delta by delta below
 				s.PB.Logger().Debug("Content stream finished", "content", content)
-				stream.addChunk(content, ChunkTypeContent)
 			}
 			if tool, ok := acc.JustFinishedToolCall(); ok {
 				s.PB.Logger().Debug("Tool call stream finished", "id", tool.ID, "index", tool.Index, "name", tool.Name, "arguments", tool.Arguments)
@@ -329,7 +559,6 @@ func (s *StreamService) consumeStream(stream *ActiveStream) {
 			}
 			if refusal, ok := acc.JustFinishedRefusal(); ok {
 				s.PB.Logger().Debug("Refusal stream finished", "refusal", refusal)
-				stream.addChunk(refusal, ChunkTypeError)
 			}
 
 			if len(chunk.Choices) > 0 {
@@ -341,21 +570,24 @@ func (s *StreamService) consumeStream(stream *ActiveStream) {
 					err := json.Unmarshal([]byte(reasoningValue), &reasoningString)
 					if err == nil {
 						stream.addChunk(reasoningString, ChunkTypeReasoning)
+						emitted = true
 					}
 				}
 				content := chunk.Choices[0].Delta.Content
 				if content != "" {
 					stream.addChunk(content, ChunkTypeContent)
+					emitted = true
+				}
+				refusal := chunk.Choices[0].Delta.Refusal
+				if refusal != "" {
+					stream.addChunk(refusal, ChunkTypeRefusal)
+					emitted = true
 				}
 			}
 		}
 	}
 
-	stream.chunkMutex.Lock()
-	stream.complete = true
-	stream.chunkMutex.Unlock()
-
-	s.PB.Logger().Debug("Stream completed", "messageID", stream.MessageID)
+	return finishReason, emitted, streamErr
 }
 
 type ChunkType int
@@ -366,6 +598,18 @@ const (
 	ChunkTypeReasoning
 	ChunkTypeError
 	ChunkTypeFinishReason
+	// ChunkTypeRetry tells that the upstream request failed before any content and is retried, with the
+	// failed StreamAttempt as JSON content
+	ChunkTypeRetry
+	// ChunkTypeFallback tells that the previous model of the fallback chain failed, with the next model as content
+	ChunkTypeFallback
+	// ChunkTypeRefusal is a part of the reason the model refused to answer
+	ChunkTypeRefusal
+	// ChunkTypeStats is the last chunk of a stream, with its StreamStats as JSON content
+	ChunkTypeStats
+	// ChunkTypeReset tells a client resuming from a chunk ID to discard the parts it received so far, sent before
+	// replaying the whole saved message once the stream is no longer held in memory
+	ChunkTypeReset
 )
 
 type FinishReason string
@@ -378,86 +622,118 @@ const (
 	FinishReasonFunctionCall FinishReason = "function_call"
 	FinishReasonError        FinishReason = "error"
 	FinishReasonCancelled    FinishReason = "cancelled"
+	// FinishReasonContentFilter is the finish reason of responses stopped by the content filter of the provider
+	FinishReasonContentFilter FinishReason = "content_filter"
 )
 
+// contentFilterRefusal is the refusal of responses stopped by a content filter without a refusal from the model.
+const contentFilterRefusal = "The response was blocked by the content filter of the provider."
+
 func (fr FinishReason) String() string {
 	return string(fr)
 }
 
 func (s *ActiveStream) addChunk(chunkContent string, chunkType ChunkType) {
-	s.chunkMutex.Lock()
-	chunk := Chunk{Type: chunkType, Content: chunkContent}
+	s.appendChunk(Chunk{Type: chunkType, Content: chunkContent})
+}
 
-	s.chunks = append(s.chunks, chunk)
-	if chunkType == ChunkTypeContent {
-		s.builtContent.WriteString(chunkContent)
+// addErrorChunk adds an error chunk with the structured error, and its message as content for clients that only read
+// the content. Cancellations have no content, as they aren't shown as errors.
+func (s *ActiveStream) addErrorChunk(streamErr StreamError) {
+	s.appendChunk(errorChunk(streamErr))
+}
+
+func errorChunk(streamErr StreamError) Chunk {
+	chunk := Chunk{Type: ChunkTypeError, Error: &streamErr}
+	if streamErr.Code != ErrorCodeCancelled {
+		chunk.Content = "Error: " + streamErr.Message
 	}
-	if chunkType == ChunkTypeReasoning {
-		s.builtReasoning.WriteString(chunkContent)
+	return chunk
+}
+
+func (s *ActiveStream) appendChunk(chunk Chunk) {
+	s.chunkMutex.Lock()
+	defer s.chunkMutex.Unlock()
+
+	if s.complete {
+		return
 	}
-	s.chunkMutex.Unlock()
 
-	s.subscriberMutex.Lock()
-	for _, subscriber := range s.subscribers {
-		select {
-		case subscriber.Channel <- chunk:
-		default:
-			// If the channel is full, we can skip sending the chunk
-			// or handle it as needed (e.g., log a warning)
+	chunk.ID = len(s.chunks) + 1
+	s.chunks = append(s.chunks, chunk)
+	if chunk.Type == ChunkTypeContent {
+		s.builtContent.WriteString(chunk.Content)
+		if s.firstContent.IsZero() {
+			s.firstContent = time.Now()
 		}
 	}
-	s.subscriberMutex.Unlock()
-}
+	if chunk.Type == ChunkTypeReasoning {
+		s.builtReasoning.WriteString(chunk.Content)
+		if s.firstReasoning.IsZero() {
+			s.firstReasoning = time.Now()
+		}
+	}
+	if s.firstToken.IsZero() &&
+		(chunk.Type == ChunkTypeContent || chunk.Type == ChunkTypeReasoning || chunk.Type == ChunkTypeRefusal) {
+		s.firstToken = time.Now()
+	}
 
-func (s *ActiveStream) Subscribe(subscriberID string) <-chan Chunk {
-	s.subscriberMutex.Lock()
-	defer s.subscriberMutex.Unlock()
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
 
-	subscriberChan := make(chan Chunk, 100)
+// markComplete marks the stream as complete, no more chunks are accepted after this and readers are woken up.
+func (s *ActiveStream) markComplete() {
+	s.chunkMutex.Lock()
+	defer s.chunkMutex.Unlock()
 
-	subscriber := &StreamSubscriber{
-		ID:      subscriberID,
-		Channel: subscriberChan,
+	if s.complete {
+		return
 	}
+	s.complete = true
+	close(s.updated)
+}
 
-	// Return historical chunks when subscribing itself
-	s.subscribers[subscriberID] = subscriber
-	go func() {
-		chunks := make([]Chunk, 0)
-		s.chunkMutex.Lock()
-		if s.builtReasoning.Len() > 0 {
-			chunks = append(chunks, Chunk{Type: ChunkTypeReasoning, Content: s.builtReasoning.String()})
-		}
-		if s.builtContent.Len() > 0 {
-			chunks = append(chunks, Chunk{Type: ChunkTypeContent, Content: s.builtContent.String()})
-		}
-		completed := s.complete
-		s.chunkMutex.Unlock()
-
-		for _, chunk := range chunks {
-			select {
-			case subscriberChan <- chunk:
-			default:
-				// If the channel is full, we can skip sending the chunk
-				// or handle it as needed (e.g., log a warning)
-				return
-			}
-		}
+// Finished returns a channel that is closed once the stream has completed and its message has been saved.
+func (s *ActiveStream) Finished() <-chan struct{} {
+	return s.finished
+}
 
-		if completed {
-			close(subscriberChan)
-		}
-	}()
+// Subscribe returns a cursor positioned right after lastChunkID. A lastChunkID of 0 reads the whole stream.
+func (s *ActiveStream) Subscribe(lastChunkID int) *StreamCursor {
+	s.chunkMutex.Lock()
+	defer s.chunkMutex.Unlock()
 
-	return subscriberChan
+	next := min(max(lastChunkID, 0), len(s.chunks))
+	return &StreamCursor{stream: s, next: next}
 }
 
-func (s *ActiveStream) Unsubscribe(subscriberID string) {
-	s.subscriberMutex.Lock()
-	defer s.subscriberMutex.Unlock()
+// Read returns the chunks added since the last read, with consecutive content and reasoning chunks
+// coalesced. done reports whether the stream has completed and everything has been read, otherwise
+// wait is closed as soon as there is something new to read.
+func (c *StreamCursor) Read() (chunks []Chunk, done bool, wait <-chan struct{}) {
+	c.stream.chunkMutex.Lock()
+	defer c.stream.chunkMutex.Unlock()
+
+	chunks = coalesceChunks(c.stream.chunks[c.next:])
+	c.next = len(c.stream.chunks)
 
-	if subscriber, ok := s.subscribers[subscriberID]; ok {
-		close(subscriber.Channel)
-		delete(s.subscribers, subscriberID)
+	return chunks, c.stream.complete, c.stream.updated
+}
+
+// coalesceChunks merges consecutive content and reasoning chunks into one, keeping the ID of the
+// last merged chunk so a client resuming from it continues right after the merged text.
+func coalesceChunks(chunks []Chunk) []Chunk {
+	coalesced := make([]Chunk, 0, len(chunks))
+	for _, chunk := range chunks {
+		last := len(coalesced) - 1
+		if last >= 0 && coalesced[last].Type == chunk.Type &&
+			(chunk.Type == ChunkTypeContent || chunk.Type == ChunkTypeReasoning) {
+			coalesced[last].ID = chunk.ID
+			coalesced[last].Content += chunk.Content
+			continue
+		}
+		coalesced = append(coalesced, chunk)
 	}
+	return coalesced
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pocketbase/pocketbase/core"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// MaxTags is the maximum number of tags on a thread or a message.
+const MaxTags = 20
+
+type AddTagsInput struct {
+	Tags []string `json:"tags" validate:"required,min=1,max=20,dive,required,max=50"`
+}
+
+// normalizeTag lowercases and trims a tag, returning false for tags that can't be used in search queries.
+func normalizeTag(tag string) (string, bool) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" || strings.ContainsFunc(tag, func(r rune) bool { return unicode.IsSpace(r) || r == ':' || r == '"' }) {
+		return "", false
+	}
+	return tag, true
+}
+
+// findTaggableRecord finds a thread or message of the user by the ID in the request path, excluding trashed threads.
+func (a *Application) findTaggableRecord(e *core.RequestEvent, collection, pathParam string) (*core.Record, error) {
+	id := e.Request.PathValue(pathParam)
+	if len(id) != 26 {
+		return nil, fmt.Errorf("invalid ID length: %q", id)
+	}
+	record, err := a.PB.FindRecordById(collection, id)
+	if err != nil {
+		return nil, err
+	}
+	if record.GetString("owner_user_id") != e.Auth.Id {
+		return nil, fmt.Errorf("user %s is not the owner of %s", e.Auth.Id, id)
+	}
+	if collection == "threads" && !record.GetDateTime("deleted_at").IsZero() {
+		return nil, fmt.Errorf("thread %s is in the trash", id)
+	}
+	return record, nil
+}
+
+// addTagsHandler returns a handler adding tags to a thread or message of the user.
+func (a *Application) addTagsHandler(collection, pathParam string) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		var input AddTagsInput
+		if err := json.NewDecoder(e.Request.Body).Decode(&input); err != nil {
+			a.PB.Logger().Warn("Failed to decode add tags request", "error", err)
+			return e.JSON(400, InvalidInputErrorData)
+		}
+		if err := validate.Struct(input); err != nil {
+			a.PB.Logger().Warn("Validation failed for add tags input", "error", err)
+			return e.JSON(400, InvalidInputErrorData)
+		}
+
+		record, err := a.findTaggableRecord(e, collection, pathParam)
+		if err != nil {
+			a.PB.Logger().Warn("Record to tag not found or user is not the owner", "error", err, "collection", collection, "userID", e.Auth.Id)
+			return e.JSON(404, map[string]string{"error": "Not found or access denied"})
+		}
+
+		tags := record.GetStringSlice("tags")
+		for _, tag := range input.Tags {
+			normalized, ok := normalizeTag(tag)
+			if !ok {
+				a.PB.Logger().Warn("Invalid tag", "tag", tag)
+				return e.JSON(400, map[string]string{"error": "Tags can't be empty or contain spaces, colons or quotes"})
+			}
+			if !slices.Contains(tags, normalized) {
+				tags = append(tags, normalized)
+			}
+		}
+		if len(tags) > MaxTags {
+			return e.JSON(400, map[string]string{"error": fmt.Sprintf("Too many tags, maximum is %d", MaxTags)})
+		}
+
+		record.Set("tags", tags)
+		if err := a.PB.Save(record); err != nil {
+			a.PB.Logger().Error("Failed to save tags", "error", err, "collection", collection, "id", record.Id)
+			return e.JSON(500, UnexpectedErrorData)
+		}
+
+		return e.JSON(200, map[string]any{"tags": tags})
+	}
+}
+
+// removeTagHandler returns a handler removing a tag from a thread or message of the user.
+func (a *Application) removeTagHandler(collection, pathParam string) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		tag, ok := normalizeTag(e.Request.PathValue("tag"))
+		if !ok {
+			a.PB.Logger().Warn("Invalid tag in request path", "tag", e.Request.PathValue("tag"))
+			return e.JSON(400, InvalidInputErrorData)
+		}
+
+		record, err := a.findTaggableRecord(e, collection, pathParam)
+		if err != nil {
+			a.PB.Logger().Warn("Record to untag not found or user is not the owner", "error", err, "collection", collection, "userID", e.Auth.Id)
+			return e.JSON(404, map[string]string{"error": "Not found or access denied"})
+		}
+
+		tags := slices.DeleteFunc(record.GetStringSlice("tags"), func(t string) bool { return t == tag })
+		record.Set("tags", tags)
+		if err := a.PB.Save(record); err != nil {
+			a.PB.Logger().Error("Failed to save tags", "error", err, "collection", collection, "id", record.Id)
+			return e.JSON(500, UnexpectedErrorData)
+		}
+
+		return e.JSON(200, map[string]any{"tags": tags})
+	}
+}
+
+// ThreadSearchQuery is a parsed search query. Filters are written as key:value and everything else is searched in
+// thread titles and message contents, e.g. "tag:infra model:anthropic/* before:2026-06 load balancer".
+type ThreadSearchQuery struct {
+	Text string
+	// Tags must all be on the thread or on one of its messages
+	Tags []string
+	// ModelPattern matches the model of a response in the thread, with * as a wildcard
+	ModelPattern string
+	// Before and After bound the creation date of the thread, excluding the given year, month or day itself
+	Before time.Time
+	After  time.Time
+}
+
+// parseSearchDate parses a year, month or day, returning the start of that period and the start of the next one.
+func parseSearchDate(value string) (time.Time, time.Time, error) {
+	if start, err := time.Parse(time.DateOnly, value); err == nil {
+		return start, start.AddDate(0, 0, 1), nil
+	}
+	if start, err := time.Parse("2006-01", value); err == nil {
+		return start, start.AddDate(0, 1, 0), nil
+	}
+	if start, err := time.Parse("2006", value); err == nil {
+		return start, start.AddDate(1, 0, 0), nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("invalid date %q, expected YYYY, YYYY-MM or YYYY-MM-DD", value)
+}
+
+// parseThreadSearchQuery splits a search query into its filters and free text.
+func parseThreadSearchQuery(query string) (ThreadSearchQuery, error) {
+	var parsed ThreadSearchQuery
+	var text []string
+	for _, term := range strings.Fields(query) {
+		key, value, found := strings.Cut(term, ":")
+		if !found || value == "" {
+			text = append(text, term)
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "tag":
+			tag, ok := normalizeTag(value)
+			if !ok {
+				return parsed, fmt.Errorf("invalid tag %q", value)
+			}
+			parsed.Tags = append(parsed.Tags, tag)
+		case "model":
+			parsed.ModelPattern = value
+		case "before":
+			start, _, err := parseSearchDate(value)
+			if err != nil {
+				return parsed, err
+			}
+			parsed.Before = start
+		case "after":
+			_, end, err := parseSearchDate(value)
+			if err != nil {
+				return parsed, err
+			}
+			parsed.After = end
+		default:
+			text = append(text, term)
+		}
+	}
+	parsed.Text = strings.Join(text, " ")
+	return parsed, nil
+}
+
+// likePattern converts a pattern with * wildcards to a LIKE pattern escaped with a backslash.
+func likePattern(pattern string) string {
+	pattern = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(pattern)
+	return strings.ReplaceAll(pattern, "*", "%")
+}
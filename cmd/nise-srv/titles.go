@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultTitlingModel is the model generating titles when no title settings pick another one
+	DefaultTitlingModel = "meta-llama/llama-3.1-8b-instruct"
+	// DefaultTitlingPrompt is the system prompt of title generation, the conversation is given in the user message
+	DefaultTitlingPrompt = "You are generating a title for a chat thread between a user and an AI assistant. You are given the conversation so far, sometimes only the first message of the user. Generate a concise and descriptive title for the thread based on it. Output only the title and nothing else."
+	// MaxTitleLength is the maximum number of characters of a generated title
+	MaxTitleLength = 250
+
+	// titleMessageMaxLength is the number of characters of each message given to the titling model, and
+	// titleConversationMaxLength the number of characters of the whole conversation
+	titleMessageMaxLength      = 2000
+	titleConversationMaxLength = 16000
+	titleGenerationTimeout     = 10 * time.Second
+)
+
+// defaultTitlingProvider routes title generation to fast providers.
+var defaultTitlingProvider = ProviderPreferences{
+	Order:             []string{"cerebras/fp16", "groq"},
+	AllowFallbacks:    openai.Ptr(true),
+	RequireParameters: true,
+	DataCollection:    "deny",
+}
+
+// TitleSettings are how thread titles are generated. The instance-wide settings are the title_settings record
+// without an owner, and the ones of users override them.
+type TitleSettings struct {
+	// Disabled turns off the titling of new threads, threads can still be retitled on demand
+	Disabled bool                 `json:"disabled"`
+	Model    string               `json:"model"`
+	Prompt   string               `json:"prompt"`
+	Provider *ProviderPreferences `json:"provider,omitempty"`
+}
+
+// Merge returns the settings with the ones set in other taking precedence. Titling stays disabled when either
+// disables it.
+func (s TitleSettings) Merge(other TitleSettings) TitleSettings {
+	merged := s
+	merged.Disabled = s.Disabled || other.Disabled
+	if other.Model != "" {
+		merged.Model = other.Model
+	}
+	if other.Prompt != "" {
+		merged.Prompt = other.Prompt
+	}
+	if other.Provider != nil {
+		merged.Provider = other.Provider
+	}
+	return merged
+}
+
+// findTitleSettings returns the title settings of the user, or the instance-wide ones for an empty userID.
+func (a *Application) findTitleSettings(userID string) (TitleSettings, error) {
+	record, err := a.PB.FindFirstRecordByData("title_settings", "owner_user_id", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TitleSettings{}, nil
+	}
+	if err != nil {
+		return TitleSettings{}, fmt.Errorf("failed to find title settings: %w", err)
+	}
+	settings := TitleSettings{
+		Disabled: record.GetBool("disabled"),
+		Model:    strings.TrimSpace(record.GetString("model")),
+		Prompt:   strings.TrimSpace(record.GetString("prompt")),
+	}
+	if raw := record.GetString("provider"); raw != "" && raw != "null" {
+		if err := json.Unmarshal([]byte(raw), &settings.Provider); err != nil {
+			return TitleSettings{}, fmt.Errorf("failed to unmarshal title provider preferences: %w", err)
+		}
+	}
+	return settings, nil
+}
+
+// titleSettings returns the settings to generate the titles of the user: the defaults, overridden by the
+// instance-wide settings and then by the ones of the user. Settings that can't be read are logged and skipped.
+func (a *Application) titleSettings(userID string) TitleSettings {
+	settings := TitleSettings{Model: DefaultTitlingModel, Prompt: DefaultTitlingPrompt, Provider: &defaultTitlingProvider}
+	for _, owner := range []string{"", userID} {
+		ownerSettings, err := a.findTitleSettings(owner)
+		if err != nil {
+			a.PB.Logger().Error("Failed to find title settings", "error", err, "userID", owner)
+			continue
+		}
+		settings = settings.Merge(ownerSettings)
+	}
+	return settings
+}
+
+// validateTitleSettings is the record hook checking that the provider preferences of title settings are valid.
+func validateTitleSettings(e *core.RecordEvent) error {
+	raw := e.Record.GetString("provider")
+	if raw == "" || raw == "null" {
+		return e.Next()
+	}
+	var provider ProviderPreferences
+	if err := json.Unmarshal([]byte(raw), &provider); err != nil || validate.Struct(provider) != nil {
+		return validation.Errors{
+			"provider": validation.NewError("validation_invalid_provider", "Must be valid provider routing preferences."),
+		}
+	}
+	return e.Next()
+}
+
+// TitleMessage is a message of the conversation given to the titling model.
+type TitleMessage struct {
+	Role    MessageRole
+	Content string
+}
+
+// truncateRunes shortens text to at most max characters, without splitting any of them.
+func truncateRunes(text string, max int) string {
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	return string([]rune(text)[:max])
+}
+
+// formatTitleConversation returns the conversation as given to the titling model, with long messages shortened and
+// the messages past the length of the conversation left out.
+func formatTitleConversation(messages []TitleMessage) string {
+	var conversation strings.Builder
+	conversation.WriteString("<conversation>\n")
+	length := 0
+	for _, message := range messages {
+		content := strings.TrimSpace(message.Content)
+		if content == "" {
+			continue
+		}
+		content = truncateRunes(content, titleMessageMaxLength)
+		length += utf8.RuneCountInString(content)
+		if length > titleConversationMaxLength {
+			break
+		}
+		fmt.Fprintf(&conversation, "<%s>%s</%s>\n", message.Role, content, message.Role)
+	}
+	conversation.WriteString("</conversation>")
+	return conversation.String()
+}
+
+// cleanGeneratedTitle trims a generated title, removes the quotes models sometimes surround it with and limits it
+// to MaxTitleLength characters.
+func cleanGeneratedTitle(title string) string {
+	title = strings.TrimSpace(title)
+	for _, quote := range []string{`"`, "'", "`"} {
+		if len(title) > 1 && strings.HasPrefix(title, quote) && strings.HasSuffix(title, quote) {
+			title = strings.TrimSpace(title[1 : len(title)-1])
+			break
+		}
+	}
+	return truncateRunes(title, MaxTitleLength)
+}
+
+// titlingRequestOptions returns the options of the requests to the titling model of the settings, with the API key
+// of the user.
+func (a *Application) titlingRequestOptions(userID string, settings TitleSettings) ([]option.RequestOption, error) {
+	apiKeyRecord, err := a.PB.FindFirstRecordByData("api_keys", "owner_user_id", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w found for user %s", errNoAPIKey, userID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find API key record: %w", err)
+	}
+
+	options := []option.RequestOption{option.WithAPIKey(apiKeyRecord.GetString("key"))}
+	if settings.Provider != nil {
+		if params := settings.Provider.openRouterParams(); len(params) > 0 {
+			options = append(options, option.WithJSONSet("provider", params))
+		}
+	}
+	return options, nil
+}
+
+// generateTitle asks the titling model of the settings for a title of the conversation, with the API key of the user.
+func (a *Application) generateTitle(ctx context.Context, userID string, settings TitleSettings, messages []TitleMessage) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, titleGenerationTimeout)
+	defer cancel()
+
+	options, err := a.titlingRequestOptions(userID, settings)
+	if err != nil {
+		return "", err
+	}
+	chat, err := a.AIClient.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
+		Messages: []openai.ChatCompletionMessageParamUnion{
+			openai.SystemMessage(settings.Prompt),
+			openai.UserMessage(formatTitleConversation(messages)),
+		},
+		Model:               settings.Model,
+		MaxCompletionTokens: openai.Opt[int64](330),
+	}, options...)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate title: %w", err)
+	}
+	if len(chat.Choices) == 0 {
+		return "", fmt.Errorf("no choices returned for the title")
+	}
+	title := cleanGeneratedTitle(chat.Choices[0].Message.Content)
+	if title == "" {
+		return "", fmt.Errorf("the generated title is empty")
+	}
+	return title, nil
+}
+
+// threadBranchMessages returns the messages of the branch of a thread ending with the leaf message, or with the
+// latest message of the thread when leafMessageID is empty.
+func (a *Application) threadBranchMessages(ownerUserID, threadID, leafMessageID string) ([]TitleMessage, error) {
+	if leafMessageID == "" {
+		records, err := a.PB.FindRecordsByFilter("messages", "parent_thread_id = {:threadID}", "-id", 1, 0, dbx.Params{"threadID": threadID})
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the latest message of the thread: %w", err)
+		}
+		if len(records) == 0 {
+			return nil, nil
+		}
+		leafMessageID = records[0].Id
+	}
+
+	fiber, err := getThreadFiber(a.PB, ownerUserID, leafMessageID)
+	if err != nil {
+		return nil, err
+	}
+	for _, message := range fiber {
+		if message.ParentThreadID != threadID {
+			return nil, errThreadAccessDenied
+		}
+	}
+	return titleMessages(fiber), nil
+}
+
+// titleMessages returns the user messages and completed responses of a branch, as given to the titling model.
+func titleMessages(branch []MessageDB) []TitleMessage {
+	messages := make([]TitleMessage, 0, len(branch))
+	for _, message := range branch {
+		if message.Role != MessageRoleUser && message.Status != MessageStatusCompleted {
+			continue
+		}
+		content, _ := message.Parts["content"].(string)
+		messages = append(messages, TitleMessage{Role: message.Role, Content: content})
+	}
+	return messages
+}
+
+type RetitleThreadInput struct {
+	// MessageID is the last message of the branch to title, the latest message of the thread when empty
+	MessageID string `json:"messageId" validate:"omitempty,len=26"`
+}
+
+// retitleThreadHandler regenerates the title of a thread from its whole conversation, whether or not titling of new
+// threads is disabled.
+func (a *Application) retitleThreadHandler(e *core.RequestEvent) error {
+	threadID := e.Request.PathValue("threadId")
+	if len(threadID) != 26 {
+		a.PB.Logger().Warn("Invalid thread ID length", "threadID", threadID)
+		return e.JSON(400, InvalidInputErrorData)
+	}
+
+	var input RetitleThreadInput
+	if e.Request.ContentLength != 0 {
+		if err := json.NewDecoder(e.Request.Body).Decode(&input); err != nil {
+			a.PB.Logger().Warn("Failed to decode retitle thread request", "error", err)
+			return e.JSON(400, InvalidInputErrorData)
+		}
+	}
+	if err := validate.Struct(input); err != nil {
+		a.PB.Logger().Warn("Validation failed for retitle thread input", "error", err)
+		return e.JSON(400, InvalidInputErrorData)
+	}
+
+	access, err := findWritableThreadAccess(a.PB, threadID, e.Auth.Id)
+	if err != nil && !errors.Is(err, errThreadAccessDenied) {
+		a.PB.Logger().Error("Failed to find thread access", "error", err, "threadID", threadID)
+		return e.JSON(500, UnexpectedErrorData)
+	}
+	if err != nil || !access.Role.CanWrite() {
+		a.PB.Logger().Warn("Thread not found or user can't write to it", "threadID", threadID, "userID", e.Auth.Id)
+		return e.JSON(404, map[string]string{"error": "Thread not found or access denied"})
+	}
+
+	messages, err := a.threadBranchMessages(access.OwnerUserID, threadID, input.MessageID)
+	if errors.Is(err, errThreadAccessDenied) || (err == nil && len(messages) == 0) {
+		a.PB.Logger().Warn("No messages to title the thread with", "threadID", threadID, "messageID", input.MessageID)
+		return e.JSON(404, map[string]string{"error": "Message not found in the thread"})
+	}
+	if err != nil {
+		a.PB.Logger().Error("Failed to find the messages of the thread", "error", err, "threadID", threadID)
+		return e.JSON(500, UnexpectedErrorData)
+	}
+
+	startTime := time.Now()
+	// The user asking for the title pays for it, with their own title settings
+	title, err := a.generateTitle(e.Request.Context(), e.Auth.Id, a.titleSettings(e.Auth.Id), messages)
+	if errors.Is(err, errNoAPIKey) {
+		a.PB.Logger().Warn("No API key to retitle thread", "error", err, "threadID", threadID, "userID", e.Auth.Id)
+		return e.JSON(400, map[string]string{"error": "Add an OpenRouter API key in your settings to retitle threads"})
+	}
+	if err != nil {
+		a.PB.Logger().Error("Failed to retitle thread", "error", err, "threadID", threadID)
+		return e.JSON(502, map[string]string{"error": "Failed to generate the title"})
+	}
+
+	threadRecord, err := a.PB.FindRecordById("threads", threadID)
+	if err != nil {
+		a.PB.Logger().Error("Failed to find thread record", "error", err, "threadID", threadID)
+		return e.JSON(500, UnexpectedErrorData)
+	}
+	threadRecord.Set("title", title)
+	threadRecord.Set("title_generation_status", ThreadTitleGenerationStatusCompleted)
+	if err := a.PB.Save(threadRecord); err != nil {
+		a.PB.Logger().Error("Failed to save thread record with generated title", "error", err, "threadID", threadID)
+		return e.JSON(500, UnexpectedErrorData)
+	}
+	a.Webhooks.Dispatch(access.OwnerUserID, WebhookEventThreadTitleGenerated, WebhookThreadData{
+		Thread: WebhookThread{ID: threadID, Title: title},
+	})
+	a.PB.Logger().Info("Retitled thread", "threadID", threadID, "userID", e.Auth.Id, "title", title, "timeTakenMs", time.Since(startTime).Milliseconds())
+
+	return e.JSON(200, map[string]any{
+		"message": "Thread retitled successfully",
+		"title":   title,
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCleanGeneratedTitle(t *testing.T) {
+	tests := []struct {
+		name  string
+		title string
+		want  string
+	}{
+		{name: "plain", title: "  A title\n", want: "A title"},
+		{name: "double quotes", title: `"A title"`, want: "A title"},
+		{name: "backticks", title: "`A title`", want: "A title"},
+		{name: "single quote", title: `"`, want: `"`},
+		{name: "long ASCII", title: strings.Repeat("a", 300), want: strings.Repeat("a", MaxTitleLength)},
+		// Every character takes several bytes, cutting by bytes would split the last one
+		{name: "long multibyte", title: strings.Repeat("é", 200) + strings.Repeat("日本", 50), want: strings.Repeat("é", 200) + strings.Repeat("日本", 25)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := cleanGeneratedTitle(test.title); got != test.want {
+				t.Errorf("cleanGeneratedTitle(%q) = %q, expected %q", test.title, got, test.want)
+			}
+		})
+	}
+}
+
+// saveTitleSettings saves the title settings of the user, or the instance-wide ones for an empty userID.
+func (s *testServer) saveTitleSettings(userID string, fields map[string]any) error {
+	s.t.Helper()
+
+	collection, err := s.App.PB.FindCollectionByNameOrId("title_settings")
+	if err != nil {
+		s.t.Fatalf("Failed to find the title settings collection: %v", err)
+	}
+	record := core.NewRecord(collection)
+	record.Set("owner_user_id", userID)
+	for name, value := range fields {
+		record.Set(name, value)
+	}
+	return s.App.PB.Save(record)
+}
+
+func TestTitleSettings(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("user@example.com")
+
+	// Without settings the defaults are used
+	s.createThread(user, "First question")
+	requests := s.Upstream.TitleRequests()
+	if len(requests) != 1 || requests[0].Model != DefaultTitlingModel {
+		t.Fatalf("Title requests are %+v, expected one with the default model", requests)
+	}
+	if provider := string(requests[0].Params["provider"]); !strings.Contains(provider, `"cerebras/fp16"`) {
+		t.Errorf("Default title provider is %s", provider)
+	}
+
+	if err := s.saveTitleSettings("", map[string]any{"model": "test/titler", "provider": map[string]any{"sort": "latency"}}); err != nil {
+		t.Fatalf("Failed to save the instance title settings: %v", err)
+	}
+	if err := s.saveTitleSettings(user.ID, map[string]any{"prompt": "Title this"}); err != nil {
+		t.Fatalf("Failed to save the user title settings: %v", err)
+	}
+	s.createThread(user, "Second question")
+	requests = s.Upstream.TitleRequests()
+	request := requests[len(requests)-1]
+	if request.Model != "test/titler" {
+		t.Errorf("Title model is %s, expected the one of the instance", request.Model)
+	}
+	if provider := string(request.Params["provider"]); provider != `{"sort":"latency"}` {
+		t.Errorf("Title provider is %s, expected the one of the instance", provider)
+	}
+	if prompt := request.text(request.Messages[0].Content); prompt != "Title this" {
+		t.Errorf("Title prompt is %q, expected the one of the user", prompt)
+	}
+	if conversation := request.lastUserText(); !strings.Contains(conversation, "<user>Second question</user>") {
+		t.Errorf("Title conversation is %q", conversation)
+	}
+
+	// Invalid provider preferences are rejected
+	other := s.createUser("other@example.com")
+	if err := s.saveTitleSettings(other.ID, map[string]any{"provider": map[string]any{"sort": "vibes"}}); err == nil {
+		t.Errorf("Title settings with an invalid provider sort were saved")
+	}
+
+	// Users can disable titling of new threads
+	user2 := s.createUser("user2@example.com")
+	if err := s.saveTitleSettings(user2.ID, map[string]any{"disabled": true}); err != nil {
+		t.Fatalf("Failed to save the user title settings: %v", err)
+	}
+	threadID, responseID := s.createThread(user2, "Untitled question")
+	s.waitMessage(responseID)
+	thread, err := s.App.PB.FindRecordById("threads", threadID)
+	if err != nil {
+		t.Fatalf("Failed to find thread: %v", err)
+	}
+	if thread.GetString("title") != "New Thread" || thread.GetString("title_generation_status") != "" {
+		t.Errorf("Thread of a user with titling disabled has title %q with status %q", thread.GetString("title"), thread.GetString("title_generation_status"))
+	}
+	if count := len(s.Upstream.TitleRequests()); count != len(requests) {
+		t.Errorf("The upstream received %d title requests, expected %d", count, len(requests))
+	}
+}
+
+func TestRetitleThread(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("user@example.com")
+	threadID, responseID := s.createThread(user, "Tell me about Go")
+	s.waitMessage(responseID)
+
+	s.Upstream.Title = `"Go programming"`
+	var output struct {
+		Title string `json:"title"`
+	}
+	res := s.sendJSON(user, http.MethodPost, "/api/threads/"+threadID+"/retitle", map[string]any{})
+	s.decode(res, http.StatusOK, &output)
+	if output.Title != "Go programming" {
+		t.Errorf("Retitled thread title is %q", output.Title)
+	}
+	thread, err := s.App.PB.FindRecordById("threads", threadID)
+	if err != nil {
+		t.Fatalf("Failed to find thread: %v", err)
+	}
+	if thread.GetString("title") != "Go programming" {
+		t.Errorf("Saved title is %q", thread.GetString("title"))
+	}
+
+	// The whole conversation is given to the titling model
+	requests := s.Upstream.TitleRequests()
+	conversation := requests[len(requests)-1].lastUserText()
+	for _, part := range []string{"<user>Tell me about Go</user>", "<assistant>Reply to: Tell me about Go</assistant>"} {
+		if !strings.Contains(conversation, part) {
+			t.Errorf("Title conversation %q doesn't contain %q", conversation, part)
+		}
+	}
+
+	// Only users who can write to the thread can retitle it
+	other := s.createUser("other@example.com")
+	res = s.sendJSON(other, http.MethodPost, "/api/threads/"+threadID+"/retitle", map[string]any{})
+	s.decode(res, http.StatusNotFound, nil)
+
+	// The branch must be in the thread
+	otherThreadID, otherResponseID := s.createThread(user, "Another thread")
+	s.waitMessage(otherResponseID)
+	res = s.sendJSON(user, http.MethodPost, "/api/threads/"+threadID+"/retitle", map[string]any{"messageId": otherResponseID})
+	s.decode(res, http.StatusNotFound, nil)
+	res = s.sendJSON(user, http.MethodPost, "/api/threads/"+otherThreadID+"/retitle", map[string]any{"messageId": otherResponseID})
+	s.decode(res, http.StatusOK, nil)
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/hook"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// AccessTokenPrefix marks personal access tokens, so they can be told apart from PocketBase auth tokens.
+const AccessTokenPrefix = "nise_"
+
+// accessTokenLastUsedResolution limits how often last_used_at is written for a token in active use.
+const accessTokenLastUsedResolution = 1 * time.Minute
+
+// accessTokenContextKey is the request store key holding the access_tokens record of a request
+// authenticated with a personal access token.
+const accessTokenContextKey = "niseAccessToken"
+
+// AccessTokenScope limits what a personal access token can be used for. Scopes are cumulative, chat includes
+// read and admin includes both.
+type AccessTokenScope string
+
+const (
+	// AccessTokenScopeRead allows reading threads, messages and streams.
+	AccessTokenScopeRead AccessTokenScope = "read"
+	// AccessTokenScopeChat additionally allows sending, regenerating and cancelling messages.
+	AccessTokenScopeChat AccessTokenScope = "chat"
+	// AccessTokenScopeAdmin additionally allows managing the account, its tokens, API keys and webhooks.
+	AccessTokenScopeAdmin AccessTokenScope = "admin"
+)
+
+func (s AccessTokenScope) String() string {
+	return string(s)
+}
+
+var accessTokenScopeLevels = map[AccessTokenScope]int{
+	AccessTokenScopeRead:  1,
+	AccessTokenScopeChat:  2,
+	AccessTokenScopeAdmin: 3,
+}
+
+// accessTokenAllows reports whether a token granted the given scopes may be used where the required scope is needed.
+func accessTokenAllows(scopes []string, required AccessTokenScope) bool {
+	for _, scope := range scopes {
+		if accessTokenScopeLevels[AccessTokenScope(scope)] >= accessTokenScopeLevels[required] {
+			return true
+		}
+	}
+	return false
+}
+
+// accessTokenAdminPaths are the route prefixes that manage the account rather than its conversations.
+var accessTokenAdminPaths = []string{
+	"/api/tokens",
+	"/api/key/",
+	"/api/batch",
+}
+
+// accessTokenConversationCollections are the only collections whose records tokens without the admin scope can use,
+// the records of any other collection belong to the account and need the admin scope.
+var accessTokenConversationCollections = []string{
+	"messages",
+	"projects",
+	"saved_searches",
+	"thread_members",
+	"threads",
+}
+
+// requiredAccessTokenScope returns the scope a personal access token needs for the request. Reads need the read
+// scope and anything else the chat scope, except for account management which always needs the admin scope.
+func requiredAccessTokenScope(request *http.Request) AccessTokenScope {
+	path := request.URL.Path
+	if slices.ContainsFunc(accessTokenAdminPaths, func(prefix string) bool { return strings.HasPrefix(path, prefix) }) {
+		return AccessTokenScopeAdmin
+	}
+	if collection, ok := strings.CutPrefix(path, "/api/collections/"); ok {
+		collection, _, _ = strings.Cut(collection, "/")
+		if !slices.Contains(accessTokenConversationCollections, collection) {
+			return AccessTokenScopeAdmin
+		}
+	}
+	// The websocket is opened with a GET but can send messages
+	if path == "/api/ws" {
+		return AccessTokenScopeChat
+	}
+	// Realtime subscriptions are set with a POST but only read
+	if path == "/api/realtime" {
+		return AccessTokenScopeRead
+	}
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return AccessTokenScopeRead
+	default:
+		return AccessTokenScopeChat
+	}
+}
+
+// newAccessToken generates a random personal access token, only its hash is ever stored.
+func newAccessToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate access token: %w", err)
+	}
+	return AccessTokenPrefix + bas32UUIDencoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+func hashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// findAccessTokenRecord looks up the access_tokens record for a plaintext token, failing for revoked and
+// expired tokens.
+func (a *Application) findAccessTokenRecord(token string) (*core.Record, error) {
+	if !strings.HasPrefix(token, AccessTokenPrefix) {
+		return nil, fmt.Errorf("not a personal access token")
+	}
+	tokenRecord, err := a.PB.FindFirstRecordByData("access_tokens", "token_hash", hashAccessToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if !tokenRecord.GetDateTime("revoked_at").IsZero() {
+		return nil, fmt.Errorf("access token %s is revoked", tokenRecord.Id)
+	}
+	expiresAt := tokenRecord.GetDateTime("expires_at")
+	if !expiresAt.IsZero() && expiresAt.Time().Before(time.Now()) {
+		return nil, fmt.Errorf("access token %s is expired", tokenRecord.Id)
+	}
+	return tokenRecord, nil
+}
+
+// touchAccessToken records the use of a token, at most once per accessTokenLastUsedResolution. The column is
+// updated directly so that using a token doesn't trigger record hooks or bump its updated date.
+func (a *Application) touchAccessToken(tokenRecord *core.Record) {
+	lastUsedAt := tokenRecord.GetDateTime("last_used_at")
+	if !lastUsedAt.IsZero() && time.Since(lastUsedAt.Time()) < accessTokenLastUsedResolution {
+		return
+	}
+	_, err := a.PB.DB().Update(
+		"access_tokens",
+		dbx.Params{"last_used_at": types.NowDateTime()},
+		dbx.HashExp{"id": tokenRecord.Id},
+	).Execute()
+	if err != nil {
+		a.PB.Logger().Warn("Failed to update access token last use", "error", err, "tokenID", tokenRecord.Id)
+	}
+}
+
+type NewAccessTokenInput struct {
+	Name   string             `json:"name" validate:"required,max=100"`
+	Scopes []AccessTokenScope `json:"scopes" validate:"required,min=1,max=3,unique,dive,oneof=read chat admin"`
+	// ExpiresInDays is optional, tokens without it never expire
+	ExpiresInDays int `json:"expiresInDays" validate:"omitempty,min=1,max=3650"`
+}
+
+type NewAccessTokenOutput struct {
+	ID          string             `json:"id"`
+	Name        string             `json:"name"`
+	Token       string             `json:"token"`
+	TokenPrefix string             `json:"tokenPrefix"`
+	Scopes      []AccessTokenScope `json:"scopes"`
+	ExpiresAt   string             `json:"expiresAt,omitempty"`
+	Created     string             `json:"created"`
+}
+
+// newAccessTokenHandler mints a personal access token for the user. The plaintext token is only returned here.
+func (a *Application) newAccessTokenHandler(e *core.RequestEvent) error {
+	var input NewAccessTokenInput
+	if err := json.NewDecoder(e.Request.Body).Decode(&input); err != nil {
+		a.PB.Logger().Warn("Failed to decode new access token request", "error", err)
+		return e.JSON(400, InvalidInputErrorData)
+	}
+	if err := validate.Struct(input); err != nil {
+		a.PB.Logger().Warn("Validation failed for new access token input", "error", err)
+		return e.JSON(400, InvalidInputErrorData)
+	}
+
+	tokensCollection, err := a.PB.FindCollectionByNameOrId("access_tokens")
+	if err != nil {
+		a.PB.Logger().Error("Failed to find access tokens collection", "error", err)
+		return e.JSON(500, UnexpectedErrorData)
+	}
+
+	token, err := newAccessToken()
+	if err != nil {
+		a.PB.Logger().Error("Failed to generate access token", "error", err)
+		return e.JSON(500, UnexpectedErrorData)
+	}
+	tokenPrefix := token[:len(AccessTokenPrefix)+6]
+
+	tokenRecord := core.NewRecord(tokensCollection)
+	tokenRecord.Set("owner_user_id", e.Auth.Id)
+	tokenRecord.Set("name", input.Name)
+	tokenRecord.Set("token_hash", hashAccessToken(token))
+	tokenRecord.Set("token_prefix", tokenPrefix)
+	scopes := make([]string, len(input.Scopes))
+	for i, scope := range input.Scopes {
+		scopes[i] = scope.String()
+	}
+	tokenRecord.Set("scopes", scopes)
+	if input.ExpiresInDays > 0 {
+		expiresAt, _ := types.ParseDateTime(time.Now().AddDate(0, 0, input.ExpiresInDays))
+		tokenRecord.Set("expires_at", expiresAt)
+	}
+	if err := a.PB.Save(tokenRecord); err != nil {
+		a.PB.Logger().Error("Failed to save access token record", "error", err, "userID", e.Auth.Id)
+		return e.JSON(500, UnexpectedErrorData)
+	}
+
+	a.PB.Logger().Info("Created access token", "tokenID", tokenRecord.Id, "userID", e.Auth.Id, "scopes", input.Scopes)
+
+	return e.JSON(200, NewAccessTokenOutput{
+		ID:          tokenRecord.Id,
+		Name:        input.Name,
+		Token:       token,
+		TokenPrefix: tokenPrefix,
+		Scopes:      input.Scopes,
+		ExpiresAt:   tokenRecord.GetString("expires_at"),
+		Created:     tokenRecord.GetString("created"),
+	})
+}
+
+// revokeAccessTokenHandler revokes a personal access token of the user. The record is kept so that its last use
+// stays visible, revoking an already revoked token is a no-op.
+func (a *Application) revokeAccessTokenHandler(e *core.RequestEvent) error {
+	tokenID := e.Request.PathValue("tokenId")
+	if tokenID == "" {
+		a.PB.Logger().Warn("Token ID is missing in request path")
+		return e.JSON(400, InvalidInputErrorData)
+	}
+
+	tokenRecord, err := a.PB.FindRecordById("access_tokens", tokenID)
+	if err != nil || tokenRecord.GetString("owner_user_id") != e.Auth.Id {
+		a.PB.Logger().Warn("Access token not found or user is not the owner", "error", err, "tokenID", tokenID, "userID", e.Auth.Id)
+		return e.JSON(404, map[string]string{"error": "Token not found or access denied"})
+	}
+
+	if tokenRecord.GetDateTime("revoked_at").IsZero() {
+		tokenRecord.Set("revoked_at", types.NowDateTime())
+		if err := a.PB.Save(tokenRecord); err != nil {
+			a.PB.Logger().Error("Failed to revoke access token", "error", err, "tokenID", tokenID)
+			return e.JSON(500, UnexpectedErrorData)
+		}
+		a.PB.Logger().Info("Revoked access token", "tokenID", tokenID, "userID", e.Auth.Id)
+	}
+
+	return e.NoContent(204)
+}
+
+// loadAccessToken authenticates requests sent with a personal access token as a bearer token, setting e.Auth to
+// the token owner. It runs before the PocketBase auth token middleware, which skips requests that already have
+// e.Auth set, so routes using apis.RequireAuth() accept both kinds of tokens. Requests outside of the token's
+// scopes are rejected here, before reaching any route.
+func (a *Application) loadAccessToken() *hook.Handler[*core.RequestEvent] {
+	return &hook.Handler[*core.RequestEvent]{
+		Id:       "niseLoadAccessToken",
+		Priority: apis.DefaultLoadAuthTokenMiddlewarePriority - 1,
+		Func: func(e *core.RequestEvent) error {
+			token := strings.TrimPrefix(e.Request.Header.Get("Authorization"), "Bearer ")
+			if !strings.HasPrefix(token, AccessTokenPrefix) {
+				return e.Next()
+			}
+
+			tokenRecord, err := a.findAccessTokenRecord(token)
+			if err != nil {
+				a.PB.Logger().Debug("Access token authentication failed", "error", err)
+				return e.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid, expired or revoked access token"})
+			}
+
+			user, err := a.PB.FindRecordById("users", tokenRecord.GetString("owner_user_id"))
+			if err == nil && !user.Verified() {
+				err = fmt.Errorf("user is not verified")
+			}
+			if err == nil && user.GetBool("disabled") {
+				err = fmt.Errorf("user is disabled")
+			}
+			if err != nil {
+				a.PB.Logger().Warn("Failed to find owner of access token", "error", err, "tokenID", tokenRecord.Id)
+				return e.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid, expired or revoked access token"})
+			}
+
+			requiredScope := requiredAccessTokenScope(e.Request)
+			if !accessTokenAllows(tokenRecord.GetStringSlice("scopes"), requiredScope) {
+				a.PB.Logger().Warn("Access token is missing scope", "tokenID", tokenRecord.Id, "requiredScope", requiredScope, "path", e.Request.URL.Path)
+				return e.JSON(http.StatusForbidden, map[string]string{"error": fmt.Sprintf("The access token requires the %s scope for this request", requiredScope)})
+			}
+
+			a.touchAccessToken(tokenRecord)
+			e.Auth = user
+			e.Set(accessTokenContextKey, tokenRecord)
+
+			return e.Next()
+		},
+	}
+}
+
+// requireAccessToken only allows requests authenticated with a personal access token by loadAccessToken.
+func (a *Application) requireAccessToken() *hook.Handler[*core.RequestEvent] {
+	return &hook.Handler[*core.RequestEvent]{
+		Func: func(e *core.RequestEvent) error {
+			if _, ok := e.Get(accessTokenContextKey).(*core.Record); !ok || e.Auth == nil {
+				return e.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or missing access token"})
+			}
+			return e.Next()
+		},
+	}
+}
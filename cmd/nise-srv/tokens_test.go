@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequiredAccessTokenScope(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   AccessTokenScope
+	}{
+		{method: http.MethodGet, path: "/api/collections/threads/records", want: AccessTokenScopeRead},
+		{method: http.MethodPatch, path: "/api/collections/threads/records/abc", want: AccessTokenScopeChat},
+		{method: http.MethodPost, path: "/api/collections/messages/records", want: AccessTokenScopeChat},
+		{method: http.MethodPost, path: "/api/threads", want: AccessTokenScopeChat},
+		{method: http.MethodGet, path: "/api/ws", want: AccessTokenScopeChat},
+		{method: http.MethodPost, path: "/api/realtime", want: AccessTokenScopeRead},
+		{method: http.MethodPost, path: "/api/tokens", want: AccessTokenScopeAdmin},
+		{method: http.MethodPost, path: "/api/batch", want: AccessTokenScopeAdmin},
+		{method: http.MethodGet, path: "/api/collections/api_keys/records", want: AccessTokenScopeAdmin},
+		// Account-level collections need the admin scope without being listed
+		{method: http.MethodPost, path: "/api/collections/retention_policies/records", want: AccessTokenScopeAdmin},
+		{method: http.MethodPatch, path: "/api/collections/model_fallbacks/records/abc", want: AccessTokenScopeAdmin},
+		{method: http.MethodPost, path: "/api/collections/title_settings/records", want: AccessTokenScopeAdmin},
+		{method: http.MethodPost, path: "/api/collections/threads_archive/records", want: AccessTokenScopeAdmin},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, test.path, nil)
+		if got := requiredAccessTokenScope(request); got != test.want {
+			t.Errorf("requiredAccessTokenScope(%s %s) = %s, expected %s", test.method, test.path, got, test.want)
+		}
+	}
+}
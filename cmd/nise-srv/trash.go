@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"time"
+)
+
+// TrashCronID identifies the job emptying the trash in the PocketBase cron scheduler.
+const TrashCronID = "niseTrash"
+
+// TrashCronSchedule runs the trash job every hour.
+const TrashCronSchedule = "15 * * * *"
+
+// DefaultTrashRetentionDays is how long deleted threads stay in the trash before being purged.
+const DefaultTrashRetentionDays = 30
+
+// TrashedThread is a thread in the trash of a user.
+type TrashedThread struct {
+	ID        string `json:"id"`
+	Title     string `json:"title"`
+	DeletedAt string `json:"deletedAt"`
+	PurgeAt   string `json:"purgeAt"`
+}
+
+// trashThreadOnDelete moves threads deleted through the records API to the trash instead of deleting them.
+// Deleting a thread that is already in the trash deletes it permanently, along with its messages and attachments.
+func (a *Application) trashThreadOnDelete(e *core.RecordRequestEvent) error {
+	if !e.Record.GetDateTime("deleted_at").IsZero() {
+		return e.Next()
+	}
+
+	e.Record.Set("deleted_at", types.NowDateTime())
+	if err := e.App.Save(e.Record); err != nil {
+		a.PB.Logger().Error("Failed to move thread to the trash", "error", err, "threadID", e.Record.Id)
+		return e.JSON(500, UnexpectedErrorData)
+	}
+	a.PB.Logger().Info("Moved thread to the trash", "threadID", e.Record.Id, "userID", e.Record.GetString("owner_user_id"))
+
+	return e.NoContent(204)
+}
+
+// listTrashedThreadsHandler lists the threads in the trash of the user, most recently deleted first.
+func (a *Application) listTrashedThreadsHandler(e *core.RequestEvent) error {
+	records, err := a.PB.FindRecordsByFilter(
+		"threads",
+		"owner_user_id = {:userID} && deleted_at != ''",
+		"-deleted_at",
+		0,
+		0,
+		dbx.Params{"userID": e.Auth.Id},
+	)
+	if err != nil {
+		a.PB.Logger().Error("Failed to find trashed threads", "error", err, "userID", e.Auth.Id)
+		return e.JSON(500, UnexpectedErrorData)
+	}
+
+	threads := make([]TrashedThread, 0, len(records))
+	for _, record := range records {
+		deletedAt := record.GetDateTime("deleted_at")
+		threads = append(threads, TrashedThread{
+			ID:        record.Id,
+			Title:     record.GetString("title"),
+			DeletedAt: deletedAt.String(),
+			PurgeAt:   deletedAt.AddDate(0, 0, a.TrashRetentionDays).String(),
+		})
+	}
+
+	return e.JSON(200, map[string]any{"threads": threads})
+}
+
+// restoreThreadHandler moves a thread of the user out of the trash.
+func (a *Application) restoreThreadHandler(e *core.RequestEvent) error {
+	threadID := e.Request.PathValue("threadId")
+	if len(threadID) != 26 {
+		a.PB.Logger().Warn("Invalid thread ID length", "threadID", threadID)
+		return e.JSON(400, InvalidInputErrorData)
+	}
+
+	threadRecord, err := a.PB.FindRecordById("threads", threadID)
+	if err != nil || threadRecord.GetString("owner_user_id") != e.Auth.Id {
+		a.PB.Logger().Warn("Thread not found or user is not the owner", "error", err, "threadID", threadID, "userID", e.Auth.Id)
+		return e.JSON(404, map[string]string{"error": "Thread not found or access denied"})
+	}
+	if threadRecord.GetDateTime("deleted_at").IsZero() {
+		return e.JSON(409, map[string]string{"error": "Thread is not in the trash"})
+	}
+
+	threadRecord.Set("deleted_at", "")
+	if err := a.PB.Save(threadRecord); err != nil {
+		a.PB.Logger().Error("Failed to restore thread", "error", err, "threadID", threadID)
+		return e.JSON(500, UnexpectedErrorData)
+	}
+	a.PB.Logger().Info("Restored thread from the trash", "threadID", threadID, "userID", e.Auth.Id)
+
+	return e.NoContent(204)
+}
+
+// purgeTrashedThreads permanently deletes the threads that have been in the trash for longer than
+// retentionDays, along with their messages and attachments. It returns the number of deleted threads.
+func (a *Application) purgeTrashedThreads(retentionDays int) (int, error) {
+	cutoff := retentionCutoff(retentionDays)
+	threads, err := a.PB.FindRecordsByFilter(
+		"threads",
+		"deleted_at != '' && deleted_at < {:cutoff}",
+		"",
+		0,
+		0,
+		dbx.Params{"cutoff": cutoff},
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find trashed threads: %w", err)
+	}
+
+	err = a.PB.RunInTransaction(func(txApp core.App) error {
+		for _, thread := range threads {
+			// Messages are deleted by cascade, and their attachments once the transaction is committed
+			if err := txApp.Delete(thread); err != nil {
+				return fmt.Errorf("failed to delete thread %s: %w", thread.Id, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(threads), nil
+}
+
+// runTrashJob is the cron job emptying the trash of threads past the trash retention period.
+func (a *Application) runTrashJob() {
+	startTime := time.Now()
+	purged, err := a.purgeTrashedThreads(a.TrashRetentionDays)
+	if err != nil {
+		a.PB.Logger().Error("Failed to purge trashed threads", "error", err)
+		return
+	}
+	if purged > 0 {
+		a.PB.Logger().Info("Purged trashed threads", "threads", purged, "duration", time.Since(startTime))
+	}
+}
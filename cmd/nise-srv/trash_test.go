@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTrashedThreadIsReadOnly(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("user@example.com")
+	threadID, responseID := s.createThread(user, "Hello")
+	response := s.waitMessage(responseID)
+	userMessageID := response.GetString("parent_message_id")
+
+	res := s.do(user, http.MethodDelete, "/api/collections/threads/records/"+threadID, nil, "", nil)
+	s.decode(res, http.StatusNoContent, nil)
+
+	// The owner can't write to a thread in the trash
+	requests := len(s.Upstream.Requests())
+	send := func() *http.Response {
+		return s.postForm(user, "/api/threads/"+threadID+"/messages", map[string]string{
+			"content":         "Hello again",
+			"parentMessageId": responseID,
+			"responseModel":   testResponseModel,
+		})
+	}
+	s.decode(send(), http.StatusNotFound, nil)
+	res = s.sendJSON(user, http.MethodPost, "/api/threads/"+threadID+"/messages/"+responseID+"/regenerate", map[string]any{
+		"responseModel": map[string]any{"providerId": "test/model"},
+	})
+	s.decode(res, http.StatusNotFound, nil)
+	res = s.sendJSON(user, http.MethodPatch, "/api/messages/"+userMessageID, map[string]any{
+		"content":       "Edited",
+		"responseModel": map[string]any{"providerId": "test/model"},
+	})
+	s.decode(res, http.StatusBadRequest, nil)
+	res = s.sendJSON(user, http.MethodPost, "/api/threads/"+threadID+"/retitle", map[string]any{})
+	s.decode(res, http.StatusNotFound, nil)
+	if count := len(s.Upstream.Requests()); count != requests {
+		t.Errorf("The upstream received %d requests, expected %d", count, requests)
+	}
+
+	// Once restored it can be written to again
+	res = s.sendJSON(user, http.MethodPost, "/api/threads/"+threadID+"/restore", map[string]any{})
+	s.decode(res, http.StatusNoContent, nil)
+	var output struct {
+		ResponseMessageID string `json:"responseMessageId"`
+	}
+	s.decode(send(), http.StatusOK, &output)
+	s.waitMessage(output.ResponseMessageID)
+}
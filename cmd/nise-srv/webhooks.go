@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+type WebhookEvent string
+
+const (
+	WebhookEventMessageCompleted     WebhookEvent = "message.completed"
+	WebhookEventMessageFailed        WebhookEvent = "message.failed"
+	WebhookEventMessageRefused       WebhookEvent = "message.refused"
+	WebhookEventThreadTitleGenerated WebhookEvent = "thread.title_generated"
+)
+
+func (e WebhookEvent) String() string {
+	return string(e)
+}
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryStatusPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliveryStatusDelivered WebhookDeliveryStatus = "delivered"
+	WebhookDeliveryStatusFailed    WebhookDeliveryStatus = "failed"
+)
+
+func (s WebhookDeliveryStatus) String() string {
+	return string(s)
+}
+
+// WebhookPayload is the JSON body posted to a webhook URL.
+type WebhookPayload struct {
+	Event   WebhookEvent   `json:"event"`
+	Created types.DateTime `json:"created"`
+	Data    any            `json:"data"`
+}
+
+type WebhookMessageData struct {
+	Message Message `json:"message"`
+}
+
+type WebhookThreadData struct {
+	Thread WebhookThread `json:"thread"`
+}
+
+type WebhookThread struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
+
+const (
+	webhookMaxAttempts     = 8
+	webhookBaseRetryDelay  = 30 * time.Second
+	webhookMaxRetryDelay   = 1 * time.Hour
+	webhookRequestTimeout  = 10 * time.Second
+	webhookPollInterval    = 10 * time.Second
+	webhookDeliveriesBatch = 50
+)
+
+// WebhookService records webhook deliveries for events and posts them from a background worker,
+// retrying failed deliveries with exponential backoff. Deliveries are stored in the webhook_deliveries
+// collection, which doubles as the delivery log users can inspect.
+type WebhookService struct {
+	PB     *pocketbase.PocketBase
+	client *http.Client
+	wake   chan struct{}
+}
+
+func NewWebhookService(app *pocketbase.PocketBase) *WebhookService {
+	return &WebhookService{
+		PB:     app,
+		client: &http.Client{Timeout: webhookRequestTimeout},
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Dispatch queues a delivery of the event to every enabled webhook of the user subscribed to it.
+// A webhook without any events selected receives all of them.
+func (w *WebhookService) Dispatch(userID string, event WebhookEvent, data any) {
+	webhooks, err := w.PB.FindRecordsByFilter(
+		"webhooks",
+		"owner_user_id = {:userID} && enabled = true",
+		"",
+		0,
+		0,
+		dbx.Params{"userID": userID},
+	)
+	if err != nil {
+		w.PB.Logger().Error("Failed to find webhooks for user", "error", err, "userID", userID, "event", event)
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+
+	deliveriesCollection, err := w.PB.FindCollectionByNameOrId("webhook_deliveries")
+	if err != nil {
+		w.PB.Logger().Error("Failed to find webhook deliveries collection", "error", err)
+		return
+	}
+
+	payload := WebhookPayload{
+		Event:   event,
+		Created: types.NowDateTime(),
+		Data:    data,
+	}
+
+	queued := 0
+	for _, webhook := range webhooks {
+		events := webhook.GetStringSlice("events")
+		if len(events) > 0 && !slices.Contains(events, event.String()) {
+			continue
+		}
+
+		delivery := core.NewRecord(deliveriesCollection)
+		delivery.Set("webhook_id", webhook.Id)
+		delivery.Set("owner_user_id", userID)
+		delivery.Set("event", event)
+		delivery.Set("payload", payload)
+		delivery.Set("status", WebhookDeliveryStatusPending)
+		delivery.Set("attempts", 0)
+		delivery.Set("next_attempt_at", types.NowDateTime())
+		if err := w.PB.Save(delivery); err != nil {
+			w.PB.Logger().Error("Failed to save webhook delivery", "error", err, "webhookID", webhook.Id, "event", event)
+			continue
+		}
+		queued++
+	}
+
+	if queued > 0 {
+		w.PB.Logger().Debug("Queued webhook deliveries", "userID", userID, "event", event, "count", queued)
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run delivers pending webhooks until the context is cancelled.
+func (w *WebhookService) Run(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		w.deliverPending(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.wake:
+		}
+	}
+}
+
+func (w *WebhookService) deliverPending(ctx context.Context) {
+	deliveries, err := w.PB.FindRecordsByFilter(
+		"webhook_deliveries",
+		"status = {:status} && next_attempt_at <= {:now}",
+		"next_attempt_at",
+		webhookDeliveriesBatch,
+		0,
+		dbx.Params{"status": WebhookDeliveryStatusPending, "now": types.NowDateTime()},
+	)
+	if err != nil {
+		w.PB.Logger().Error("Failed to find pending webhook deliveries", "error", err)
+		return
+	}
+
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			return
+		}
+		w.deliver(ctx, delivery)
+	}
+}
+
+// deliver attempts a single delivery and records the outcome, scheduling a retry on failure.
+func (w *WebhookService) deliver(ctx context.Context, delivery *core.Record) {
+	attempts := delivery.GetInt("attempts") + 1
+	delivery.Set("attempts", attempts)
+
+	statusCode, err := w.post(ctx, delivery)
+	if statusCode != 0 {
+		delivery.Set("response_status", statusCode)
+	}
+
+	if err == nil {
+		delivery.Set("status", WebhookDeliveryStatusDelivered)
+		delivery.Set("delivered_at", types.NowDateTime())
+		delivery.Set("last_error", "")
+	} else {
+		w.PB.Logger().Warn("Webhook delivery failed", "error", err, "deliveryID", delivery.Id, "attempts", attempts)
+		delivery.Set("last_error", truncateRunes(err.Error(), 4096))
+		if attempts >= webhookMaxAttempts {
+			delivery.Set("status", WebhookDeliveryStatusFailed)
+		} else {
+			nextAttempt, _ := types.ParseDateTime(time.Now().Add(webhookRetryDelay(attempts)))
+			delivery.Set("next_attempt_at", nextAttempt)
+		}
+	}
+
+	if err := w.PB.Save(delivery); err != nil {
+		w.PB.Logger().Error("Failed to save webhook delivery", "error", err, "deliveryID", delivery.Id)
+	}
+}
+
+// post sends the delivery payload to its webhook, returning the response status code if a response was received.
+func (w *WebhookService) post(ctx context.Context, delivery *core.Record) (int, error) {
+	webhook, err := w.PB.FindRecordById("webhooks", delivery.GetString("webhook_id"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to find webhook: %w", err)
+	}
+	if !webhook.GetBool("enabled") {
+		return 0, fmt.Errorf("webhook is disabled")
+	}
+
+	body := []byte(delivery.GetString("payload"))
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.GetString("url"), bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "Nise-Webhooks")
+	request.Header.Set("X-Nise-Event", delivery.GetString("event"))
+	request.Header.Set("X-Nise-Delivery", delivery.Id)
+	request.Header.Set("X-Nise-Timestamp", timestamp)
+	request.Header.Set("X-Nise-Signature", "sha256="+signWebhookPayload(webhook.GetString("secret"), timestamp, body))
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send webhook request: %w", err)
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("webhook responded with status %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+// signWebhookPayload returns the hex encoded HMAC-SHA256 of "timestamp.body" keyed with the webhook secret.
+// Receivers should recompute it from the X-Nise-Timestamp header and the raw body, and reject stale timestamps.
+func signWebhookPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookRetryDelay doubles the delay with every failed attempt up to a maximum, with up to 20% jitter.
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookBaseRetryDelay << (attempts - 1)
+	if delay <= 0 || delay > webhookMaxRetryDelay {
+		delay = webhookMaxRetryDelay
+	}
+	jitter := time.Duration(rand.Int64N(int64(delay) / 5))
+	return delay - jitter
+}
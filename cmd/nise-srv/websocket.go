@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/pocketbase/pocketbase/core"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type WebSocketRequestType string
+
+const (
+	WebSocketRequestSubscribe   WebSocketRequestType = "subscribe"
+	WebSocketRequestUnsubscribe WebSocketRequestType = "unsubscribe"
+	WebSocketRequestSendMessage WebSocketRequestType = "sendMessage"
+	WebSocketRequestRegenerate  WebSocketRequestType = "regenerate"
+	WebSocketRequestCancel      WebSocketRequestType = "cancel"
+)
+
+type WebSocketEventType string
+
+const (
+	WebSocketEventReply WebSocketEventType = "reply"
+	WebSocketEventError WebSocketEventType = "error"
+	WebSocketEventChunk WebSocketEventType = "chunk"
+	// WebSocketEventDone is sent once a subscribed message has no more chunks to send.
+	WebSocketEventDone WebSocketEventType = "done"
+)
+
+// WebSocketRequest is a request sent by the client, Data holds the same JSON body as the equivalent HTTP endpoint.
+type WebSocketRequest struct {
+	// RequestID is chosen by the client and echoed back in the reply or error for this request
+	RequestID   string               `json:"requestId" validate:"max=64"`
+	Type        WebSocketRequestType `json:"type" validate:"required,oneof=subscribe unsubscribe sendMessage regenerate cancel"`
+	ThreadID    string               `json:"threadId,omitempty" validate:"omitempty,len=26"`
+	MessageID   string               `json:"messageId,omitempty" validate:"omitempty,len=26"`
+	LastChunkID int                  `json:"lastChunkId,omitempty" validate:"min=0"`
+	Data        json.RawMessage      `json:"data,omitempty"`
+}
+
+type WebSocketEvent struct {
+	Type      WebSocketEventType `json:"type"`
+	RequestID string             `json:"requestId,omitempty"`
+	MessageID string             `json:"messageId,omitempty"`
+	Chunk     *Chunk             `json:"chunk,omitempty"`
+	Data      any                `json:"data,omitempty"`
+	Error     string             `json:"error,omitempty"`
+}
+
+const (
+	webSocketPingInterval = 30 * time.Second
+	webSocketWriteTimeout = 10 * time.Second
+	webSocketMaxRequest   = 256 * 1024
+)
+
+// WebSocketProtocol is the subprotocol of the websocket. Browsers cannot set headers on websocket requests, so they
+// authenticate by offering it followed by the PocketBase auth token as a second subprotocol, which keeps the token
+// out of URLs and access logs. Only WebSocketProtocol is accepted back.
+const WebSocketProtocol = "nise"
+
+var webSocketUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	Subprotocols:    []string{WebSocketProtocol},
+}
+
+// webSocketProtocolToken returns the auth token offered as the subprotocol after WebSocketProtocol.
+func webSocketProtocolToken(request *http.Request) string {
+	protocols := websocket.Subprotocols(request)
+	if len(protocols) != 2 || protocols[0] != WebSocketProtocol {
+		return ""
+	}
+	return protocols[1]
+}
+
+// webSocketSession is a single authenticated websocket connection and the message streams it is subscribed to.
+type webSocketSession struct {
+	app    *Application
+	conn   *websocket.Conn
+	userID string
+
+	ctx context.Context
+
+	writeMutex sync.Mutex
+
+	subscriptions     map[string]*webSocketSubscription // message ID -> its forwarding goroutine
+	subscriptionMutex sync.Mutex
+	subscriptionGroup sync.WaitGroup
+}
+
+// webSocketSubscription is the forwarding goroutine of a message stream, a pointer so that it can tell whether it
+// was replaced when it finishes.
+type webSocketSubscription struct {
+	cancel context.CancelFunc
+}
+
+// websocketHandler upgrades the request to a websocket that can send messages, regenerate and cancel them, and
+// receive the chunks of any number of message streams. Besides the Authorization header the PocketBase auth token
+// is accepted in the subprotocols, see WebSocketProtocol.
+func (a *Application) websocketHandler(e *core.RequestEvent) error {
+	authRecord := e.Auth
+	if authRecord == nil {
+		token := webSocketProtocolToken(e.Request)
+		if token == "" {
+			return e.JSON(401, map[string]string{"error": "The request requires valid record authorization token."})
+		}
+		record, err := a.PB.FindAuthRecordByToken(token, core.TokenTypeAuth)
+		if err != nil {
+			a.PB.Logger().Warn("Invalid websocket auth token", "error", err)
+			return e.JSON(401, map[string]string{"error": "The request requires valid record authorization token."})
+		}
+		authRecord = record
+	}
+
+	conn, err := webSocketUpgrader.Upgrade(e.Response, e.Request, nil)
+	if err != nil {
+		// The upgrader has already replied with an error
+		a.PB.Logger().Warn("Failed to upgrade websocket connection", "error", err)
+		return nil
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	session := &webSocketSession{
+		app:           a,
+		conn:          conn,
+		userID:        authRecord.Id,
+		ctx:           ctx,
+		subscriptions: make(map[string]*webSocketSubscription),
+	}
+	a.PB.Logger().Info("Websocket connected", "userID", session.userID)
+
+	go session.ping()
+	session.readRequests()
+
+	cancel()
+	session.subscriptionGroup.Wait()
+	a.PB.Logger().Info("Websocket disconnected", "userID", session.userID)
+
+	return nil
+}
+
+// ping keeps the connection alive until the session ends.
+func (s *webSocketSession) ping() {
+	ticker := time.NewTicker(webSocketPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.writeMutex.Lock()
+			err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(webSocketWriteTimeout))
+			s.writeMutex.Unlock()
+			if err != nil {
+				s.app.PB.Logger().Debug("Failed to ping websocket", "error", err, "userID", s.userID)
+				return
+			}
+		}
+	}
+}
+
+// readRequests handles requests from the client until the connection is closed.
+func (s *webSocketSession) readRequests() {
+	s.conn.SetReadLimit(webSocketMaxRequest)
+	_ = s.conn.SetReadDeadline(time.Now().Add(2 * webSocketPingInterval))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(2 * webSocketPingInterval))
+	})
+
+	for {
+		var request WebSocketRequest
+		if err := s.conn.ReadJSON(&request); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				s.writeError("", InvalidInputErrorData["error"])
+				continue
+			}
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				s.app.PB.Logger().Warn("Websocket read failed", "error", err, "userID", s.userID)
+			}
+			return
+		}
+		_ = s.conn.SetReadDeadline(time.Now().Add(2 * webSocketPingInterval))
+
+		if err := validate.Struct(request); err != nil {
+			s.app.PB.Logger().Warn("Validation failed for websocket request", "error", err)
+			s.writeError(request.RequestID, InvalidInputErrorData["error"])
+			continue
+		}
+		s.handleRequest(request)
+	}
+}
+
+func (s *webSocketSession) handleRequest(request WebSocketRequest) {
+	logger := s.app.PB.Logger()
+
+	switch request.Type {
+	case WebSocketRequestSubscribe:
+		if request.MessageID == "" {
+			s.writeError(request.RequestID, InvalidInputErrorData["error"])
+			return
+		}
+		if err := s.subscribe(request.MessageID, request.LastChunkID); err != nil {
+			logger.Warn("Failed to subscribe to message stream", "error", err, "messageID", request.MessageID)
+			s.writeError(request.RequestID, "Message not found")
+			return
+		}
+		s.write(WebSocketEvent{Type: WebSocketEventReply, RequestID: request.RequestID, MessageID: request.MessageID})
+
+	case WebSocketRequestUnsubscribe:
+		s.unsubscribe(request.MessageID)
+		s.write(WebSocketEvent{Type: WebSocketEventReply, RequestID: request.RequestID, MessageID: request.MessageID})
+
+	case WebSocketRequestSendMessage:
+		var input NewUserMessageInput
+		if request.ThreadID == "" || json.Unmarshal(request.Data, &input) != nil || validate.Struct(input) != nil {
+			logger.Warn("Invalid websocket send message request", "threadID", request.ThreadID)
+			s.writeError(request.RequestID, InvalidInputErrorData["error"])
+			return
+		}
+		if err := s.app.checkResponseModel(s.ctx, input.ResponseModel); err != nil {
+			logger.Warn("Invalid response model options", "error", err)
+			s.writeError(request.RequestID, err.Error())
+			return
+		}
+		userMessage, responseMessage, err := s.app.sendMessageInThread(s.userID, request.ThreadID, input.UserMessage, input.ResponseModel, nil)
+		if errors.Is(err, errThreadAccessDenied) {
+			logger.Warn("Thread not found or user can't write in it", "threadID", request.ThreadID, "userID", s.userID)
+			s.writeError(request.RequestID, "Thread not found or access denied")
+			return
+		}
+		if errors.Is(err, errParentMessageNotFound) {
+			logger.Warn("Parent message not found in the thread", "error", err, "threadID", request.ThreadID)
+			s.writeError(request.RequestID, "Parent message not found in the thread")
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to send new message in thread", "error", err, "threadID", request.ThreadID)
+			s.writeError(request.RequestID, UnexpectedErrorData["error"])
+			return
+		}
+		s.write(WebSocketEvent{
+			Type:      WebSocketEventReply,
+			RequestID: request.RequestID,
+			MessageID: responseMessage.ID,
+			Data: map[string]any{
+				"userMessageId":     userMessage.ID,
+				"responseMessageId": responseMessage.ID,
+			},
+		})
+		if err := s.subscribe(responseMessage.ID, 0); err != nil {
+			logger.Error("Failed to subscribe to new message stream", "error", err, "messageID", responseMessage.ID)
+		}
+
+	case WebSocketRequestRegenerate:
+		var input RegenerateMessageInThreadInput
+		if request.ThreadID == "" || request.MessageID == "" ||
+			json.Unmarshal(request.Data, &input) != nil || validate.Struct(input) != nil {
+			logger.Warn("Invalid websocket regenerate request", "threadID", request.ThreadID, "messageID", request.MessageID)
+			s.writeError(request.RequestID, InvalidInputErrorData["error"])
+			return
+		}
+		newMessageID, err := s.app.regenerateMessage(s.ctx, s.userID, request.ThreadID, request.MessageID, input)
+		if errors.Is(err, errInvalidModelOptions) {
+			logger.Warn("Invalid response model options", "error", err)
+			s.writeError(request.RequestID, err.Error())
+			return
+		}
+		if errors.Is(err, errThreadAccessDenied) {
+			logger.Warn("Message not found or user can't regenerate it", "error", err, "messageID", request.MessageID)
+			s.writeError(request.RequestID, "Message not found or access denied")
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to regenerate message with response", "error", err)
+			s.writeError(request.RequestID, UnexpectedErrorData["error"])
+			return
+		}
+		s.write(WebSocketEvent{
+			Type:      WebSocketEventReply,
+			RequestID: request.RequestID,
+			MessageID: newMessageID,
+			Data:      map[string]any{"messageId": newMessageID},
+		})
+		if err := s.subscribe(newMessageID, 0); err != nil {
+			logger.Error("Failed to subscribe to regenerated message stream", "error", err, "messageID", newMessageID)
+		}
+
+	case WebSocketRequestCancel:
+		if request.MessageID == "" {
+			s.writeError(request.RequestID, InvalidInputErrorData["error"])
+			return
+		}
+		cancelled, err := s.app.StreamService.CancelStream(request.MessageID, s.userID)
+		if errors.Is(err, errThreadAccessDenied) {
+			logger.Warn("User can't cancel the generation of the message", "error", err, "messageID", request.MessageID, "userID", s.userID)
+			s.writeError(request.RequestID, "Message is not being generated")
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to cancel stream for message", "error", err, "messageID", request.MessageID)
+			s.writeError(request.RequestID, UnexpectedErrorData["error"])
+			return
+		}
+		if !cancelled {
+			s.writeError(request.RequestID, "Message is not being generated")
+			return
+		}
+		s.write(WebSocketEvent{Type: WebSocketEventReply, RequestID: request.RequestID, MessageID: request.MessageID})
+	}
+}
+
+// subscribe starts forwarding the chunks of a message after lastChunkID, replacing any existing subscription to it.
+// Messages that are no longer streaming are sent from their saved parts.
+func (s *webSocketSession) subscribe(messageID string, lastChunkID int) error {
+	stream, ok, err := s.app.StreamService.GetActiveStream(messageID, s.userID)
+	if err != nil {
+		return err
+	}
+
+	var storedChunks []Chunk
+	if !ok {
+		messageRecord, err := s.app.PB.FindRecordById("messages", messageID)
+		if err != nil {
+			return fmt.Errorf("failed to find message record: %w", err)
+		}
+		if _, err := findThreadAccess(s.app.PB, messageRecord.GetString("parent_thread_id"), s.userID); err != nil {
+			return fmt.Errorf("message %s is not accessible to user %s: %w", messageID, s.userID, err)
+		}
+		storedChunks, err = storedMessageChunks(messageRecord, lastChunkID)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal message parts: %w", err)
+		}
+	}
+
+	s.subscriptionMutex.Lock()
+	if existing, exists := s.subscriptions[messageID]; exists {
+		existing.cancel()
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	subscription := &webSocketSubscription{cancel: cancel}
+	s.subscriptions[messageID] = subscription
+	s.subscriptionMutex.Unlock()
+
+	s.subscriptionGroup.Add(1)
+	go func() {
+		defer s.subscriptionGroup.Done()
+		defer func() {
+			cancel()
+			s.subscriptionMutex.Lock()
+			if s.subscriptions[messageID] == subscription {
+				delete(s.subscriptions, messageID)
+			}
+			s.subscriptionMutex.Unlock()
+		}()
+
+		if stream == nil {
+			for _, chunk := range storedChunks {
+				if ctx.Err() != nil {
+					return
+				}
+				s.writeChunk(messageID, chunk)
+			}
+		} else {
+			cursor := stream.Subscribe(lastChunkID)
+			for {
+				chunks, done, wait := cursor.Read()
+				for _, chunk := range chunks {
+					s.writeChunk(messageID, chunk)
+				}
+				if done {
+					break
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-wait:
+				}
+			}
+		}
+
+		s.write(WebSocketEvent{Type: WebSocketEventDone, MessageID: messageID})
+	}()
+
+	return nil
+}
+
+func (s *webSocketSession) unsubscribe(messageID string) {
+	s.subscriptionMutex.Lock()
+	defer s.subscriptionMutex.Unlock()
+
+	if subscription, ok := s.subscriptions[messageID]; ok {
+		subscription.cancel()
+		delete(s.subscriptions, messageID)
+	}
+}
+
+func (s *webSocketSession) writeChunk(messageID string, chunk Chunk) {
+	s.write(WebSocketEvent{Type: WebSocketEventChunk, MessageID: messageID, Chunk: &chunk})
+}
+
+func (s *webSocketSession) writeError(requestID, message string) {
+	s.write(WebSocketEvent{Type: WebSocketEventError, RequestID: requestID, Error: message})
+}
+
+// write sends an event to the client, closing the connection if it cannot keep up.
+func (s *webSocketSession) write(event WebSocketEvent) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	_ = s.conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+	if err := s.conn.WriteJSON(event); err != nil {
+		s.app.PB.Logger().Debug("Failed to write to websocket", "error", err, "userID", s.userID)
+		_ = s.conn.Close()
+	}
+}
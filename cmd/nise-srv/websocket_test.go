@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialWebSocket opens the websocket of the user, authenticated with the subprotocols as browsers do.
+func (s *testServer) dialWebSocket(user testUser) *websocket.Conn {
+	s.t.Helper()
+
+	dialer := websocket.Dialer{Subprotocols: []string{WebSocketProtocol, user.Token}}
+	conn, res, err := dialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/api/ws", nil)
+	if err != nil {
+		s.t.Fatalf("Failed to open the websocket: %v", err)
+	}
+	if protocol := res.Header.Get("Sec-WebSocket-Protocol"); protocol != WebSocketProtocol {
+		s.t.Errorf("Websocket subprotocol is %q, expected %q", protocol, WebSocketProtocol)
+	}
+	s.t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// webSocketReply sends the request and returns the reply or error to it, skipping the other events.
+func webSocketReply(t *testing.T, conn *websocket.Conn, request WebSocketRequest) WebSocketEvent {
+	t.Helper()
+
+	if err := conn.WriteJSON(request); err != nil {
+		t.Fatalf("Failed to send websocket request: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var event WebSocketEvent
+		if err := conn.ReadJSON(&event); err != nil {
+			t.Fatalf("Failed to read websocket event: %v", err)
+		}
+		if event.RequestID == request.RequestID {
+			return event
+		}
+	}
+}
+
+func TestWebSocketAuth(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("user@example.com")
+
+	// The auth token isn't accepted in the URL
+	res := s.do(testUser{}, http.MethodGet, "/api/ws?token="+user.Token, nil, "", nil)
+	s.decode(res, http.StatusUnauthorized, nil)
+
+	dialer := websocket.Dialer{Subprotocols: []string{WebSocketProtocol, "invalid"}}
+	if _, _, err := dialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/api/ws", nil); err == nil {
+		t.Errorf("Websocket opened with an invalid token")
+	}
+
+	conn := s.dialWebSocket(user)
+	_, responseID := s.createThread(user, "Hello")
+	s.waitMessage(responseID)
+	event := webSocketReply(t, conn, WebSocketRequest{RequestID: "1", Type: WebSocketRequestSubscribe, MessageID: responseID})
+	if event.Type != WebSocketEventReply {
+		t.Errorf("Subscribe event is %+v, expected a reply", event)
+	}
+}
+
+func TestWebSocketAccessErrors(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.createUser("owner@example.com")
+	other := s.createUser("other@example.com")
+	s.Upstream.Script = func(request mockRequest) MockScript {
+		return MockScript{Content: []string{"Slow", " reply"}, DelayMs: 500}
+	}
+	threadID, responseID := s.createThread(owner, "Hello")
+	t.Cleanup(func() { s.waitMessage(responseID) })
+
+	// Errors are the same as the ones of the HTTP endpoints
+	conn := s.dialWebSocket(other)
+	event := webSocketReply(t, conn, WebSocketRequest{RequestID: "1", Type: WebSocketRequestCancel, MessageID: responseID})
+	if event.Type != WebSocketEventError || event.Error != "Message is not being generated" {
+		t.Errorf("Cancel of the message of another user is %+v", event)
+	}
+	event = webSocketReply(t, conn, WebSocketRequest{
+		RequestID: "2",
+		Type:      WebSocketRequestSendMessage,
+		ThreadID:  threadID,
+		Data:      []byte(`{"userMessage":{"content":"Hi"},"responseModel":{"providerId":"test/model"}}`),
+	})
+	if event.Type != WebSocketEventError || event.Error != "Thread not found or access denied" {
+		t.Errorf("Message in the thread of another user is %+v", event)
+	}
+}
@@ -3,7 +3,11 @@ import { MessageMarkdown } from "@/components/message-markdown.tsx";
 import { useEffect, useRef, useState } from "react";
 import { pb } from "@/lib/pb.ts";
 import { EventSourcePlus } from "event-source-plus";
-import { Alert, AlertTitle } from "@/components/ui/alert.tsx";
+import {
+	Alert,
+	AlertDescription,
+	AlertTitle,
+} from "@/components/ui/alert.tsx";
 import { AlertCircleIcon } from "lucide-react";
 import {
 	Tooltip,
@@ -11,7 +15,10 @@ import {
 	TooltipTrigger,
 } from "@/components/ui/tooltip.tsx";
 import { useQueryClient } from "@tanstack/react-query";
-import type { Message as MessageType } from "@/lib/message.ts";
+import {
+	type Message as MessageType,
+	messageErrorGuidance,
+} from "@/lib/message.ts";
 
 type MessageRef = {
 	message: MessageType;
@@ -25,6 +32,11 @@ enum StreamingChunkType {
 	ERROR = 3,
 
 	FINISH_REASON = 4,
+	RETRY = 5,
+	FALLBACK = 6,
+	REFUSAL = 7,
+	STATS = 8,
+	RESET = 9,
 }
 
 type MessageProps = {
@@ -107,14 +119,43 @@ export function Message({ originalMessage, threadId }: MessageProps) {
 					console.error("Error in streaming message:", data.c);
 					// biome-ignore lint/style/noNonNullAssertion: Initialised above
 					messageRef.current.message.parts!.error = data.c;
+					if (data.e) {
+						// biome-ignore lint/style/noNonNullAssertion: Initialised above
+						messageRef.current.message.parts!.errorCode = data.e.code;
+						// biome-ignore lint/style/noNonNullAssertion: Initialised above
+						messageRef.current.message.parts!.schemaErrors = data.e.details;
+					}
+				} else if (data.t === StreamingChunkType.RETRY) {
+					console.warn("Retrying message after upstream error:", data.c);
+				} else if (data.t === StreamingChunkType.REFUSAL) {
+					// biome-ignore lint/style/noNonNullAssertion: Initialised above
+					const parts = messageRef.current.message.parts!;
+					parts.refusal = (parts.refusal ?? "") + data.c;
+				} else if (data.t === StreamingChunkType.FALLBACK) {
+					console.warn("Model unavailable, falling back to:", data.c);
 				} else if (data.t === StreamingChunkType.FINISH_REASON) {
 					message.meta = {
 						...message.meta,
 						finishReason: data.c || "unknown",
 					};
 					// eventSourceController.abort();
-					messageRef.current.message.status =
-						data.c === "stop" ? "completed" : "failed";
+					if (messageRef.current.message.parts?.refusal) {
+						messageRef.current.message.status = "refused";
+					} else {
+						messageRef.current.message.status =
+							data.c === "stop" ? "completed" : "failed";
+					}
+				} else if (data.t === StreamingChunkType.RESET) {
+					// The whole saved message follows, drop the parts received before reconnecting
+					messageRef.current.message.parts = {
+						content: "",
+						reasoning: "",
+					};
+				} else if (data.t === StreamingChunkType.STATS) {
+					message.meta = {
+						...message.meta,
+						stats: JSON.parse(data.c),
+					};
 				} else {
 					console.warn("Unknown chunk type received:", data.t);
 				}
@@ -181,6 +222,7 @@ export function Message({ originalMessage, threadId }: MessageProps) {
 						<Reasoning
 							reasoning={message.parts?.reasoning || ""}
 							isStreaming={message.status === "generating"}
+							durationMs={message.meta?.stats?.reasoningMs}
 						/>
 					) : null}
 					<MessageMarkdown content={message.parts?.content || ""} />
@@ -191,15 +233,31 @@ export function Message({ originalMessage, threadId }: MessageProps) {
 							<Alert variant="destructive" className="w-fit">
 								<AlertCircleIcon />
 								<AlertTitle>Error generating response</AlertTitle>
+								{message.parts?.errorCode &&
+								messageErrorGuidance[message.parts.errorCode] ? (
+									<AlertDescription>
+										{messageErrorGuidance[message.parts.errorCode]}
+									</AlertDescription>
+								) : null}
 							</Alert>
 						</TooltipTrigger>
 						<TooltipContent>
 							<pre className="wrap-break-word text-destructive max-w-[60vw] sm:max-w-[80vw] flex-wrap overflow-x-auto p-1">
 								{message.parts?.error}
+								{message.parts?.schemaErrors?.map((schemaError) => (
+									<div key={schemaError}>{schemaError}</div>
+								))}
 							</pre>
 						</TooltipContent>
 					</Tooltip>
 				) : null}
+				{message.status === "refused" ? (
+					<Alert className="w-fit">
+						<AlertCircleIcon />
+						<AlertTitle>The model refused to answer</AlertTitle>
+						<AlertDescription>{message.parts?.refusal}</AlertDescription>
+					</Alert>
+				) : null}
 				{/*show loading state, global state for the teal underflow idea, zustand setter here and subscriber in effect div */}
 				{message.status === "generating" ? <LoadingIndicator /> : null}
 			</div>
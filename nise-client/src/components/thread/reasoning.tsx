@@ -9,10 +9,28 @@ import {
 type ReasoningProps = {
 	reasoning?: string;
 	isStreaming?: boolean;
+	// How long the model reasoned, known once the stream is done
+	durationMs?: number;
 };
 
+function formatDuration(durationMs: number) {
+	const seconds = durationMs / 1000;
+	if (seconds < 10) {
+		return `${Math.max(seconds, 0.1).toFixed(1)}s`;
+	}
+	const rounded = Math.round(seconds);
+	if (rounded < 60) {
+		return `${rounded}s`;
+	}
+	return `${Math.floor(rounded / 60)}m ${rounded % 60}s`;
+}
+
 // TODO: Consider having it automatically close when streaming is done
-export function Reasoning({ reasoning, isStreaming }: ReasoningProps) {
+export function Reasoning({
+	reasoning,
+	isStreaming,
+	durationMs,
+}: ReasoningProps) {
 	return (
 		<div className="prose prose-sm message min-w-full rounded-md bg-muted px-4">
 			<Accordion
@@ -23,7 +41,11 @@ export function Reasoning({ reasoning, isStreaming }: ReasoningProps) {
 			>
 				<AccordionItem value="reasoning">
 					<AccordionTrigger>
-						<strong>Reasoning</strong>
+						<strong>
+							{durationMs
+								? `Thought for ${formatDuration(durationMs)}`
+								: "Reasoning"}
+						</strong>
 					</AccordionTrigger>
 					<AccordionContent>
 						<Markdown>{reasoning}</Markdown>
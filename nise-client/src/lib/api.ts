@@ -17,6 +17,37 @@ export type ModelReasoningEffort = "off" | "low" | "medium" | "high";
 export type ResponseModelOptions = {
 	webSearch?: boolean; // Whether to enable web search
 	reasoningEffort?: ModelReasoningEffort; // Reasoning effort level
+	includeRefusals?: boolean; // Whether to keep refused responses and the prompts they refused in the transcript
+	temperature?: number; // Between 0 and 2
+	topP?: number; // Between 0 (excluded) and 1
+	maxTokens?: number; // Maximum number of tokens to generate
+	stop?: string[]; // Up to 4 stop sequences
+	seed?: number; // Seed for reproducible sampling, when the model supports it
+	presencePenalty?: number; // Between -2 and 2
+	frequencyPenalty?: number; // Between -2 and 2
+	responseFormat?: ResponseFormat; // JSON mode or structured output
+	provider?: ProviderPreferences; // OpenRouter provider routing preferences
+};
+
+export type ResponseFormat = {
+	type: "text" | "json_object" | "json_schema";
+	jsonSchema?: {
+		name: string; // Letters, digits, underscores and dashes
+		description?: string;
+		schema: Record<string, unknown>; // JSON schema of the response
+		strict?: boolean;
+	}; // Required with the json_schema type only
+};
+
+export type ProviderPreferences = {
+	order?: string[]; // Providers to try first, in order
+	allowFallbacks?: boolean; // Whether other providers can be used when the ones in order fail
+	requireParameters?: boolean; // Only use providers supporting all the parameters of the request
+	dataCollection?: "allow" | "deny";
+	only?: string[];
+	ignore?: string[];
+	quantizations?: ("int4" | "int8" | "fp4" | "fp6" | "fp8" | "fp16" | "bf16" | "fp32" | "unknown")[];
+	sort?: "price" | "throughput" | "latency";
 };
 
 export type ResponseModel = {
@@ -87,6 +118,29 @@ export async function regenerateMessageInThread(
 	);
 }
 
+export async function retitleThread(threadId: string, messageId?: string) {
+	return (await pb.send(`/api/threads/${threadId}/retitle`, {
+		method: "POST",
+		body: JSON.stringify({ messageId }),
+	})) as {
+		title: string; // The regenerated title
+	};
+}
+
+export type ThreadInsights = {
+	summary: string; // Rolling summary of the thread
+	summaryMessageId: string; // Last message of the summarized branch
+	suggestions: string[]; // Follow-up prompts of the requested message, or of the summarized one
+};
+
+export async function getThreadInsights(threadId: string, messageId?: string) {
+	const query = messageId ? `?messageId=${encodeURIComponent(messageId)}` : "";
+	return await pb.send<ThreadInsights>(
+		`/api/threads/${threadId}/insights${query}`,
+		{ method: "GET" },
+	);
+}
+
 export type UpdateUserMessageHandler = (
 	messageId: string,
 	content: string,
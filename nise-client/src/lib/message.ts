@@ -1,9 +1,39 @@
 import type { ResponseModelOptions } from "@/lib/api.ts";
 
+export type MessageErrorCode =
+	| "auth_failed"
+	| "insufficient_credits"
+	| "rate_limited"
+	| "context_too_long"
+	| "content_filtered"
+	| "upstream_unavailable"
+	| "cancelled"
+	| "schema_mismatch"
+	| "internal";
+
+// What the user can do about an error, errors without guidance can only be retried
+export const messageErrorGuidance: Partial<Record<MessageErrorCode, string>> = {
+	auth_failed: "Check the OpenRouter API key in your settings.",
+	insufficient_credits: "Top up your OpenRouter credits.",
+	rate_limited: "The model is rate limited, wait a moment before trying again.",
+	context_too_long:
+		"The thread is too long for the model, start a new thread or pick a model with a larger context.",
+	content_filtered:
+		"The request was blocked by the moderation of the provider, rephrase it or pick another model.",
+	upstream_unavailable:
+		"The model is unavailable, try again later or pick another model.",
+	schema_mismatch:
+		"The response doesn't match the JSON schema, try again or pick a model supporting structured outputs.",
+};
+
 export type MessageParts = {
 	content: string;
 	reasoning?: string;
 	error?: string; // Error message if the message generation failed
+	errorCode?: MessageErrorCode; // Kind of the error, set along with it
+	refusal?: string; // Why the model refused to answer, for refused messages
+	structured?: unknown; // Parsed content of responses with a JSON response format
+	schemaErrors?: string[]; // Violations of the JSON schema when the content doesn't match it
 	// TODO: Update for toolcalls like web search, can a message have multiple parts?
 };
 
@@ -23,6 +53,15 @@ export type MessageUsage = {
 	};
 };
 
+// Timings of the stream that generated a message
+export type MessageStats = {
+	timeToFirstTokenMs?: number;
+	reasoningMs?: number; // From the first reasoning to the first content
+	totalMs: number;
+	tokensPerSecond?: number;
+	reasoningTokens?: number;
+};
+
 export type MessageMeta = {
 	edited?: boolean; // Indicates if the message has been edited by the user
 	originalMessageId?: string; // ID of the original message if this is an edit
@@ -30,11 +69,17 @@ export type MessageMeta = {
 	finishReason?: string; // Reason for the message generation finish (e.g., "stop", "length", etc.)
 	usage?: MessageUsage; // Usage stats for the message
 	modelOptions?: ResponseModelOptions; // Options used for the model
+	stats?: MessageStats; // Timings of the generation
 };
 
 export type MessageRole = "user" | "assistant" | "system";
 
-export type MessageStatus = "pending" | "generating" | "completed" | "failed";
+export type MessageStatus =
+	| "pending"
+	| "generating"
+	| "completed"
+	| "failed"
+	| "refused";
 
 export type Message = {
 	id: string;
@@ -48,6 +93,7 @@ export type Message = {
 
 	meta?: MessageMeta;
 	attachments?: string[]; // Array of attachment IDs
+	suggestions?: string[]; // Follow-up prompts generated once the response completed
 
 	created: string;
 	updated: string;
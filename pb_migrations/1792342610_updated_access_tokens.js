@@ -0,0 +1,81 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((app) => {
+  const collection = app.findCollectionByNameOrId("pbc_2984622541")
+
+  // add field
+  collection.fields.addAt(5, new Field({
+    "hidden": false,
+    "id": "select1568838183",
+    "maxSelect": 3,
+    "name": "scopes",
+    "presentable": false,
+    "required": false,
+    "system": false,
+    "type": "select",
+    "values": [
+      "read",
+      "chat",
+      "admin"
+    ]
+  }))
+
+  // add field
+  collection.fields.addAt(6, new Field({
+    "hidden": false,
+    "id": "date2356408712",
+    "max": "",
+    "min": "",
+    "name": "last_used_at",
+    "presentable": false,
+    "required": false,
+    "system": false,
+    "type": "date"
+  }))
+
+  // add field
+  collection.fields.addAt(7, new Field({
+    "hidden": false,
+    "id": "date261981154",
+    "max": "",
+    "min": "",
+    "name": "expires_at",
+    "presentable": false,
+    "required": false,
+    "system": false,
+    "type": "date"
+  }))
+
+  // add field
+  collection.fields.addAt(8, new Field({
+    "hidden": false,
+    "id": "date1386404917",
+    "max": "",
+    "min": "",
+    "name": "revoked_at",
+    "presentable": false,
+    "required": false,
+    "system": false,
+    "type": "date"
+  }))
+
+  app.save(collection)
+
+  // tokens minted before scopes existed were only usable for chat completions
+  app.db().newQuery("UPDATE access_tokens SET scopes = '[\"chat\"]' WHERE scopes = '' OR scopes = '[]'").execute()
+}, (app) => {
+  const collection = app.findCollectionByNameOrId("pbc_2984622541")
+
+  // remove field
+  collection.fields.removeById("select1568838183")
+
+  // remove field
+  collection.fields.removeById("date2356408712")
+
+  // remove field
+  collection.fields.removeById("date261981154")
+
+  // remove field
+  collection.fields.removeById("date1386404917")
+
+  return app.save(collection)
+})
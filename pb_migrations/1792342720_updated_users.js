@@ -0,0 +1,34 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((app) => {
+  const collection = app.findCollectionByNameOrId("_pb_users_auth_")
+
+  // update collection data
+  unmarshal({
+    "updateRule": "id = @request.auth.id && @request.body.disabled:isset = false"
+  }, collection)
+
+  // add field
+  collection.fields.addAt(9, new Field({
+    "hidden": false,
+    "id": "bool2185616402",
+    "name": "disabled",
+    "presentable": false,
+    "required": false,
+    "system": false,
+    "type": "bool"
+  }))
+
+  return app.save(collection)
+}, (app) => {
+  const collection = app.findCollectionByNameOrId("_pb_users_auth_")
+
+  // update collection data
+  unmarshal({
+    "updateRule": "id = @request.auth.id"
+  }, collection)
+
+  // remove field
+  collection.fields.removeById("bool2185616402")
+
+  return app.save(collection)
+})
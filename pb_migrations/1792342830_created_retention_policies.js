@@ -0,0 +1,96 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((app) => {
+  const collection = new Collection({
+    "createRule": "@request.auth.id != \"\" && @request.body.owner_user_id = @request.auth.id",
+    "deleteRule": "@request.auth.id != \"\" && owner_user_id = @request.auth.id",
+    "fields": [
+      {
+        "autogeneratePattern": "[a-z0-9]{15}",
+        "hidden": false,
+        "id": "text3208210256",
+        "max": 15,
+        "min": 15,
+        "name": "id",
+        "pattern": "^[a-z0-9]+$",
+        "presentable": false,
+        "primaryKey": true,
+        "required": true,
+        "system": true,
+        "type": "text"
+      },
+      {
+        "cascadeDelete": true,
+        "collectionId": "_pb_users_auth_",
+        "hidden": false,
+        "id": "relation723014986",
+        "maxSelect": 1,
+        "minSelect": 0,
+        "name": "owner_user_id",
+        "presentable": false,
+        "required": false,
+        "system": false,
+        "type": "relation"
+      },
+      {
+        "hidden": false,
+        "id": "number1952356408",
+        "max": 36500,
+        "min": 0,
+        "name": "thread_max_age_days",
+        "onlyInt": true,
+        "presentable": false,
+        "required": false,
+        "system": false,
+        "type": "number"
+      },
+      {
+        "hidden": false,
+        "id": "number2731870327",
+        "max": 36500,
+        "min": 0,
+        "name": "attachment_max_age_days",
+        "onlyInt": true,
+        "presentable": false,
+        "required": false,
+        "system": false,
+        "type": "number"
+      },
+      {
+        "hidden": false,
+        "id": "autodate2990389176",
+        "name": "created",
+        "onCreate": true,
+        "onUpdate": false,
+        "presentable": false,
+        "system": false,
+        "type": "autodate"
+      },
+      {
+        "hidden": false,
+        "id": "autodate3332085495",
+        "name": "updated",
+        "onCreate": true,
+        "onUpdate": true,
+        "presentable": false,
+        "system": false,
+        "type": "autodate"
+      }
+    ],
+    "id": "pbc_1874612305",
+    "indexes": [
+      "CREATE UNIQUE INDEX `idx_r7KpW2mQxT` ON `retention_policies` (`owner_user_id`)"
+    ],
+    "listRule": "@request.auth.id != \"\" && owner_user_id = @request.auth.id",
+    "name": "retention_policies",
+    "system": false,
+    "type": "base",
+    "updateRule": "@request.auth.id != \"\" && owner_user_id = @request.auth.id && (@request.body.owner_user_id:isset = false || @request.body.owner_user_id = @request.auth.id)",
+    "viewRule": "@request.auth.id != \"\" && owner_user_id = @request.auth.id"
+  });
+
+  return app.save(collection);
+}, (app) => {
+  const collection = app.findCollectionByNameOrId("pbc_1874612305");
+
+  return app.delete(collection);
+})
@@ -0,0 +1,40 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((app) => {
+  const collection = app.findCollectionByNameOrId("pbc_4275913271")
+
+  // update collection data
+  unmarshal({
+    "listRule": "@request.auth.id = owner_user_id && deleted_at = \"\"",
+    "updateRule": "@request.auth.id = owner_user_id && deleted_at = \"\" && @request.body.deleted_at:isset = false",
+    "viewRule": "@request.auth.id = owner_user_id || (deleted_at = \"\" && shared != \"\" && shared < @now)"
+  }, collection)
+
+  // add field
+  collection.fields.addAt(7, new Field({
+    "hidden": false,
+    "id": "date2264128713",
+    "max": "",
+    "min": "",
+    "name": "deleted_at",
+    "presentable": false,
+    "required": false,
+    "system": false,
+    "type": "date"
+  }))
+
+  return app.save(collection)
+}, (app) => {
+  const collection = app.findCollectionByNameOrId("pbc_4275913271")
+
+  // update collection data
+  unmarshal({
+    "listRule": "@request.auth.id = owner_user_id",
+    "updateRule": "@request.auth.id = owner_user_id",
+    "viewRule": "@request.auth.id = owner_user_id || (shared != \"\" && shared < @now)"
+  }, collection)
+
+  // remove field
+  collection.fields.removeById("date2264128713")
+
+  return app.save(collection)
+})
@@ -0,0 +1,22 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((app) => {
+  const collection = app.findCollectionByNameOrId("pbc_2605467279")
+
+  // update collection data
+  unmarshal({
+    "listRule": "@request.auth.id = owner_user_id || (parent_thread_id.deleted_at = \"\" && parent_thread_id.shared != \"\" && parent_thread_id.shared < @now)",
+    "viewRule": "@request.auth.id = owner_user_id || (parent_thread_id.deleted_at = \"\" && parent_thread_id.shared != \"\" && parent_thread_id.shared < @now)"
+  }, collection)
+
+  return app.save(collection)
+}, (app) => {
+  const collection = app.findCollectionByNameOrId("pbc_2605467279")
+
+  // update collection data
+  unmarshal({
+    "listRule": "@request.auth.id = owner_user_id || (parent_thread_id.shared != \"\" && parent_thread_id.shared < @now)",
+    "viewRule": "@request.auth.id = owner_user_id || (parent_thread_id.shared != \"\" && parent_thread_id.shared < @now)"
+  }, collection)
+
+  return app.save(collection)
+})
@@ -0,0 +1,44 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((app) => {
+  const collection = app.findCollectionByNameOrId("pbc_4275913271")
+
+  // update collection data
+  unmarshal({
+    "updateRule": "@request.auth.id = owner_user_id && deleted_at = \"\" && @request.body.deleted_at:isset = false && @request.body.project_id:isset = false"
+  }, collection)
+
+  // add field
+  collection.fields.addAt(8, new Field({
+    "cascadeDelete": false,
+    "collectionId": "pbc_2541054544",
+    "hidden": false,
+    "id": "relation3590218217",
+    "maxSelect": 1,
+    "minSelect": 0,
+    "name": "project_id",
+    "presentable": false,
+    "required": false,
+    "system": false,
+    "type": "relation"
+  }))
+
+  // add index
+  collection.indexes.push("CREATE INDEX `idx_Pj5nRw2kLs` ON `threads` (`project_id`)")
+
+  return app.save(collection)
+}, (app) => {
+  const collection = app.findCollectionByNameOrId("pbc_4275913271")
+
+  // update collection data
+  unmarshal({
+    "updateRule": "@request.auth.id = owner_user_id && deleted_at = \"\" && @request.body.deleted_at:isset = false"
+  }, collection)
+
+  // remove index
+  collection.indexes = collection.indexes.filter((index) => !index.includes("idx_Pj5nRw2kLs"))
+
+  // remove field
+  collection.fields.removeById("relation3590218217")
+
+  return app.save(collection)
+})
@@ -0,0 +1,35 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((app) => {
+  const collection = app.findCollectionByNameOrId("pbc_4275913271")
+
+  // update collection data
+  unmarshal({
+    "updateRule": "@request.auth.id = owner_user_id && deleted_at = \"\" && @request.body.deleted_at:isset = false && @request.body.project_id:isset = false && @request.body.tags:isset = false"
+  }, collection)
+
+  // add field
+  collection.fields.addAt(9, new Field({
+    "hidden": false,
+    "id": "json1874629670",
+    "maxSize": 0,
+    "name": "tags",
+    "presentable": false,
+    "required": false,
+    "system": false,
+    "type": "json"
+  }))
+
+  return app.save(collection)
+}, (app) => {
+  const collection = app.findCollectionByNameOrId("pbc_4275913271")
+
+  // update collection data
+  unmarshal({
+    "updateRule": "@request.auth.id = owner_user_id && deleted_at = \"\" && @request.body.deleted_at:isset = false && @request.body.project_id:isset = false"
+  }, collection)
+
+  // remove field
+  collection.fields.removeById("json1874629670")
+
+  return app.save(collection)
+})
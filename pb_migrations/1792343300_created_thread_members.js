@@ -0,0 +1,100 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((app) => {
+  const collection = new Collection({
+    "createRule": null,
+    "deleteRule": "@request.auth.id != \"\" && (user_id = @request.auth.id || thread_id.owner_user_id = @request.auth.id)",
+    "fields": [
+      {
+        "autogeneratePattern": "[a-z0-9]{15}",
+        "hidden": false,
+        "id": "text3208210256",
+        "max": 15,
+        "min": 15,
+        "name": "id",
+        "pattern": "^[a-z0-9]+$",
+        "presentable": false,
+        "primaryKey": true,
+        "required": true,
+        "system": true,
+        "type": "text"
+      },
+      {
+        "cascadeDelete": true,
+        "collectionId": "pbc_4275913271",
+        "hidden": false,
+        "id": "relation2446209813",
+        "maxSelect": 1,
+        "minSelect": 0,
+        "name": "thread_id",
+        "presentable": false,
+        "required": true,
+        "system": false,
+        "type": "relation"
+      },
+      {
+        "cascadeDelete": true,
+        "collectionId": "_pb_users_auth_",
+        "hidden": false,
+        "id": "relation2809058197",
+        "maxSelect": 1,
+        "minSelect": 0,
+        "name": "user_id",
+        "presentable": false,
+        "required": true,
+        "system": false,
+        "type": "relation"
+      },
+      {
+        "hidden": false,
+        "id": "select1466534506",
+        "maxSelect": 1,
+        "name": "role",
+        "presentable": false,
+        "required": true,
+        "system": false,
+        "type": "select",
+        "values": [
+          "viewer",
+          "contributor"
+        ]
+      },
+      {
+        "hidden": false,
+        "id": "autodate2990389176",
+        "name": "created",
+        "onCreate": true,
+        "onUpdate": false,
+        "presentable": false,
+        "system": false,
+        "type": "autodate"
+      },
+      {
+        "hidden": false,
+        "id": "autodate3332085495",
+        "name": "updated",
+        "onCreate": true,
+        "onUpdate": true,
+        "presentable": false,
+        "system": false,
+        "type": "autodate"
+      }
+    ],
+    "id": "pbc_1547905126",
+    "indexes": [
+      "CREATE UNIQUE INDEX `idx_Tm6cXe3rBw` ON `thread_members` (`thread_id`, `user_id`)",
+      "CREATE INDEX `idx_Ku9pLd4sVa` ON `thread_members` (`user_id`)"
+    ],
+    "listRule": "@request.auth.id != \"\" && (user_id = @request.auth.id || thread_id.owner_user_id = @request.auth.id)",
+    "name": "thread_members",
+    "system": false,
+    "type": "base",
+    "updateRule": null,
+    "viewRule": "@request.auth.id != \"\" && (user_id = @request.auth.id || thread_id.owner_user_id = @request.auth.id)"
+  });
+
+  return app.save(collection);
+}, (app) => {
+  const collection = app.findCollectionByNameOrId("pbc_1547905126");
+
+  return app.delete(collection);
+})
@@ -0,0 +1,22 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((app) => {
+  const collection = app.findCollectionByNameOrId("pbc_4275913271")
+
+  // update collection data
+  unmarshal({
+    "listRule": "deleted_at = \"\" && (@request.auth.id = owner_user_id || thread_members_via_thread_id.user_id ?= @request.auth.id)",
+    "viewRule": "@request.auth.id = owner_user_id || (deleted_at = \"\" && (thread_members_via_thread_id.user_id ?= @request.auth.id || (shared != \"\" && shared < @now)))"
+  }, collection)
+
+  return app.save(collection)
+}, (app) => {
+  const collection = app.findCollectionByNameOrId("pbc_4275913271")
+
+  // update collection data
+  unmarshal({
+    "listRule": "@request.auth.id = owner_user_id && deleted_at = \"\"",
+    "viewRule": "@request.auth.id = owner_user_id || (deleted_at = \"\" && shared != \"\" && shared < @now)"
+  }, collection)
+
+  return app.save(collection)
+})
@@ -0,0 +1,40 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((app) => {
+  const collection = app.findCollectionByNameOrId("pbc_2605467279")
+
+  // update collection data
+  unmarshal({
+    "listRule": "@request.auth.id = owner_user_id || (parent_thread_id.deleted_at = \"\" && (parent_thread_id.thread_members_via_thread_id.user_id ?= @request.auth.id || (parent_thread_id.shared != \"\" && parent_thread_id.shared < @now)))",
+    "viewRule": "@request.auth.id = owner_user_id || (parent_thread_id.deleted_at = \"\" && (parent_thread_id.thread_members_via_thread_id.user_id ?= @request.auth.id || (parent_thread_id.shared != \"\" && parent_thread_id.shared < @now)))"
+  }, collection)
+
+  // add field
+  collection.fields.addAt(3, new Field({
+    "cascadeDelete": false,
+    "collectionId": "_pb_users_auth_",
+    "hidden": false,
+    "id": "relation2133358452",
+    "maxSelect": 1,
+    "minSelect": 0,
+    "name": "author_user_id",
+    "presentable": false,
+    "required": false,
+    "system": false,
+    "type": "relation"
+  }))
+
+  return app.save(collection)
+}, (app) => {
+  const collection = app.findCollectionByNameOrId("pbc_2605467279")
+
+  // update collection data
+  unmarshal({
+    "listRule": "@request.auth.id = owner_user_id || (parent_thread_id.deleted_at = \"\" && parent_thread_id.shared != \"\" && parent_thread_id.shared < @now)",
+    "viewRule": "@request.auth.id = owner_user_id || (parent_thread_id.deleted_at = \"\" && parent_thread_id.shared != \"\" && parent_thread_id.shared < @now)"
+  }, collection)
+
+  // remove field
+  collection.fields.removeById("relation2133358452")
+
+  return app.save(collection)
+})
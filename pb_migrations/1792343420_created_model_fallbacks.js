@@ -0,0 +1,96 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((app) => {
+  const collection = new Collection({
+    "createRule": "@request.auth.id != \"\" && @request.body.owner_user_id = @request.auth.id",
+    "deleteRule": "@request.auth.id != \"\" && owner_user_id = @request.auth.id",
+    "fields": [
+      {
+        "autogeneratePattern": "[a-z0-9]{15}",
+        "hidden": false,
+        "id": "text3208210256",
+        "max": 15,
+        "min": 15,
+        "name": "id",
+        "pattern": "^[a-z0-9]+$",
+        "presentable": false,
+        "primaryKey": true,
+        "required": true,
+        "system": true,
+        "type": "text"
+      },
+      {
+        "cascadeDelete": true,
+        "collectionId": "_pb_users_auth_",
+        "hidden": false,
+        "id": "relation723014986",
+        "maxSelect": 1,
+        "minSelect": 0,
+        "name": "owner_user_id",
+        "presentable": false,
+        "required": true,
+        "system": false,
+        "type": "relation"
+      },
+      {
+        "autogeneratePattern": "",
+        "hidden": false,
+        "id": "text3616895705",
+        "max": 200,
+        "min": 1,
+        "name": "model",
+        "pattern": "",
+        "presentable": true,
+        "primaryKey": false,
+        "required": true,
+        "system": false,
+        "type": "text"
+      },
+      {
+        "hidden": false,
+        "id": "json2843312461",
+        "maxSize": 0,
+        "name": "fallbacks",
+        "presentable": false,
+        "required": true,
+        "system": false,
+        "type": "json"
+      },
+      {
+        "hidden": false,
+        "id": "autodate2990389176",
+        "name": "created",
+        "onCreate": true,
+        "onUpdate": false,
+        "presentable": false,
+        "system": false,
+        "type": "autodate"
+      },
+      {
+        "hidden": false,
+        "id": "autodate3332085495",
+        "name": "updated",
+        "onCreate": true,
+        "onUpdate": true,
+        "presentable": false,
+        "system": false,
+        "type": "autodate"
+      }
+    ],
+    "id": "pbc_2079513440",
+    "indexes": [
+      "CREATE UNIQUE INDEX `idx_Mf8wKd3pXa` ON `model_fallbacks` (`owner_user_id`, `model`)"
+    ],
+    "listRule": "@request.auth.id != \"\" && owner_user_id = @request.auth.id",
+    "name": "model_fallbacks",
+    "system": false,
+    "type": "base",
+    "updateRule": "@request.auth.id != \"\" && owner_user_id = @request.auth.id && (@request.body.owner_user_id:isset = false || @request.body.owner_user_id = @request.auth.id)",
+    "viewRule": "@request.auth.id != \"\" && owner_user_id = @request.auth.id"
+  });
+
+  return app.save(collection);
+}, (app) => {
+  const collection = app.findCollectionByNameOrId("pbc_2079513440");
+
+  return app.delete(collection);
+})
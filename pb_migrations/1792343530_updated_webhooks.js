@@ -0,0 +1,45 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((app) => {
+  const collection = app.findCollectionByNameOrId("pbc_3653375940")
+
+  // update field
+  collection.fields.addAt(5, new Field({
+    "hidden": false,
+    "id": "select1401378634",
+    "maxSelect": 4,
+    "name": "events",
+    "presentable": false,
+    "required": false,
+    "system": false,
+    "type": "select",
+    "values": [
+      "message.completed",
+      "message.failed",
+      "message.refused",
+      "thread.title_generated"
+    ]
+  }))
+
+  return app.save(collection)
+}, (app) => {
+  const collection = app.findCollectionByNameOrId("pbc_3653375940")
+
+  // update field
+  collection.fields.addAt(5, new Field({
+    "hidden": false,
+    "id": "select1401378634",
+    "maxSelect": 3,
+    "name": "events",
+    "presentable": false,
+    "required": false,
+    "system": false,
+    "type": "select",
+    "values": [
+      "message.completed",
+      "message.failed",
+      "thread.title_generated"
+    ]
+  }))
+
+  return app.save(collection)
+})
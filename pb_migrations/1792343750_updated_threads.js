@@ -0,0 +1,58 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((app) => {
+  const collection = app.findCollectionByNameOrId("pbc_4275913271")
+
+  // update collection data
+  unmarshal({
+    "updateRule": "@request.auth.id = owner_user_id && deleted_at = \"\" && @request.body.deleted_at:isset = false && @request.body.project_id:isset = false && @request.body.tags:isset = false && @request.body.summary:isset = false && @request.body.summary_message_id:isset = false"
+  }, collection)
+
+  // add field
+  collection.fields.addAt(10, new Field({
+    "autogeneratePattern": "",
+    "hidden": false,
+    "id": "text3815287604",
+    "max": 0,
+    "min": 0,
+    "name": "summary",
+    "pattern": "",
+    "presentable": false,
+    "primaryKey": false,
+    "required": false,
+    "system": false,
+    "type": "text"
+  }))
+
+  // add field
+  collection.fields.addAt(11, new Field({
+    "autogeneratePattern": "",
+    "hidden": false,
+    "id": "text1598342761",
+    "max": 26,
+    "min": 0,
+    "name": "summary_message_id",
+    "pattern": "",
+    "presentable": false,
+    "primaryKey": false,
+    "required": false,
+    "system": false,
+    "type": "text"
+  }))
+
+  return app.save(collection)
+}, (app) => {
+  const collection = app.findCollectionByNameOrId("pbc_4275913271")
+
+  // update collection data
+  unmarshal({
+    "updateRule": "@request.auth.id = owner_user_id && deleted_at = \"\" && @request.body.deleted_at:isset = false && @request.body.project_id:isset = false && @request.body.tags:isset = false"
+  }, collection)
+
+  // remove field
+  collection.fields.removeById("text3815287604")
+
+  // remove field
+  collection.fields.removeById("text1598342761")
+
+  return app.save(collection)
+})
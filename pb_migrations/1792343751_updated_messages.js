@@ -0,0 +1,25 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((app) => {
+  const collection = app.findCollectionByNameOrId("pbc_2605467279")
+
+  // add field
+  collection.fields.addAt(11, new Field({
+    "hidden": false,
+    "id": "json2690457813",
+    "maxSize": 0,
+    "name": "suggestions",
+    "presentable": false,
+    "required": false,
+    "system": false,
+    "type": "json"
+  }))
+
+  return app.save(collection)
+}, (app) => {
+  const collection = app.findCollectionByNameOrId("pbc_2605467279")
+
+  // remove field
+  collection.fields.removeById("json2690457813")
+
+  return app.save(collection)
+})